@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// exitCancelled is the exit code after an update was interrupted by SIGINT or SIGTERM
+const exitCancelled = 130
+
+// cancelMonitorWindow is how long the device is still monitored after an interrupted update
+// whose image was already fully transferred
+const cancelMonitorWindow = 5 * time.Second
+
+// errCancelled is returned by Update after it was interrupted with Cancel
+var errCancelled = errors.New("update cancelled")
+
+// uploadProgress tracks how much of the image has been handed to the HTTP transport
+type uploadProgress struct {
+	sent     atomic.Int64 // Image bytes read from the source into the request
+	size     atomic.Int64 // Image size, -1 if unknown
+	complete atomic.Bool  // The whole image was read into the request
+}
+
+// countingReader counts the bytes read from the firmware source
+type countingReader struct {
+	r        io.Reader
+	progress *uploadProgress
+	onRead   func(n int) // Called with the size of every chunk read, if set
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.progress.sent.Add(int64(n))
+	if n > 0 && r.onRead != nil {
+		r.onRead(n)
+	}
+	if err == io.EOF {
+		r.progress.complete.Store(true)
+	}
+	return n, err
+}
+
+// Cancel records that the update is being interrupted by sig. The caller then cancels the
+// context passed to Update, which reports the cancellation and returns errCancelled.
+func (c *SWUpdateClient) Cancel(sig os.Signal) {
+	c.cancelled.CompareAndSwap(nil, sig)
+}
+
+// cancelSignal returns the signal passed to Cancel, or nil if the update was not cancelled
+func (c *SWUpdateClient) cancelSignal() os.Signal {
+	sig, _ := c.cancelled.Load().(os.Signal)
+	return sig
+}
+
+// reportCancellation tells the user how far the interrupted update got. If the image was fully
+// transferred the device may still install it, so it is monitored for a few more seconds
+// over the still open WebSocket to report the outcome.
+func (c *SWUpdateClient) reportCancellation(monitorCtx context.Context) error {
+	sent, size := c.upload.sent.Load(), c.upload.size.Load()
+	transferred := c.upload.complete.Load()
+
+	data := map[string]interface{}{
+		"signal":      c.cancelSignal().String(),
+		"bytes_sent":  sent,
+		"transferred": transferred,
+	}
+	if size >= 0 {
+		data["image_size"] = size
+	}
+
+	var message string
+	switch {
+	case transferred:
+		c.logMessage("cancelled", "WARN", fmt.Sprintf("Cancelled after the image was fully transferred, the device may still install it; monitoring for %s", cancelMonitorWindow))
+		outcome := c.awaitOutcome(monitorCtx, cancelMonitorWindow)
+		data["outcome"] = outcome
+		message = fmt.Sprintf("Update cancelled after the image was fully transferred (installation: %s)", outcome)
+	case sent > 0:
+		message = fmt.Sprintf("Update cancelled after %s of %s were sent, the device discards the partial image", formatSize(sent), formatSize(size))
+	default:
+		message = "Update cancelled before the image was sent"
+	}
+
+	c.logEvent("cancelled", "WARN", message, data)
+	return errCancelled
+}
+
+// awaitOutcome waits up to window for the device to report the result of the installation
+// and returns "installed", "failed" or "unknown"
+func (c *SWUpdateClient) awaitOutcome(ctx context.Context, window time.Duration) string {
+	if c.wsConn == nil {
+		return "unknown"
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for {
+		result, lost, updated := c.state.result()
+		switch {
+		case result == "SUCCESS":
+			return "installed"
+		case result == "FAILURE":
+			return "failed"
+		case lost:
+			return "unknown"
+		}
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return "unknown"
+		case <-ctx.Done():
+			return "unknown"
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stallingDevice accepts part or all of an upload and then never answers, so the
+// test can cancel the update at a known point
+func stallingDevice(t *testing.T, readAll bool, received chan<- struct{}, afterUpload []SWUpdateEvent) *httptest.Server {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	uploaded := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			select {
+			case <-uploaded:
+			case <-r.Context().Done():
+				return
+			}
+			for _, event := range afterUpload {
+				time.Sleep(50 * time.Millisecond)
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+			_, _, _ = conn.ReadMessage()
+		case "/upload":
+			if readAll {
+				_, _ = io.Copy(io.Discard, r.Body)
+			} else {
+				_, _ = io.CopyN(io.Discard, r.Body, 64*1024)
+			}
+			close(uploaded)
+			received <- struct{}{}
+			// A partially read request is not cancelled when the client goes away, so wait for the test to end
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	return server
+}
+
+func runCancelledUpdate(t *testing.T, readAll bool, afterUpload []SWUpdateEvent) (LogMessage, error) {
+	t.Helper()
+
+	received := make(chan struct{}, 1)
+	server := stallingDevice(t, readAll, received, afterUpload)
+	client := NewSWUpdateClient(Config{
+		Target:     server.URL,
+		Filename:   writeTestFile(t, "image.swu", bytes.Repeat([]byte("x"), 4<<20)),
+		JSONOutput: true,
+		Timeout:    30 * time.Second,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-received
+		client.Cancel(os.Interrupt)
+		cancel()
+	}()
+
+	var err error
+	output := captureStdout(t, func() { err = client.Update(ctx, false) })
+
+	var final LogMessage
+	for _, line := range bytes.Split([]byte(output), []byte("\n")) {
+		var msg LogMessage
+		if json.Unmarshal(line, &msg) == nil && msg.Type == "cancelled" && msg.Data != nil {
+			final = msg
+		}
+	}
+	if final.Data == nil {
+		t.Fatalf("No final cancelled record in output:\n%s", output)
+	}
+	return final, err
+}
+
+func TestUpdate_CancelledDuringUpload(t *testing.T) {
+	final, err := runCancelledUpdate(t, false, nil)
+
+	if !errors.Is(err, errCancelled) {
+		t.Errorf("Update() error = %v, want errCancelled", err)
+	}
+	if final.Data["transferred"] != false || final.Data["signal"] != "interrupt" {
+		t.Errorf("Unexpected cancelled record: %+v", final.Data)
+	}
+	if sent := final.Data["bytes_sent"].(float64); sent <= 0 || sent >= 4<<20 {
+		t.Errorf("Expected a partial transfer, got %v bytes", sent)
+	}
+	if _, ok := final.Data["outcome"]; ok {
+		t.Error("Partial transfer should not wait for an installation outcome")
+	}
+}
+
+func TestUpdate_CancelledAfterTransfer(t *testing.T) {
+	events := []SWUpdateEvent{{Type: "status", Status: "RUN"}, {Type: "status", Status: "SUCCESS"}}
+	final, err := runCancelledUpdate(t, true, events)
+
+	if !errors.Is(err, errCancelled) {
+		t.Errorf("Update() error = %v, want errCancelled", err)
+	}
+	if final.Data["transferred"] != true || final.Data["bytes_sent"] != float64(4<<20) {
+		t.Errorf("Unexpected cancelled record: %+v", final.Data)
+	}
+	if final.Data["outcome"] != "installed" {
+		t.Errorf("Expected the monitored outcome to be reported, got %v", final.Data["outcome"])
+	}
+}
+
+func TestUpdate_CancelledDuringRestart(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	restarting := make(chan struct{})
+	dev.restart = func(w http.ResponseWriter, r *http.Request) {
+		close(restarting)
+		<-r.Context().Done()
+	}
+
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, JSONOutput: true}, 64<<10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-restarting
+		client.Cancel(os.Interrupt)
+		cancel()
+	}()
+
+	var err error
+	output := captureStdout(t, func() { err = client.Update(ctx, true) })
+	if !errors.Is(err, errCancelled) {
+		t.Errorf("Update() error = %v, want errCancelled", err)
+	}
+	if !strings.Contains(output, `"type":"cancelled"`) {
+		t.Errorf("No cancelled record in output:\n%s", output)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// errIncorrectPassphrase is returned when an encrypted key cannot be decrypted with the given passphrase
+var errIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// Object identifiers used by PKCS#5 v2.0 encrypted PKCS#8 keys
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// encryptedPrivateKeyInfo is the ASN.1 structure of an "ENCRYPTED PRIVATE KEY" PEM block (RFC 5208)
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params holds the key derivation and encryption scheme of a PBES2 encrypted key (RFC 8018)
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params holds the PBKDF2 salt, iteration count and pseudo-random function
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// validateClientCredentials checks that the client identity flags are used in a consistent combination
+func (c *SWUpdateClient) validateClientCredentials() error {
+	hasPair := c.config.ClientCertFile != "" || c.config.ClientKeyFile != ""
+
+	switch {
+	case c.config.ClientP12File != "" && hasPair:
+		return fmt.Errorf("-client-p12 cannot be combined with -client-cert or -client-key")
+	case c.config.ClientCertFile != "" && c.config.ClientKeyFile == "":
+		return fmt.Errorf("-client-cert requires -client-key")
+	case c.config.ClientKeyFile != "" && c.config.ClientCertFile == "":
+		return fmt.Errorf("-client-key requires -client-cert")
+	}
+	return nil
+}
+
+// clientIdentity holds the client certificate of a run, so an encrypted key is decrypted and its
+// passphrase asked for only once for all connections and devices
+type clientIdentity struct {
+	once sync.Once
+	cert *tls.Certificate
+	err  error
+}
+
+// clientCertificate returns the configured client identity, loading it on first use.
+// It returns nil if no client identity is configured.
+func (c *SWUpdateClient) clientCertificate() (*tls.Certificate, error) {
+	c.identity.once.Do(func() {
+		c.identity.cert, c.identity.err = c.loadClientCertificate()
+	})
+	return c.identity.cert, c.identity.err
+}
+
+// loadClientCertificate loads the configured client identity from a PEM pair or a PKCS#12 bundle.
+// It returns nil if no client identity is configured.
+func (c *SWUpdateClient) loadClientCertificate() (*tls.Certificate, error) {
+	if err := c.validateClientCredentials(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c.config.ClientP12File != "":
+		return c.loadPKCS12Certificate()
+	case c.config.ClientCertFile != "":
+		return c.loadPEMCertificate()
+	}
+	return nil, nil
+}
+
+// loadPEMCertificate loads a PEM certificate and private key, decrypting the key if it is encrypted
+func (c *SWUpdateClient) loadPEMCertificate() (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(c.config.ClientCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificate file: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(c.config.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client key file: %w", err)
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to parse client key file: no PEM data found")
+	}
+
+	if isEncryptedPEMBlock(block) {
+		passphrase, err := c.keyPassphrase(c.config.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, err = decryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt client key: %w", err)
+		}
+		keyPEM = pem.EncodeToMemory(block)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// loadPKCS12Certificate loads a client certificate, its private key and any intermediate certificates from a .p12 bundle
+func (c *SWUpdateClient) loadPKCS12Certificate() (*tls.Certificate, error) {
+	data, err := os.ReadFile(c.config.ClientP12File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PKCS#12 file: %w", err)
+	}
+
+	// Unprotected bundles are common in test setups, so try an empty password before asking for one
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, "")
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		var passphrase []byte
+		passphrase, err = c.keyPassphrase(c.config.ClientP12File)
+		if err != nil {
+			return nil, err
+		}
+		key, cert, caCerts, err = pkcs12.DecodeChain(data, string(passphrase))
+		if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+			err = errIncorrectPassphrase
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PKCS#12 file: %w", err)
+	}
+
+	tlsCert := tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+	for _, ca := range caCerts {
+		tlsCert.Certificate = append(tlsCert.Certificate, ca.Raw)
+	}
+	return &tlsCert, nil
+}
+
+// keyPassphrase returns the passphrase for an encrypted client key, read from a file,
+// an environment variable or an interactive prompt in that order of preference
+func (c *SWUpdateClient) keyPassphrase(source string) ([]byte, error) {
+	if c.config.KeyPassphraseFile != "" {
+		data, err := os.ReadFile(c.config.KeyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	if c.config.KeyPassphraseEnv != "" {
+		value, ok := os.LookupEnv(c.config.KeyPassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s is not set", c.config.KeyPassphraseEnv)
+		}
+		return []byte(value), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("%s is encrypted: use -key-passphrase-file or -key-passphrase-env when not running interactively", source)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", source)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return passphrase, nil
+}
+
+// isEncryptedPEMBlock reports whether a PEM block holds an encrypted private key,
+// either as PKCS#8 or in the legacy OpenSSL "Proc-Type: 4,ENCRYPTED" format
+func isEncryptedPEMBlock(block *pem.Block) bool {
+	//nolint:staticcheck // legacy encrypted PEM keys are still issued by older tooling
+	return block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)
+}
+
+// decryptPEMBlock decrypts an encrypted private key block and returns an unencrypted block
+func decryptPEMBlock(block *pem.Block, passphrase []byte) (*pem.Block, error) {
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+
+	//nolint:staticcheck // legacy encrypted PEM keys are still issued by older tooling
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err != nil {
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, errIncorrectPassphrase
+		}
+		return nil, err
+	}
+	return &pem.Block{Type: block.Type, Bytes: der}, nil
+}
+
+// decryptPKCS8 decrypts a PBES2 encrypted PKCS#8 key and returns the unencrypted PKCS#8 DER bytes
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption algorithm %s (only PBES2 is supported)", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid PBKDF2 parameters: %w", err)
+	}
+
+	prf, err := pbkdf2HashFunc(kdf.PRF.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	newCipher, keyLen, err := pbes2Cipher(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("invalid encryption scheme parameters: %w", err)
+	}
+
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLen, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid encrypted private key: bad IV or data length")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	plain, err = unpadPKCS7(plain, block.BlockSize())
+	if err != nil {
+		return nil, errIncorrectPassphrase
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(plain); err != nil {
+		return nil, errIncorrectPassphrase
+	}
+	return plain, nil
+}
+
+// pbkdf2HashFunc maps a PBKDF2 PRF identifier to its hash constructor, defaulting to HMAC-SHA1
+func pbkdf2HashFunc(oid asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(oid) == 0, oid.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case oid.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case oid.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case oid.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported PBKDF2 pseudo-random function %s", oid)
+}
+
+// pbes2Cipher maps a PBES2 encryption scheme identifier to its block cipher and key length
+func pbes2Cipher(oid asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case oid.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case oid.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case oid.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	case oid.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key encryption scheme %s", oid)
+}
+
+// unpadPKCS7 strips and validates PKCS#7 padding
+func unpadPKCS7(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty plaintext")
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	if !bytes.Equal(data[len(data)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return data[:len(data)-n], nil
+}
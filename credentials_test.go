@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newTestCertificate creates a self-signed certificate and its ECDSA private key
+func newTestCertificate(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "swupdate-client-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeTestFile writes data to a file in the test's temporary directory and returns its path
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encryptPKCS8 encrypts a PKCS#8 key with PBES2 (PBKDF2-HMAC-SHA256, AES-256-CBC) like `openssl pkcs8 -topk8 -v2 aes256`
+func encryptPKCS8(t *testing.T, der, passphrase []byte) []byte {
+	t.Helper()
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	_, _ = rand.Read(salt)
+	_, _ = rand.Read(iv)
+
+	key := pbkdf2.Key(passphrase, salt, 2048, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	plain := append(append([]byte{}, der...), make([]byte, pad)...)
+	for i := len(der); i < len(plain); i++ {
+		plain[i] = byte(pad)
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	kdfParams, _ := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: 2048,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	ivParams, _ := asn1.Marshal(iv)
+	schemeParams, _ := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	out, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: schemeParams}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestValidateClientCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{name: "No client identity", config: Config{}},
+		{name: "PEM pair", config: Config{ClientCertFile: "c.crt", ClientKeyFile: "c.key"}},
+		{name: "PKCS#12 bundle", config: Config{ClientP12File: "c.p12"}},
+		{name: "Cert without key", config: Config{ClientCertFile: "c.crt"}, wantErr: "-client-cert requires -client-key"},
+		{name: "Key without cert", config: Config{ClientKeyFile: "c.key"}, wantErr: "-client-key requires -client-cert"},
+		{name: "Bundle and pair", config: Config{ClientP12File: "c.p12", ClientCertFile: "c.crt", ClientKeyFile: "c.key"}, wantErr: "cannot be combined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewSWUpdateClient(tt.config).validateClientCredentials()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadClientCertificate_EncryptedPKCS8(t *testing.T) {
+	cert, key := newTestCertificate(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := writeTestFile(t, "client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	keyFile := writeTestFile(t, "client.key", pem.EncodeToMemory(&pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: encryptPKCS8(t, der, []byte("secret")),
+	}))
+
+	t.Setenv("SWUPDATE_TEST_PASS", "secret")
+	client := NewSWUpdateClient(Config{ClientCertFile: certFile, ClientKeyFile: keyFile, KeyPassphraseEnv: "SWUPDATE_TEST_PASS"})
+	tlsCert, err := client.loadClientCertificate()
+	if err != nil {
+		t.Fatalf("loadClientCertificate() error = %v", err)
+	}
+	if tlsCert == nil || len(tlsCert.Certificate) != 1 {
+		t.Fatal("Expected a client certificate to be loaded")
+	}
+
+	t.Setenv("SWUPDATE_TEST_PASS", "wrong")
+	_, err = client.loadClientCertificate()
+	if !errors.Is(err, errIncorrectPassphrase) {
+		t.Errorf("Expected incorrect passphrase error, got %v", err)
+	}
+}
+
+func TestLoadClientCertificate_LegacyEncryptedPEM(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//nolint:staticcheck // producing the legacy format is the point of this test
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := writeTestFile(t, "client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	keyFile := writeTestFile(t, "client.key", pem.EncodeToMemory(block))
+	passFile := writeTestFile(t, "pass.txt", []byte("secret\n"))
+
+	// The key does not belong to the certificate, so decryption must succeed and pairing must fail
+	client := NewSWUpdateClient(Config{ClientCertFile: certFile, ClientKeyFile: keyFile, KeyPassphraseFile: passFile})
+	_, err = client.loadClientCertificate()
+	if err == nil || !strings.Contains(err.Error(), "failed to load client certificate") {
+		t.Errorf("Expected key mismatch error after decryption, got %v", err)
+	}
+}
+
+func TestLoadClientCertificate_PKCS12(t *testing.T) {
+	cert, key := newTestCertificate(t)
+	pfx, err := pkcs12.Modern.Encode(key, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12File := writeTestFile(t, "client.p12", pfx)
+	passFile := writeTestFile(t, "pass.txt", []byte("secret"))
+
+	client := NewSWUpdateClient(Config{ClientP12File: p12File, KeyPassphraseFile: passFile})
+	tlsCert, err := client.loadClientCertificate()
+	if err != nil {
+		t.Fatalf("loadClientCertificate() error = %v", err)
+	}
+	if tlsCert.Leaf == nil || tlsCert.Leaf.Subject.CommonName != "swupdate-client-test" {
+		t.Error("Expected leaf certificate from PKCS#12 bundle")
+	}
+
+	wrongFile := writeTestFile(t, "wrong.txt", []byte("wrong"))
+	client = NewSWUpdateClient(Config{ClientP12File: p12File, KeyPassphraseFile: wrongFile})
+	if _, err := client.loadClientCertificate(); !errors.Is(err, errIncorrectPassphrase) {
+		t.Errorf("Expected incorrect passphrase error, got %v", err)
+	}
+}
+
+func TestClientCertificate_LoadedOnce(t *testing.T) {
+	cert, key := newTestCertificate(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writeTestFile(t, "client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	keyFile := writeTestFile(t, "client.key", pem.EncodeToMemory(&pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: encryptPKCS8(t, der, []byte("secret")),
+	}))
+
+	t.Setenv("SWUPDATE_TEST_PASS", "secret")
+	config := Config{ClientCertFile: certFile, ClientKeyFile: keyFile, KeyPassphraseEnv: "SWUPDATE_TEST_PASS"}
+	clients := newDeviceClients(config, []string{"https://10.0.0.1", "https://10.0.0.2"}, nil)
+	if _, err := clients[0].createTLSConfig(); err != nil {
+		t.Fatalf("createTLSConfig() error = %v", err)
+	}
+
+	// A changed passphrase would fail to decrypt the key, so later connections and devices must reuse it
+	t.Setenv("SWUPDATE_TEST_PASS", "wrong")
+	for _, client := range clients {
+		tlsConfig, err := client.createTLSConfig()
+		if err != nil {
+			t.Fatalf("createTLSConfig() error = %v", err)
+		}
+		if len(tlsConfig.Certificates) != 1 {
+			t.Error("Expected the cached client certificate")
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Update stages shown in the dashboard's phase column, JSON records and reports
+const (
+	stageWaiting    = "waiting"
+	stageConnecting = "connecting" // Connecting and pre-flight checks
+	stageUploading  = "uploading"
+	stageInstalling = "installing"
+	stageRebooting  = "rebooting"
+	stageVerifying  = "verifying" // Waiting for the device to come back after the restart
+	stageDone       = "done"
+)
+
+const (
+	dashboardRefresh = 250 * time.Millisecond // How often the dashboard is redrawn
+	dashboardLogSize = 200                    // Log lines kept per device
+)
+
+// abortSignal is recorded as the cancellation signal of a device aborted from the dashboard
+type abortSignal struct{}
+
+func (abortSignal) String() string { return "abort" }
+func (abortSignal) Signal()        {}
+
+// enterStage reports that the update reached a new stage
+func (c *SWUpdateClient) enterStage(stage string) {
+	c.stage.Store(stage)
+	c.report.begin(stage)
+	if c.row != nil {
+		c.row.setStage(stage)
+	}
+}
+
+// logWarning prints a warning that is not part of the structured output
+func (c *SWUpdateClient) logWarning(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	c.sendToSinks(c.newRecord(originClient, "warning", "WARN", message, nil))
+	if c.row != nil && c.row.log("Warning: "+message) {
+		return
+	}
+	c.logf(levelWarn, "Warning: %s", message)
+}
+
+// deviceRow is the dashboard's view of one device
+type deviceRow struct {
+	mu     sync.Mutex
+	label  string
+	upload *uploadProgress
+	client *SWUpdateClient
+
+	stage    string
+	started  time.Time
+	finished time.Time
+	step     int // Current step, 0 if unknown
+	steps    int // Number of steps, 0 if unknown
+	percent  int // Progress of the current step, -1 if unknown
+	message  string
+	lines    []string
+	result   string
+	cancel   context.CancelFunc
+	closed   bool // The dashboard was closed, output goes to the terminal again
+}
+
+// start marks the device's update as running; cancel aborts it
+func (r *deviceRow) start(cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.started, r.cancel = time.Now(), cancel
+}
+
+func (r *deviceRow) setStage(stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stage = stage
+}
+
+// log records a line of the device's output; it reports false once the dashboard is closed
+// and the line would never be shown
+func (r *deviceRow) log(line string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.message = line
+	r.lines = append(r.lines, line)
+	if len(r.lines) > dashboardLogSize {
+		r.lines = r.lines[len(r.lines)-dashboardLogSize:]
+	}
+	return true
+}
+
+// stepEvent records the install progress of a step event
+func (r *deviceRow) stepEvent(event SWUpdateEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if step, err := strconv.Atoi(event.Step); err == nil {
+		r.step = step
+	}
+	if steps, err := strconv.Atoi(event.Number); err == nil {
+		r.steps = steps
+	}
+	if percent, err := strconv.Atoi(event.Percent); err == nil {
+		r.percent = percent
+	}
+}
+
+// installPercent returns the overall install progress over all steps, or -1 if unknown
+func (r *deviceRow) installPercent() int {
+	if r.percent < 0 {
+		return -1
+	}
+	if r.steps > 0 && r.step > 0 {
+		return ((r.step-1)*100 + r.percent) / r.steps
+	}
+	return r.percent
+}
+
+// finish records the result of the device's update
+func (r *deviceRow) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.finished, r.stage = time.Now(), stageDone
+	switch {
+	case err == nil:
+		r.result = "ok"
+	case errors.Is(err, errCancelled):
+		r.result = "cancelled"
+		if _, ok := r.client.cancelSignal().(abortSignal); ok {
+			r.result = "aborted"
+		}
+	default:
+		r.result = "failed"
+		r.message = err.Error()
+		r.lines = append(r.lines, "Update failed: "+err.Error())
+	}
+}
+
+// abort cancels the device's update if it is still running
+func (r *deviceRow) abort() {
+	r.mu.Lock()
+	cancel := r.cancel
+	running := r.result == ""
+	r.mu.Unlock()
+
+	if cancel != nil && running {
+		r.client.Cancel(abortSignal{})
+		cancel()
+	}
+}
+
+// dashboard is a full-screen view of several concurrent updates with one row per device
+type dashboard struct {
+	mu        sync.Mutex
+	out       io.Writer
+	width     int
+	height    int
+	rows      []*deviceRow
+	selected  int
+	expanded  bool
+	interrupt func() // Cancels all updates
+
+	restore func()       // Restores the terminal
+	logs    bytes.Buffer // log output held back while the dashboard is shown
+	stop    chan struct{}
+	done    chan struct{}
+	closed  bool // Set by close; keys read afterwards are ignored
+}
+
+// newDashboard attaches a dashboard row to every client
+func newDashboard(out io.Writer, width, height int, clients []*SWUpdateClient, interrupt func()) *dashboard {
+	d := &dashboard{out: out, width: width, height: height, interrupt: interrupt}
+	for _, client := range clients {
+		row := &deviceRow{label: client.config.DeviceLabel, upload: &client.upload, client: client, stage: stageWaiting, percent: -1}
+		client.row = row
+		d.rows = append(d.rows, row)
+	}
+	return d
+}
+
+// newTerminalDashboard returns a dashboard for stdout, or nil when stdout is not a terminal
+func newTerminalDashboard(clients []*SWUpdateClient, interrupt func()) *dashboard {
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	width, height, err := term.GetSize(fd)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	return newDashboard(os.Stdout, width, height, clients, interrupt)
+}
+
+// start switches to the full-screen view and handles keys read from stdin
+func (d *dashboard) start() {
+	fd := int(os.Stdin.Fd())
+	d.restore = func() {}
+	if term.IsTerminal(fd) {
+		if state, err := term.MakeRaw(fd); err == nil {
+			d.restore = func() { _ = term.Restore(fd, state) }
+		}
+		go d.readKeys(os.Stdin)
+	}
+
+	log.SetOutput(&d.logs)
+	fmt.Fprint(d.out, "\x1b[?1049h\x1b[?25l")
+
+	d.stop, d.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(dashboardRefresh)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// close leaves the full-screen view, prints the result of every device and the held back log output
+func (d *dashboard) close() {
+	if d.stop == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+	d.stop = nil
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	fmt.Fprint(d.out, "\x1b[?25h\x1b[?1049l")
+	d.restore()
+	log.SetOutput(os.Stderr)
+
+	for _, row := range d.rows {
+		row.mu.Lock()
+		row.closed = true
+		line := fmt.Sprintf("%s: %s after %s", row.label, row.result, formatElapsed(row.finished.Sub(row.started)))
+		if row.result == "failed" {
+			line += ": " + row.message
+		}
+		row.mu.Unlock()
+		fmt.Fprintln(d.out, line)
+	}
+	_, _ = os.Stderr.Write(d.logs.Bytes())
+}
+
+// draw redraws the whole screen
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprint(d.out, "\x1b[H\x1b[2J"+strings.Join(d.render(time.Now()), "\r\n"))
+}
+
+// render returns the lines of the screen
+func (d *dashboard) render(now time.Time) []string {
+	labelWidth := len("DEVICE")
+	for _, row := range d.rows {
+		labelWidth = max(labelWidth, utf8.RuneCountInString(row.label))
+	}
+	labelWidth = min(labelWidth, 40)
+
+	lines := []string{
+		fmt.Sprintf("Updating %d devices   up/down: select   enter: show log   a: abort device   q: abort all", len(d.rows)),
+		"",
+		fmt.Sprintf("  %-*s  %-10s  %6s  %7s  %7s  %-9s  %s", labelWidth, "DEVICE", "PHASE", "UPLOAD", "INSTALL", "ELAPSED", "RESULT", "MESSAGE"),
+	}
+	for i, row := range d.rows {
+		cursor := "  "
+		if i == d.selected {
+			cursor = "> "
+		}
+		lines = append(lines, cursor+row.render(labelWidth, now))
+	}
+
+	if d.expanded && d.selected < len(d.rows) {
+		row := d.rows[d.selected]
+		row.mu.Lock()
+		history := row.lines
+		if room := d.height - len(lines) - 2; room > 0 && len(history) > room {
+			history = history[len(history)-room:]
+		}
+		lines = append(lines, "", "Log of "+row.label+":")
+		lines = append(lines, history...)
+		row.mu.Unlock()
+	}
+
+	if d.width > 1 {
+		for i, line := range lines {
+			lines[i] = truncateRunes(line, d.width-1)
+		}
+	}
+	if d.height > 0 && len(lines) > d.height {
+		lines = lines[:d.height]
+	}
+	return lines
+}
+
+// render formats the device's row
+func (r *deviceRow) render(labelWidth int, now time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	label := truncateRunes(r.label, labelWidth)
+
+	upload := "-"
+	if size := r.upload.size.Load(); size > 0 {
+		upload = fmt.Sprintf("%d%%", r.upload.sent.Load()*100/size)
+	}
+	install := "-"
+	if percent := r.installPercent(); percent >= 0 {
+		install = fmt.Sprintf("%d%%", percent)
+	}
+	elapsed := "-"
+	switch {
+	case !r.finished.IsZero():
+		elapsed = formatElapsed(r.finished.Sub(r.started))
+	case !r.started.IsZero():
+		elapsed = formatElapsed(now.Sub(r.started))
+	}
+
+	return fmt.Sprintf("%-*s  %-10s  %6s  %7s  %7s  %-9s  %s", labelWidth, label, r.stage, upload, install, elapsed, r.result, r.message)
+}
+
+// truncateRunes shortens s to at most n characters without splitting multi-byte characters
+func truncateRunes(s string, n int) string {
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// formatElapsed formats a duration as minutes and seconds
+func formatElapsed(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// readKeys handles key presses until r is closed
+func (d *dashboard) readKeys(r io.Reader) {
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		for _, key := range parseKeys(buf[:n]) {
+			d.handleKey(key)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseKeys translates raw terminal input into key names
+func parseKeys(input []byte) []string {
+	var keys []string
+	for i := 0; i < len(input); i++ {
+		switch b := input[i]; {
+		case b == 0x1b && i+2 < len(input) && input[i+1] == '[':
+			switch input[i+2] {
+			case 'A':
+				keys = append(keys, "up")
+			case 'B':
+				keys = append(keys, "down")
+			}
+			i += 2
+		case b == '\r' || b == '\n':
+			keys = append(keys, "enter")
+		case b == 3:
+			keys = append(keys, "ctrl-c")
+		default:
+			keys = append(keys, string(b))
+		}
+	}
+	return keys
+}
+
+// handleKey acts on a key press
+func (d *dashboard) handleKey(key string) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	switch key {
+	case "up", "k":
+		d.selected = max(d.selected-1, 0)
+	case "down", "j":
+		d.selected = min(d.selected+1, len(d.rows)-1)
+	case "enter", "l":
+		d.expanded = !d.expanded
+	case "a":
+		row := d.rows[d.selected]
+		d.mu.Unlock()
+		row.abort()
+		return
+	case "q", "ctrl-c":
+		d.mu.Unlock()
+		d.interrupt()
+		return
+	}
+	d.mu.Unlock()
+	d.draw()
+}
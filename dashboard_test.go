@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("j\x1b[A\x1b[Ba\rq\x03"))
+	want := []string{"j", "up", "down", "a", "enter", "q", "ctrl-c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestDashboard_Render(t *testing.T) {
+	clients := newDeviceClients(Config{}, []string{"http://10.0.0.1", "http://10.0.0.2"}, nil)
+	d := newDashboard(io.Discard, 120, 24, clients, func() {})
+
+	start := time.Now()
+	uploading := d.rows[0]
+	uploading.start(func() {})
+	uploading.started = start.Add(-75 * time.Second)
+	uploading.setStage(stageUploading)
+	clients[0].upload.size.Store(200)
+	clients[0].upload.sent.Store(50)
+	uploading.log("Uploading firmware: image.swu (0.00 MB)")
+
+	installed := d.rows[1]
+	installed.start(func() {})
+	installed.stepEvent(SWUpdateEvent{Type: "step", Step: "2", Number: "2", Name: "rootfs", Percent: "50"})
+	installed.log("Update process completed")
+	installed.finish(nil)
+
+	lines := d.render(start)
+	if len(lines) != 5 {
+		t.Fatalf("Expected header and 2 rows, got:\n%s", strings.Join(lines, "\n"))
+	}
+	for _, want := range []string{"> http://10.0.0.1", "uploading", "25%", "1:15", "Uploading firmware"} {
+		if !strings.Contains(lines[3], want) {
+			t.Errorf("Row %q does not contain %q", lines[3], want)
+		}
+	}
+	// Step 2 of 2 at 50% is 75% of the whole installation
+	for _, want := range []string{"  http://10.0.0.2", "done", "75%", "ok"} {
+		if !strings.Contains(lines[4], want) {
+			t.Errorf("Row %q does not contain %q", lines[4], want)
+		}
+	}
+
+	d.handleKey("down")
+	d.handleKey("enter")
+	lines = d.render(start)
+	if !strings.HasPrefix(lines[4], "> ") || lines[len(lines)-2] != "Log of http://10.0.0.2:" || lines[len(lines)-1] != "Update process completed" {
+		t.Errorf("Expected the second device's log to be expanded, got:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestDashboard_TruncatesCharacters(t *testing.T) {
+	label := strings.Repeat("ü", 50)
+	clients := newDeviceClients(Config{}, []string{label, "http://10.0.0.2"}, nil)
+	d := newDashboard(io.Discard, 61, 24, clients, func() {})
+	d.rows[0].log("Überprüfung läuft")
+
+	for _, line := range d.render(time.Now()) {
+		if !utf8.ValidString(line) || utf8.RuneCountInString(line) > 60 {
+			t.Errorf("Line %q is not cut to 60 characters", line)
+		}
+	}
+	if row := d.rows[0].render(40, time.Now()); !strings.HasPrefix(row, strings.Repeat("ü", 40)+"  ") {
+		t.Errorf("Label not cut to 40 characters in %q", row)
+	}
+}
+
+func TestDashboard_KeysAfterClose(t *testing.T) {
+	var out bytes.Buffer
+	clients := newDeviceClients(Config{}, []string{"http://10.0.0.1", "http://10.0.0.2"}, nil)
+	d := newDashboard(&out, 120, 24, clients, func() { t.Error("Interrupted after the dashboard was closed") })
+	d.restore = func() {}
+	d.stop, d.done = make(chan struct{}), make(chan struct{})
+	close(d.done)
+	d.close()
+
+	summary := out.String()
+	d.handleKey("down")
+	d.handleKey("q")
+	if out.String() != summary {
+		t.Errorf("A key press after close() redrew the screen:\n%q", strings.TrimPrefix(out.String(), summary))
+	}
+}
+
+func TestDashboard_AbortDevice(t *testing.T) {
+	good := newPhaseDevice(t)
+	good.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	stuck := newPhaseDevice(t)
+	stuck.upload = func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-stuck.release:
+		}
+	}
+
+	config := Config{
+		Filename:       writeTestFile(t, "image.swu", bytes.Repeat([]byte("x"), 64<<10)),
+		InstallTimeout: 5 * time.Second,
+	}
+	clients := newDeviceClients(config, []string{good.server.URL, stuck.server.URL}, nil)
+	d := newDashboard(io.Discard, 120, 24, clients, func() {})
+
+	go func() {
+		row := d.rows[1]
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			row.mu.Lock()
+			stage := row.stage
+			row.mu.Unlock()
+			if stage == stageUploading {
+				break
+			}
+		}
+		d.handleKey("down")
+		d.handleKey("a")
+	}()
+
+	if code := runUpdates(context.Background(), clients, false, 0); code != 1 {
+		t.Errorf("runUpdates() = %d, want 1 after aborting a device", code)
+	}
+	if d.rows[0].result != "ok" || d.rows[1].result != "aborted" {
+		t.Errorf("Results are %q and %q, want ok and aborted", d.rows[0].result, d.rows[1].result)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetList collects repeatable -target flags; several targets update several devices concurrently
+type targetList []string
+
+func (t *targetList) String() string {
+	return strings.Join(*t, ", ")
+}
+
+func (t *targetList) Set(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("empty target")
+	}
+	if _, err := parseTargetSpec(value); err != nil {
+		return err
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// targetSpec is a -target value: the device address, optionally followed by settings of that
+// device only, e.g. "http://10.0.0.1:8080,hw=myboard 1.0,version=2.1.0"
+type targetSpec struct {
+	Address       string
+	HWRevision    string // Overrides -hw-revision
+	DeviceVersion string // Overrides -device-version
+}
+
+// parseTargetSpec splits a -target value into the address and its comma-separated key=value settings
+func parseTargetSpec(value string) (targetSpec, error) {
+	parts := strings.Split(value, ",")
+	spec := targetSpec{Address: strings.TrimSpace(parts[0])}
+	for _, part := range parts[1:] {
+		key, setting, ok := strings.Cut(part, "=")
+		key, setting = strings.TrimSpace(key), strings.TrimSpace(setting)
+		switch {
+		case !ok || setting == "":
+			return spec, fmt.Errorf("invalid setting %q of target %q, expected key=value", part, spec.Address)
+		case key == "hw":
+			spec.HWRevision = setting
+		case key == "version":
+			spec.DeviceVersion = setting
+		default:
+			return spec, fmt.Errorf("unknown setting %q of target %q, expected hw or version", key, spec.Address)
+		}
+	}
+	return spec, nil
+}
+
+// newDeviceClients creates one client per target sharing config, the client identity, the download
+// cache and, if set, the aggregate upload limit. Settings given with a target override config for
+// that device. With several targets every client labels its output with its address.
+func newDeviceClients(config Config, targets []string, totalLimit *rateLimiter) []*SWUpdateClient {
+	if len(targets) == 0 {
+		targets = []string{config.Target}
+	}
+
+	clients := make([]*SWUpdateClient, 0, len(targets))
+	for _, target := range targets {
+		spec, err := parseTargetSpec(target)
+		if err != nil {
+			// Rejected by targetList.Set already; the device address then reports the problem
+			spec = targetSpec{Address: target}
+		}
+		deviceConfig := config
+		deviceConfig.Target = spec.Address
+		if spec.HWRevision != "" {
+			deviceConfig.HWRevision = spec.HWRevision
+		}
+		if spec.DeviceVersion != "" {
+			deviceConfig.DeviceVersion = spec.DeviceVersion
+		}
+		if len(targets) > 1 {
+			deviceConfig.DeviceLabel = spec.Address
+		}
+		client := NewSWUpdateClient(deviceConfig)
+		client.totalLimit = totalLimit
+		if len(clients) > 0 {
+			client.identity = clients[0].identity
+			client.cache = clients[0].cache
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// devicePrefix returns the prefix identifying the device in text output, empty for a single device
+func (c *SWUpdateClient) devicePrefix() string {
+	if c.config.DeviceLabel == "" {
+		return ""
+	}
+	return "[" + c.config.DeviceLabel + "] "
+}
+
+// runUpdates updates all devices, at most parallel at a time (0 for all at once), and returns
+// the exit code: exitCancelled if any update was cancelled, 1 if any failed, otherwise 0
+func runUpdates(ctx context.Context, clients []*SWUpdateClient, restart bool, parallel int) int {
+	if parallel <= 0 || parallel > len(clients) {
+		parallel = len(clients)
+	}
+
+	codes := make([]int, len(clients))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *SWUpdateClient) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			codes[i] = runUpdate(ctx, client, restart)
+		}(i, client)
+	}
+	wg.Wait()
+
+	exitCode, failed := 0, 0
+	for _, code := range codes {
+		switch {
+		case code == exitCancelled:
+			exitCode = exitCancelled
+		case code != 0:
+			failed++
+			if exitCode == 0 {
+				exitCode = code
+			}
+		}
+	}
+	if len(clients) > 1 && failed > 0 && clients[0].row == nil {
+		fmt.Fprintf(os.Stderr, "Update failed on %d of %d devices\n", failed, len(clients))
+	}
+	return exitCode
+}
+
+// runUpdate updates a single device, reporting the result, and returns its exit code. A device
+// aborted from the dashboard counts as failed.
+func runUpdate(ctx context.Context, client *SWUpdateClient, restart bool) int {
+	if client.row != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		client.row.start(cancel)
+	}
+
+	target, err := client.target()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sError: %v\n", client.devicePrefix(), err)
+		return 1
+	}
+
+	if client.config.TraceFile != "" || client.config.TraceEndpoint != "" {
+		client.trace = newUpdateTrace(map[string]interface{}{
+			"swupdate.device":  redactURL(client.deviceName()),
+			"swupdate.group":   client.config.DeviceGroup,
+			"swupdate.dry_run": client.config.DryRun,
+		})
+	}
+
+	if client.config.SessionDir != "" {
+		if client.session, err = client.openSession(); err != nil {
+			fmt.Fprintf(os.Stderr, "%sError: %v\n", client.devicePrefix(), err)
+			return 1
+		}
+	}
+
+	client.logMessage("connection", "INFO", fmt.Sprintf("Connecting to swupdate device at %s", target))
+
+	started := time.Now()
+	if !client.config.DryRun {
+		client.countMetric(metricUpdatesStarted, 1)
+	}
+	client.fireHook(hookStart, nil)
+	err = client.Update(ctx, restart)
+	client.report.finish(err)
+	if !client.config.DryRun {
+		client.observeUpdate(err)
+	}
+	if client.session != nil {
+		if closeErr := client.session.close(err); closeErr != nil {
+			client.logWarning("%v", closeErr)
+		}
+	}
+	if client.trace != nil {
+		if traceErr := client.exportTrace(ctx, err); traceErr != nil {
+			client.logWarning("%v", traceErr)
+		}
+	}
+	if client.config.HistoryFile != "" && !client.config.DryRun {
+		if historyErr := client.recordHistory(started, err); historyErr != nil {
+			client.logWarning("%v", historyErr)
+		}
+	}
+	if err != nil {
+		client.fireHook(hookFailure, err)
+	} else {
+		client.fireHook(hookSuccess, nil)
+	}
+	if client.row != nil {
+		client.row.finish(err)
+	}
+	if err != nil {
+		if _, aborted := client.cancelSignal().(abortSignal); aborted {
+			return 1
+		}
+		if errors.Is(err, errCancelled) {
+			return exitCancelled
+		}
+		if client.config.JSONOutput {
+			// Failed updates end with a result record as well, so even -quiet -json shows one per device
+			outcome := updateOutcome(err)
+			client.printRecord(client.newRecord(originClient, "outcome", "ERROR", fmt.Sprintf("Update failed: %v", err), map[string]interface{}{
+				"result": outcome.Result, "error": outcome.Error,
+			}))
+		}
+		if client.row == nil {
+			fmt.Fprintf(os.Stderr, "%sUpdate failed: %v\n", client.devicePrefix(), err)
+		}
+		return 1
+	}
+
+	if client.config.DryRun {
+		client.logMessage("completion", "INFO", "Dry run completed, nothing was sent to the device")
+		return 0
+	}
+	client.logMessage("completion", "INFO", "Update process completed")
+	return 0
+}
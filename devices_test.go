@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewDeviceClients(t *testing.T) {
+	total := newRateLimiter(1 << 20)
+	clients := newDeviceClients(Config{Target: "http://ignored"}, []string{"http://a:8080", "http://b:8080"}, total)
+	if len(clients) != 2 {
+		t.Fatalf("Expected 2 clients, got %d", len(clients))
+	}
+	for i, want := range []string{"http://a:8080", "http://b:8080"} {
+		if clients[i].config.Target != want || clients[i].config.DeviceLabel != want {
+			t.Errorf("Client %d has target %q and label %q, want %q", i, clients[i].config.Target, clients[i].config.DeviceLabel, want)
+		}
+		if clients[i].totalLimit != total {
+			t.Errorf("Client %d does not share the aggregate limit", i)
+		}
+	}
+
+	single := newDeviceClients(Config{IPAddress: "10.0.0.1"}, nil, nil)
+	if len(single) != 1 || single[0].config.DeviceLabel != "" {
+		t.Errorf("A single device should be unlabelled, got %+v", single)
+	}
+}
+
+func TestParseTargetSpec(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    targetSpec
+		wantErr string
+	}{
+		{"http://10.0.0.1:8080", targetSpec{Address: "http://10.0.0.1:8080"}, ""},
+		{"https://[fe80::1%eth0]:8443/swupdate/,hw=myboard 1.0", targetSpec{Address: "https://[fe80::1%eth0]:8443/swupdate/", HWRevision: "myboard 1.0"}, ""},
+		{"10.0.0.2, hw = 2.0", targetSpec{Address: "10.0.0.2", HWRevision: "2.0"}, ""},
+		{"10.0.0.6,version=2.1.0,hw=1.0", targetSpec{Address: "10.0.0.6", HWRevision: "1.0", DeviceVersion: "2.1.0"}, ""},
+		{"10.0.0.3,hw=", targetSpec{}, "expected key=value"},
+		{"10.0.0.4,board", targetSpec{}, "expected key=value"},
+		{"10.0.0.5,rev=1.0", targetSpec{}, `unknown setting "rev"`},
+	}
+	for _, tt := range tests {
+		got, err := parseTargetSpec(tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseTargetSpec(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseTargetSpec(%q) = %+v, %v; want %+v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewDeviceClients_TargetSettings(t *testing.T) {
+	clients := newDeviceClients(Config{HWRevision: "default 1.0"}, []string{"http://a:8080,hw=board-a 1.0,version=2.0.0", "http://b:8080"}, nil)
+	if clients[0].config.Target != "http://a:8080" || clients[0].config.DeviceLabel != "http://a:8080" || clients[0].config.HWRevision != "board-a 1.0" || clients[0].config.DeviceVersion != "2.0.0" {
+		t.Errorf("Unexpected config of the first device %+v", clients[0].config)
+	}
+	if clients[1].config.HWRevision != "default 1.0" {
+		t.Errorf("Second device has revision %q, want the configured one", clients[1].config.HWRevision)
+	}
+}
+
+func TestRunUpdates_SeveralDevices(t *testing.T) {
+	good := newPhaseDevice(t)
+	good.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	bad := newPhaseDevice(t)
+	bad.upload = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no space left", http.StatusInternalServerError)
+	}
+
+	config := Config{
+		Filename:       writeTestFile(t, "image.swu", bytes.Repeat([]byte("x"), 64<<10)),
+		JSONOutput:     true,
+		InstallTimeout: 5 * time.Second,
+	}
+	clients := newDeviceClients(config, []string{good.server.URL, bad.server.URL}, nil)
+
+	var code int
+	output := captureStdout(t, func() {
+		code = runUpdates(context.Background(), clients, false, 1)
+	})
+	if code != 1 {
+		t.Errorf("runUpdates() = %d, want 1 when one device fails", code)
+	}
+
+	completed := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		var msg LogMessage
+		if json.Unmarshal([]byte(line), &msg) == nil && msg.Type == "completion" {
+			completed[msg.Device] = true
+		}
+	}
+	if !completed[good.server.URL] || completed[bad.server.URL] {
+		t.Errorf("Expected only %s to complete, got %v", good.server.URL, completed)
+	}
+}
+
+func TestRunUpdates_SharedDownloadCache(t *testing.T) {
+	artifacts, requests := artifactServer(t, bytes.Repeat([]byte("x"), 256<<10), nil)
+	var targets []string
+	for i := 0; i < 3; i++ {
+		dev := newPhaseDevice(t)
+		dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+		targets = append(targets, dev.server.URL)
+	}
+
+	config := Config{
+		Filename:       artifacts.URL + "/fw.swu",
+		CacheDir:       t.TempDir(),
+		JSONOutput:     true,
+		InstallTimeout: 5 * time.Second,
+	}
+	clients := newDeviceClients(config, targets, nil)
+
+	var code int
+	output := captureStdout(t, func() {
+		code = runUpdates(context.Background(), clients, false, 0)
+	})
+	if code != 0 {
+		t.Fatalf("runUpdates() = %d, want 0:\n%s", code, output)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("Expected the image to be downloaded once, got %d requests", n)
+	}
+}
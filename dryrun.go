@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// redactedHeaderWords mark headers whose values are not printed in dry-run output or stored in session files
+var redactedHeaderWords = []string{"authorization", "cookie", "token", "secret", "key", "password"}
+
+// describeRequest reports the request that would be sent to the device in dry-run mode
+func (c *SWUpdateClient) describeRequest(action string, req *http.Request) {
+	headers := redactHeaders(req.Header)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if req.Host != "" {
+		headers["Host"] = req.Host
+	}
+
+	data := map[string]interface{}{
+		"action":  action,
+		"method":  req.Method,
+		"url":     redactURL(req.URL.String()),
+		"headers": headers,
+	}
+	body := "no body"
+	switch {
+	case req.ContentLength > 0:
+		data["content_length"] = req.ContentLength
+		body = fmt.Sprintf("%d byte body", req.ContentLength)
+	case req.Body != nil:
+		data["chunked"] = true
+		body = "chunked body of unknown size"
+	}
+
+	c.logEvent("dry-run", "INFO", fmt.Sprintf("Dry run: would %s: %s %s (%s)", action, req.Method, data["url"], body), data)
+
+	if c.logLevel() <= levelDebug && !c.config.JSONOutput {
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c.logf(levelDebug, "  %s: %s", name, headers[name])
+		}
+	}
+}
+
+// redactHeader hides the values of headers that usually carry credentials
+func redactHeader(name, value string) string {
+	lower := strings.ToLower(name)
+	for _, word := range redactedHeaderWords {
+		if strings.Contains(lower, word) {
+			return "<redacted>"
+		}
+	}
+	return value
+}
+
+// redactHeaders flattens headers, hiding the values of those that usually carry credentials
+func redactHeaders(header http.Header) map[string]string {
+	if len(header) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		headers[name] = redactHeader(name, strings.Join(values, ", "))
+	}
+	return headers
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUpdate_DryRun(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var mu sync.Mutex
+	var paths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/ws" {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	defer server.Close()
+
+	image := buildSWU(testSWDescription, []byte("rootfs"))
+	client := NewSWUpdateClient(Config{
+		Target:     server.URL,
+		Filename:   writeTestFile(t, "image.swu", image),
+		Token:      "secret-token",
+		Headers:    []string{"X-Tenant: acme"},
+		HWRevision: "1.2",
+		DryRun:     true,
+		JSONOutput: true,
+		Timeout:    5 * time.Second,
+	})
+
+	var err error
+	output := captureStdout(t, func() { err = client.Update(context.Background(), true) })
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/ws" {
+		t.Errorf("Dry run sent requests to %v, expected only the WebSocket connect", paths)
+	}
+
+	var actions []map[string]interface{}
+	for _, line := range strings.Split(output, "\n") {
+		var msg LogMessage
+		if json.Unmarshal([]byte(line), &msg) == nil && msg.Type == "dry-run" && msg.Data != nil {
+			actions = append(actions, msg.Data)
+		}
+	}
+	if len(actions) != 2 {
+		t.Fatalf("Expected upload and restart dry-run records, got %d:\n%s", len(actions), output)
+	}
+
+	upload, restart := actions[0], actions[1]
+	if upload["url"] != server.URL+"/upload" || upload["content_length"] == nil {
+		t.Errorf("Unexpected upload record: %v", upload)
+	}
+	headers := upload["headers"].(map[string]interface{})
+	if headers["Authorization"] != "<redacted>" || headers["X-Tenant"] != "acme" {
+		t.Errorf("Unexpected upload headers: %v", headers)
+	}
+	if !strings.HasPrefix(headers["Content-Type"].(string), "multipart/form-data") {
+		t.Errorf("Unexpected content type: %v", headers["Content-Type"])
+	}
+	if restart["url"] != server.URL+"/restart" || restart["method"] != "POST" {
+		t.Errorf("Unexpected restart record: %v", restart)
+	}
+	if !strings.Contains(output, "sw-description version 2.1.0") {
+		t.Errorf("Expected parsed image details in output:\n%s", output)
+	}
+}
+
+func TestUpdate_DryRunFailsPreflight(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	client := NewSWUpdateClient(Config{
+		Target:   server.URL,
+		Filename: writeTestFile(t, "image.swu", buildSWU(testSWDescription, nil)),
+		DryRun:   true,
+		Timeout:  time.Second,
+	})
+	if err := client.Update(context.Background(), false); err == nil {
+		t.Error("Expected dry run to fail when the WebSocket cannot be connected")
+	}
+
+	client = NewSWUpdateClient(Config{
+		Target:   server.URL,
+		Filename: writeTestFile(t, "broken.swu", []byte("not an image")),
+		DryRun:   true,
+		Timeout:  time.Second,
+	})
+	if err := client.uploadFirmware(context.Background()); err == nil {
+		t.Error("Expected dry run to fail for an unparsable image")
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	tests := map[string]bool{
+		"Authorization":   true,
+		"X-Api-Key":       true,
+		"X-Auth-Token":    true,
+		"Cookie":          true,
+		"X-Tenant":        false,
+		"Content-Type":    false,
+		"X-Forwarded-For": false,
+	}
+	for name, redacted := range tests {
+		if got := redactHeader(name, "value") == "<redacted>"; got != redacted {
+			t.Errorf("redactHeader(%q) redacted = %v, want %v", name, got, redacted)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// downloadAttempts is how often an interrupted download is resumed before giving up
+const downloadAttempts = 5
+
+// firmwareSource is an opened firmware image ready to be streamed into the upload
+type firmwareSource struct {
+	Name   string        // File name used for the multipart form part
+	Size   int64         // Size in bytes, or -1 if unknown
+	Reader io.ReadCloser // Image contents
+}
+
+// artifactCache serializes the downloads into -cache-dir of one run. The devices of a multi-target
+// run share it, so the image is downloaded once and the other devices use the cached copy instead
+// of writing the same partial file concurrently.
+type artifactCache struct {
+	mu      sync.Mutex
+	digests map[string]string // SHA-256 of each firmware URL downloaded in this run
+}
+
+// stdinFirmware is the -file value that reads the image from standard input
+const stdinFirmware = "-"
+
+// defaultUploadName is the multipart file name used when the source has none
+const defaultUploadName = "firmware.swu"
+
+// isRemoteFirmware reports whether the firmware location is a URL rather than a local path
+func isRemoteFirmware(location string) bool {
+	for _, prefix := range []string{"http://", "https://", "s3://", "oci://"} {
+		if strings.HasPrefix(location, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// openFirmware opens the configured firmware image from a local file, stdin, a remote URL or an OCI registry,
+// applying the -upload-name override. Remote images are streamed directly unless a checksum must be verified or a cache is
+// configured, in which case they are downloaded first.
+func (c *SWUpdateClient) openFirmware(ctx context.Context) (*firmwareSource, error) {
+	source, err := c.openFirmwareSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.UploadName != "" {
+		source.Name = c.config.UploadName
+	}
+	return source, nil
+}
+
+func (c *SWUpdateClient) openFirmwareSource(ctx context.Context) (*firmwareSource, error) {
+	switch {
+	case c.config.Filename == stdinFirmware:
+		return c.openStdinFirmware()
+	case strings.HasPrefix(c.config.Filename, "oci://"):
+		return c.openOCIFirmware(ctx)
+	case isRemoteFirmware(c.config.Filename):
+		return c.openRemoteFirmware(ctx)
+	}
+
+	file, err := os.Open(c.config.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", c.config.Filename, err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+
+	if c.config.FileSHA256 != "" {
+		if err := verifySHA256(file, c.config.FileSHA256); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return &firmwareSource{Name: filepath.Base(c.config.Filename), Size: stat.Size(), Reader: file}, nil
+}
+
+// openStdinFirmware reads the image from standard input. It is streamed as it arrives unless a
+// checksum must be verified first, in which case it is spooled to a temporary file.
+func (c *SWUpdateClient) openStdinFirmware() (*firmwareSource, error) {
+	return c.openStreamFirmware(os.Stdin)
+}
+
+// openStreamFirmware opens a pipe or redirected file as a firmware source
+func (c *SWUpdateClient) openStreamFirmware(in *os.File) (*firmwareSource, error) {
+	size := int64(-1)
+	if stat, err := in.Stat(); err == nil && stat.Mode().IsRegular() {
+		// Redirected from a file, so the size is known
+		size = stat.Size()
+	}
+
+	if c.config.FileSHA256 == "" {
+		return &firmwareSource{Name: defaultUploadName, Size: size, Reader: io.NopCloser(in)}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "swupdate-*.swu")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), in); err != nil {
+		tmp.Close()
+		cleanup()
+		return nil, fmt.Errorf("failed to read firmware from stdin: %w", err)
+	}
+	if digest, expected := hex.EncodeToString(h.Sum(nil)), strings.ToLower(c.config.FileSHA256); digest != expected {
+		tmp.Close()
+		cleanup()
+		return nil, fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, digest)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		cleanup()
+		return nil, err
+	}
+
+	source, err := openedFileSource(tmp, defaultUploadName)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	source.Reader = &cleanupReadCloser{ReadCloser: source.Reader, cleanup: cleanup}
+	return source, nil
+}
+
+// openRemoteFirmware opens an http(s):// or s3:// firmware image
+func (c *SWUpdateClient) openRemoteFirmware(ctx context.Context) (*firmwareSource, error) {
+	name := remoteFileName(c.config.Filename)
+	expected := strings.ToLower(c.config.FileSHA256)
+
+	if c.config.CacheDir == "" && expected == "" {
+		return c.streamRemoteFirmware(ctx, name)
+	}
+
+	if c.config.CacheDir != "" {
+		c.cache.mu.Lock()
+		defer c.cache.mu.Unlock()
+
+		digest := expected
+		if digest == "" {
+			digest = c.cache.digests[c.config.Filename]
+		}
+		if digest != "" {
+			if file, err := c.openCachedArtifact(digest); err == nil {
+				c.logMessage("download", "INFO", fmt.Sprintf("Using cached firmware %s (sha256 %s)", name, digest))
+				return openedFileSource(file, name)
+			}
+		}
+	}
+
+	path, cleanup, err := c.downloadFirmware(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.CacheDir != "" {
+		if c.cache.digests == nil {
+			c.cache.digests = make(map[string]string)
+		}
+		c.cache.digests[c.config.Filename] = filepath.Base(path) // Cached files are named after their digest
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	source, err := openedFileSource(file, name)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	source.Reader = &cleanupReadCloser{ReadCloser: source.Reader, cleanup: cleanup}
+	return source, nil
+}
+
+// streamRemoteFirmware returns the response body of the firmware URL for direct upload
+func (c *SWUpdateClient) streamRemoteFirmware(ctx context.Context, name string) (*firmwareSource, error) {
+	resp, err := c.fetchRemote(ctx, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	c.logMessage("download", "INFO", fmt.Sprintf("Streaming firmware from %s", redactURL(c.config.Filename)))
+	return &firmwareSource{Name: name, Size: resp.ContentLength, Reader: resp.Body}, nil
+}
+
+// downloadFirmware downloads the firmware URL to the cache or a temporary file, resuming interrupted
+// transfers, and verifies its checksum. The returned cleanup function removes temporary files.
+func (c *SWUpdateClient) downloadFirmware(ctx context.Context) (string, func(), error) {
+	var partial string
+	if c.config.CacheDir != "" {
+		if err := os.MkdirAll(filepath.Join(c.config.CacheDir, "partial"), 0755); err != nil {
+			return "", nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		sum := sha256.Sum256([]byte(c.config.Filename))
+		partial = filepath.Join(c.config.CacheDir, "partial", hex.EncodeToString(sum[:]))
+	} else {
+		tmp, err := os.CreateTemp("", "swupdate-*.swu")
+		if err != nil {
+			return "", nil, err
+		}
+		tmp.Close()
+		partial = tmp.Name()
+	}
+
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open download file: %w", err)
+	}
+	defer file.Close()
+
+	// The validator of the object the partial file belongs to is kept as long as the partial file
+	validator := partial + ".validator"
+	keepPartial := false
+	defer func() {
+		if !keepPartial {
+			os.Remove(validator)
+		}
+	}()
+
+	c.logMessage("download", "INFO", fmt.Sprintf("Downloading firmware from %s", redactURL(c.config.Filename)))
+
+	var lastErr error
+	for attempt := 0; attempt < downloadAttempts; attempt++ {
+		lastErr = c.downloadRange(ctx, file, validator)
+		if lastErr == nil || ctx.Err() != nil {
+			break
+		}
+		c.logf(levelDebug, "Download interrupted, resuming: %v", lastErr)
+	}
+	if lastErr != nil {
+		if c.config.CacheDir == "" {
+			os.Remove(partial)
+		} else {
+			keepPartial = true // Resumed by the next run
+		}
+		return "", nil, fmt.Errorf("failed to download firmware: %w", lastErr)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	digest, err := sha256Reader(file)
+	if err != nil {
+		return "", nil, err
+	}
+	if expected := strings.ToLower(c.config.FileSHA256); expected != "" && digest != expected {
+		// A corrupt partial download must not be resumed again
+		os.Remove(partial)
+		return "", nil, fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, digest)
+	}
+
+	if c.config.CacheDir == "" {
+		return partial, func() { os.Remove(partial) }, nil
+	}
+
+	cached := cachedArtifactPath(c.config.CacheDir, digest)
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	file.Close()
+	if err := os.Rename(partial, cached); err != nil {
+		return "", nil, fmt.Errorf("failed to store firmware in cache: %w", err)
+	}
+	c.logMessage("download", "INFO", fmt.Sprintf("Firmware cached as sha256 %s", digest))
+	return cached, func() {}, nil
+}
+
+// downloadRange appends the remainder of the firmware to file, starting at its current size.
+// The partial file is only resumed while the remote object still matches the ETag or Last-Modified
+// validator stored in validatorPath; otherwise the download starts over.
+func (c *SWUpdateClient) downloadRange(ctx context.Context, file *os.File, validatorPath string) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := stat.Size()
+
+	var validator string
+	if offset > 0 {
+		if data, err := os.ReadFile(validatorPath); err == nil {
+			validator = string(data)
+		}
+		if validator == "" {
+			// Without a validator the partial file may belong to an older version of the object
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	}
+
+	resp, err := c.fetchRemote(ctx, offset, validator)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		if total, ok := contentRangeTotal(resp.Header.Get("Content-Range")); ok && total == offset {
+			// The partial file is already complete
+			return nil
+		}
+		if err := discardPartial(file, validatorPath); err != nil {
+			return err
+		}
+		return fmt.Errorf("remote firmware changed since the partial download, starting over")
+	case resp.StatusCode == http.StatusPartialContent && responseValidator(resp) != validator:
+		// The server ignored If-Range
+		if err := discardPartial(file, validatorPath); err != nil {
+			return err
+		}
+		return fmt.Errorf("remote firmware changed since the partial download, starting over")
+	case resp.StatusCode != http.StatusPartialContent:
+		// The object changed or the server ignored the range request, start over
+		if err := discardPartial(file, validatorPath); err != nil {
+			return err
+		}
+		offset = 0
+		if validator := responseValidator(resp); validator != "" {
+			if err := os.WriteFile(validatorPath, []byte(validator), 0644); err != nil {
+				return fmt.Errorf("failed to store download validator: %w", err)
+			}
+		}
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
+
+// discardPartial empties a partial download and forgets its validator
+func discardPartial(file *os.File, validatorPath string) error {
+	os.Remove(validatorPath)
+	return file.Truncate(0)
+}
+
+// responseValidator returns the validator identifying the version of a remote object for If-Range:
+// its strong ETag, or its Last-Modified date; empty if it has neither
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// contentRangeTotal returns the complete length from a Content-Range header such as "bytes */1234"
+func contentRangeTotal(header string) (int64, bool) {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(header[i+1:], 10, 64)
+	return total, err == nil
+}
+
+// fetchRemote issues a GET for the firmware URL, requesting the bytes from offset onwards if the
+// object still matches validator. A 416 response is returned without error so callers can detect
+// a completed download.
+func (c *SWUpdateClient) fetchRemote(ctx context.Context, offset int64, validator string) (*http.Response, error) {
+	req, err := c.remoteRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+	if strings.HasPrefix(c.config.Filename, "s3://") {
+		signS3Request(req, s3CredentialsFromEnv(), c.s3Region())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch firmware: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return resp, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	return nil, fmt.Errorf("firmware download failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// remoteRequest builds the unsigned GET request for the firmware URL
+func (c *SWUpdateClient) remoteRequest(ctx context.Context) (*http.Request, error) {
+	location := c.config.Filename
+	if strings.HasPrefix(location, "s3://") {
+		var err error
+		location, err = s3ObjectURL(location, c.s3Endpoint())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+	return req, nil
+}
+
+// openedFileSource wraps an open file as a firmware source
+func openedFileSource(file *os.File, name string) (*firmwareSource, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get file stats: %w", err)
+	}
+	return &firmwareSource{Name: name, Size: stat.Size(), Reader: file}, nil
+}
+
+// openCachedArtifact opens the cached image with the given digest after checking that its contents
+// still match it. A corrupted or modified entry is removed, so the image is downloaded again.
+func (c *SWUpdateClient) openCachedArtifact(digest string) (*os.File, error) {
+	path := cachedArtifactPath(c.config.CacheDir, digest)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := sha256Reader(file)
+	if err == nil && actual != digest {
+		os.Remove(path)
+		err = fmt.Errorf("cached firmware does not match sha256 %s, got %s", digest, actual)
+		c.logWarning("%v, downloading it again", err)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// cachedArtifactPath returns the content-addressed cache location of an artifact
+func cachedArtifactPath(cacheDir, digest string) string {
+	return filepath.Join(cacheDir, "sha256", digest)
+}
+
+// remoteFileName derives the multipart file name from the last path element of a URL
+func remoteFileName(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return defaultUploadName
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return defaultUploadName
+	}
+	return name
+}
+
+// redactURL removes credentials and query parameters (which may hold pre-signed signatures) for logging
+func redactURL(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = "..."
+	}
+	return u.String()
+}
+
+// verifySHA256 checks the SHA-256 digest of r against the expected hex string
+func verifySHA256(r io.Reader, expected string) error {
+	digest, err := sha256Reader(r)
+	if err != nil {
+		return fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	if digest != strings.ToLower(expected) {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", strings.ToLower(expected), digest)
+	}
+	return nil
+}
+
+func sha256Reader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validateFirmwareOptions checks the firmware location and checksum options before connecting
+func (c *SWUpdateClient) validateFirmwareOptions() error {
+	if sum := c.config.FileSHA256; sum != "" {
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid -file-sha256 %q: expected 64 hex characters", sum)
+		}
+	}
+
+	if c.config.Filename == stdinFirmware {
+		return nil
+	}
+
+	if isRemoteFirmware(c.config.Filename) {
+		switch {
+		case strings.HasPrefix(c.config.Filename, "s3://"):
+			_, err := s3ObjectURL(c.config.Filename, c.s3Endpoint())
+			return err
+		case strings.HasPrefix(c.config.Filename, "oci://"):
+			_, err := parseOCIReference(c.config.Filename)
+			return err
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(c.config.Filename); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("firmware file '%s' does not exist", c.config.Filename)
+	}
+	return nil
+}
+
+// cleanupReadCloser runs a cleanup function after closing the underlying reader
+type cleanupReadCloser struct {
+	io.ReadCloser
+	cleanup func()
+}
+
+func (r *cleanupReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.cleanup()
+	return err
+}
+
+// formatSize renders a byte count in megabytes, or "size unknown"
+func formatSize(size int64) string {
+	if size < 0 {
+		return "size unknown"
+	}
+	return strconv.FormatFloat(float64(size)/(1024*1024), 'f', 2, 64) + " MB"
+}
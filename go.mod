@@ -2,6 +2,14 @@ module swupdate-client
 
 go 1.21
 
-require github.com/gorilla/websocket v1.5.1
+require (
+	github.com/gorilla/websocket v1.5.1
+	golang.org/x/crypto v0.14.0
+	golang.org/x/term v0.15.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
+)
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
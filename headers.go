@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTokenTTL is how long a token printed by -token-command is reused when it carries no expiry
+const defaultTokenTTL = 5 * time.Minute
+
+// tokenExpiryMargin renews command tokens slightly before they expire
+const tokenExpiryMargin = 30 * time.Second
+
+// headerList collects repeatable -header "Name: value" flags
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(value string) error {
+	if _, _, err := parseHeader(value); err != nil {
+		return err
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// parseHeader splits a "Name: value" header specification
+func parseHeader(spec string) (string, string, error) {
+	name, value, ok := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", fmt.Errorf("invalid header %q, expected \"Name: value\"", spec)
+	}
+	return textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value), nil
+}
+
+// tokenSource provides the bearer token from a static value, a file or a command.
+// Files are re-read on every request so rotated tokens are picked up; command output
+// is cached until the expiry it reports, or for the configured TTL.
+type tokenSource struct {
+	static  string
+	file    string
+	command string
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	cached string
+	expiry time.Time
+	now    func() time.Time
+}
+
+// newTokenSource returns a token source for the configuration, or nil if no token is configured
+func newTokenSource(config Config) *tokenSource {
+	if config.Token == "" && config.TokenFile == "" && config.TokenCommand == "" {
+		return nil
+	}
+	ttl := config.TokenTTL
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	return &tokenSource{
+		static:  config.Token,
+		file:    config.TokenFile,
+		command: config.TokenCommand,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// Token returns the current bearer token
+func (s *tokenSource) Token(ctx context.Context) (string, error) {
+	switch {
+	case s.static != "":
+		return s.static, nil
+	case s.file != "":
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cached != "" && s.now().Before(s.expiry) {
+		return s.cached, nil
+	}
+
+	output, err := shellCommand(ctx, s.command).Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %w", err)
+	}
+
+	token, expiry := parseTokenOutput(output, s.now(), s.ttl)
+	if token == "" {
+		return "", fmt.Errorf("token command produced no token")
+	}
+	s.cached, s.expiry = token, expiry
+	return token, nil
+}
+
+// parseTokenOutput extracts the token and its expiry from command output. The output may be the bare
+// token or a JSON object with "access_token" or "token" and "expires_in" (seconds) or "expires_at"/"expiry" (RFC 3339).
+func parseTokenOutput(output []byte, now time.Time, ttl time.Duration) (string, time.Time) {
+	output = bytes.TrimSpace(output)
+
+	var response struct {
+		AccessToken string    `json:"access_token"`
+		Token       string    `json:"token"`
+		ExpiresIn   int64     `json:"expires_in"`
+		ExpiresAt   time.Time `json:"expires_at"`
+		Expiry      time.Time `json:"expiry"`
+	}
+	if len(output) == 0 || output[0] != '{' || json.Unmarshal(output, &response) != nil {
+		return string(output), now.Add(ttl)
+	}
+
+	token := response.AccessToken
+	if token == "" {
+		token = response.Token
+	}
+
+	expiry := now.Add(ttl)
+	switch {
+	case response.ExpiresIn > 0:
+		expiry = now.Add(time.Duration(response.ExpiresIn) * time.Second)
+	case !response.ExpiresAt.IsZero():
+		expiry = response.ExpiresAt
+	case !response.Expiry.IsZero():
+		expiry = response.Expiry
+	}
+	return token, expiry.Add(-tokenExpiryMargin)
+}
+
+// shellCommand runs a command line through the platform shell
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// validateAuthOptions checks that at most one bearer token source is configured
+func (c *SWUpdateClient) validateAuthOptions() error {
+	sources := 0
+	for _, v := range []string{c.config.Token, c.config.TokenFile, c.config.TokenCommand} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("only one of -token, -token-file and -token-command may be used")
+	}
+	return nil
+}
+
+// requestHeaders returns the custom headers and bearer token applied to every request and the WebSocket handshake
+func (c *SWUpdateClient) requestHeaders(ctx context.Context) (http.Header, error) {
+	header := http.Header{}
+	for _, spec := range c.config.Headers {
+		name, value, err := parseHeader(spec)
+		if err != nil {
+			return nil, err
+		}
+		header.Add(name, value)
+	}
+
+	if c.tokens != nil {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header, nil
+}
+
+// applyHeaders adds the request headers to an HTTP request, honoring a "Host" override
+func (c *SWUpdateClient) applyHeaders(req *http.Request) error {
+	header, err := c.requestHeaders(req.Context())
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+	return nil
+}
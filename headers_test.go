@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHeaderListSet(t *testing.T) {
+	var headers headerList
+	if err := headers.Set("X-Tenant: acme"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := headers.Set("x-trace-id:abc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, invalid := range []string{"NoColon", ": value", "Bad Name: value"} {
+		if err := headers.Set(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+	if len(headers) != 2 {
+		t.Errorf("Expected 2 headers, got %d", len(headers))
+	}
+}
+
+func TestParseTokenOutput(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	token, expiry := parseTokenOutput([]byte("abc123\n"), now, time.Minute)
+	if token != "abc123" || !expiry.Equal(now.Add(time.Minute)) {
+		t.Errorf("Unexpected plain token result: %q %v", token, expiry)
+	}
+
+	token, expiry = parseTokenOutput([]byte(`{"access_token":"xyz","expires_in":3600}`), now, time.Minute)
+	if token != "xyz" || !expiry.Equal(now.Add(time.Hour-tokenExpiryMargin)) {
+		t.Errorf("Unexpected JSON token result: %q %v", token, expiry)
+	}
+
+	token, expiry = parseTokenOutput([]byte(`{"token":"t","expires_at":"2024-01-01T13:00:00Z"}`), now, time.Minute)
+	if token != "t" || !expiry.Equal(now.Add(time.Hour-tokenExpiryMargin)) {
+		t.Errorf("Unexpected expires_at result: %q %v", token, expiry)
+	}
+}
+
+func TestTokenSource_CommandCached(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell command")
+	}
+
+	counter := filepath.Join(t.TempDir(), "count")
+	source := newTokenSource(Config{TokenCommand: "echo x >> " + counter + "; wc -l < " + counter, TokenTTL: time.Hour})
+	now := time.Now()
+	source.now = func() time.Time { return now }
+
+	first, err := source.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := source.Token(context.Background())
+	if first != second {
+		t.Errorf("Expected cached token, got %q then %q", first, second)
+	}
+
+	now = now.Add(2 * time.Hour)
+	third, _ := source.Token(context.Background())
+	if third == first {
+		t.Errorf("Expected token to be renewed after expiry, got %q again", third)
+	}
+}
+
+func TestValidateAuthOptions(t *testing.T) {
+	client := NewSWUpdateClient(Config{Token: "a", TokenFile: "b"})
+	if err := client.validateAuthOptions(); err == nil {
+		t.Error("Expected error for multiple token sources")
+	}
+}
+
+func TestHeadersAppliedToAllRequests(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	seen := make(map[string]http.Header)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen[r.URL.Path] = r.Header.Clone()
+		if r.URL.Path == "/ws" {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err == nil {
+				conn.Close()
+			}
+		}
+	}))
+	defer server.Close()
+
+	file := writeTestFile(t, "firmware.swu", []byte("test firmware data"))
+	tokenFile := writeTestFile(t, "token", []byte("secret-token\n"))
+	client := NewSWUpdateClient(Config{
+		Target:    server.URL,
+		Filename:  file,
+		Timeout:   5 * time.Second,
+		Headers:   []string{"X-Tenant: acme"},
+		TokenFile: tokenFile,
+	})
+
+	ctx := context.Background()
+	if err := client.connectWebSocket(ctx); err != nil {
+		t.Fatalf("connectWebSocket() error = %v", err)
+	}
+	client.wsConn.Close()
+	if err := client.uploadFirmware(ctx); err != nil {
+		t.Fatalf("uploadFirmware() error = %v", err)
+	}
+	if err := client.restartDevice(ctx); err != nil {
+		t.Fatalf("restartDevice() error = %v", err)
+	}
+
+	for _, path := range []string{"/ws", "/upload", "/restart"} {
+		header, ok := seen[path]
+		if !ok {
+			t.Errorf("No request to %s", path)
+			continue
+		}
+		if got := header.Get("Authorization"); got != "Bearer secret-token" {
+			t.Errorf("%s: expected bearer token, got %q", path, got)
+		}
+		if got := header.Get("X-Tenant"); !strings.EqualFold(got, "acme") {
+			t.Errorf("%s: expected tenant header, got %q", path, got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// historyEntry is one update in the history file
+type historyEntry struct {
+	Device   string    `json:"device"`
+	Artifact string    `json:"artifact"`
+	Size     int64     `json:"size,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`  // Digest of the uploaded image, empty if the upload did not complete
+	Version  string    `json:"version,omitempty"` // Version declared in sw-description
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Result   string    `json:"result"` // passed, failed or cancelled
+	Error    string    `json:"error,omitempty"`
+}
+
+// historyMu serialises appends of concurrent device updates
+var historyMu sync.Mutex
+
+// defaultHistoryFile returns the history file in the user's configuration directory, empty if there is none
+func defaultHistoryFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "swupdate-client", "history.jsonl")
+}
+
+// recordsImage reports whether the name, digest and version of the uploaded image are collected
+func (c *SWUpdateClient) recordsImage() bool {
+	return c.session != nil || c.config.HistoryFile != "" || c.trace != nil || c.hooks != nil
+}
+
+// artifactName returns the name of the uploaded image, or of the configured file before the upload
+func (c *SWUpdateClient) artifactName() string {
+	if c.image.Name != "" {
+		return c.image.Name
+	}
+	return filepath.Base(redactURL(c.config.Filename))
+}
+
+// recordHistory appends the outcome of the update started at started to the history file
+func (c *SWUpdateClient) recordHistory(started time.Time, err error) error {
+	outcome := updateOutcome(err)
+	sha := c.image.SHA256
+	if sha == "" && c.upload.complete.Load() {
+		sha = strings.ToLower(c.config.FileSHA256)
+	}
+	device := redactURL(c.deviceName())
+	if target, err := c.target(); err == nil {
+		device = target.String()
+	}
+	entry := historyEntry{
+		Device:   device,
+		Artifact: c.artifactName(),
+		Size:     c.image.Size,
+		SHA256:   sha,
+		Version:  c.image.Version,
+		Started:  started,
+		Finished: time.Now(),
+		Result:   outcome.Result,
+		Error:    outcome.Error,
+	}
+	return appendHistory(c.config.HistoryFile, entry)
+}
+
+// appendHistory appends an entry to the history file at path, creating it if needed. Each entry
+// is written with a single append, so runs in other processes do not interleave with it.
+func appendHistory(path string, entry historyEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode history entry: %w", err)
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return nil
+}
+
+// readHistory reads all entries of the history file at path; a missing file has none
+func readHistory(path string) ([]historyEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer file.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid history entry: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+	return entries, nil
+}
+
+// historyFilter selects history entries; empty fields match everything
+type historyFilter struct {
+	Device  string    // Device address or URL, compared in normalized form
+	Port    int       // Port of a device address without one
+	Version string    // sw-description version
+	Since   time.Time // Updates started at or after this time
+	Until   time.Time // Updates started before this time
+}
+
+func (f historyFilter) matches(entry historyEntry) bool {
+	switch {
+	case f.Device != "" && historyDevice(entry.Device, f.Port) != historyDevice(f.Device, f.Port):
+		return false
+	case f.Version != "" && entry.Version != f.Version:
+		return false
+	case !f.Since.IsZero() && entry.Started.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.Started.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// historyDevice normalizes a device address to the base URL recorded in the history, so that
+// "10.0.0.1", "10.0.0.1:8080" and "http://10.0.0.1:8080/" select the same updates
+func historyDevice(spec string, port int) string {
+	target, err := parseTarget(spec, port, false, "")
+	if err != nil {
+		return strings.TrimSuffix(spec, "/")
+	}
+	return target.String()
+}
+
+// historyTimeLayouts are accepted by -since and -until, in local time unless a zone is given
+var historyTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseHistoryTime parses a -since or -until time. A date without a time of day stands for the
+// start of the day, or with endOfDay for the start of the next day, so -until includes the date.
+func parseHistoryTime(value string, endOfDay bool) (time.Time, error) {
+	for _, layout := range historyTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" && endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DD or RFC 3339", value)
+}
+
+// runHistory queries the update history and returns the exit code
+func runHistory(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	path := flags.String("history-file", defaultHistoryFile(), "Update history file")
+	device := flags.String("device", "", "Only updates of this device (address or URL)")
+	port := flags.Int("port", 8080, "Port of a -device address given without one")
+	version := flags.String("version", "", "Only updates installing this sw-description version")
+	since := flags.String("since", "", "Only updates started at or after this date or time")
+	until := flags.String("until", "", "Only updates started before the end of this date, or before this time")
+	jsonOutput := flags.Bool("json", false, "Export the entries as a JSON array")
+	csvOutput := flags.Bool("csv", false, "Export the entries as CSV")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s history [options]\n\nOptions:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 1
+	}
+
+	filter := historyFilter{Device: *device, Port: *port, Version: *version}
+	var err error
+	if *since != "" {
+		if filter.Since, err = parseHistoryTime(*since, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -since: %v\n", err)
+			return 1
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = parseHistoryTime(*until, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -until: %v\n", err)
+			return 1
+		}
+	}
+	if *path == "" {
+		fmt.Fprintf(os.Stderr, "Error: no history file, set -history-file\n")
+		return 1
+	}
+
+	entries, err := readHistory(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	selected := []historyEntry{}
+	for _, entry := range entries {
+		if filter.matches(entry) {
+			selected = append(selected, entry)
+		}
+	}
+
+	switch {
+	case *jsonOutput:
+		err = writeHistoryJSON(os.Stdout, selected)
+	case *csvOutput:
+		err = writeHistoryCSV(os.Stdout, selected)
+	default:
+		err = writeHistoryTable(os.Stdout, selected)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// writeHistoryJSON exports entries as an indented JSON array
+func writeHistoryJSON(w io.Writer, entries []historyEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// historyCSVHeader names the columns of the CSV export
+var historyCSVHeader = []string{"device", "artifact", "size", "sha256", "version", "started", "finished", "result", "error"}
+
+// writeHistoryCSV exports entries as CSV with a header row
+func writeHistoryCSV(w io.Writer, entries []historyEntry) error {
+	writer := csv.NewWriter(w)
+	writer.Write(historyCSVHeader)
+	for _, entry := range entries {
+		writer.Write([]string{
+			entry.Device,
+			entry.Artifact,
+			strconv.FormatInt(entry.Size, 10),
+			entry.SHA256,
+			entry.Version,
+			entry.Started.Format(time.RFC3339),
+			entry.Finished.Format(time.RFC3339),
+			entry.Result,
+			entry.Error,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
+
+// writeHistoryTable prints entries as an aligned table, oldest first
+func writeHistoryTable(w io.Writer, entries []historyEntry) error {
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, "No updates recorded")
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STARTED\tDEVICE\tVERSION\tARTIFACT\tSHA-256\tDURATION\tRESULT")
+	for _, entry := range entries {
+		version, sha := entry.Version, entry.SHA256
+		if version == "" {
+			version = "-"
+		}
+		if len(sha) > 12 {
+			sha = sha[:12]
+		} else if sha == "" {
+			sha = "-"
+		}
+		result := entry.Result
+		if entry.Error != "" {
+			result += ": " + entry.Error
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Started.Local().Format("2006-01-02 15:04:05"), entry.Device, version, entry.Artifact, sha,
+			entry.Finished.Sub(entry.Started).Round(time.Second), result)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory_RecordsUpdates(t *testing.T) {
+	image := buildSWU(testSWDescription, []byte("payload"))
+	path := filepath.Join(t.TempDir(), "state", "history.jsonl")
+	config := Config{
+		Filename:       writeTestFile(t, "image.swu", image),
+		InstallTimeout: 5 * time.Second,
+		HistoryFile:    path,
+	}
+
+	// A scripted device takes a single upload, so every update gets its own
+	var targets []string
+	for _, status := range []string{"SUCCESS", "FAILURE"} {
+		dev := newPhaseDevice(t)
+		dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: status}}
+		config.Target = dev.server.URL
+		targets = append(targets, dev.server.URL)
+		captureStdout(t, func() { runUpdate(context.Background(), NewSWUpdateClient(config), false) })
+	}
+
+	entries, err := readHistory(path)
+	if err != nil {
+		t.Fatalf("readHistory() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected two history entries, got %+v", entries)
+	}
+
+	digest := sha256.Sum256(image)
+	passed, failed := entries[0], entries[1]
+	if passed.Result != "passed" || passed.Artifact != "image.swu" || passed.Version != "2.1.0" || passed.SHA256 != hex.EncodeToString(digest[:]) {
+		t.Errorf("Unexpected entry for the passed update %+v", passed)
+	}
+	if !strings.HasPrefix(passed.Device, targets[0]) || passed.Finished.Before(passed.Started) {
+		t.Errorf("Unexpected device or times in %+v", passed)
+	}
+	if failed.Result != "failed" || !strings.Contains(failed.Error, "installation failed") {
+		t.Errorf("Unexpected entry for the failed update %+v", failed)
+	}
+}
+
+func TestHistory_SeveralDevicesRecordURLs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	config := Config{
+		Filename:       writeTestFile(t, "image.swu", buildSWU(testSWDescription, []byte("payload"))),
+		JSONOutput:     true,
+		InstallTimeout: 5 * time.Second,
+		HistoryFile:    path,
+	}
+
+	// The second target is unreachable, only its label differs from the recorded URL
+	address := strings.TrimPrefix(dev.server.URL, "http://")
+	clients := newDeviceClients(config, []string{address, "127.0.0.1:1"}, nil)
+	captureStdout(t, func() { runUpdates(context.Background(), clients, false, 0) })
+
+	entries, err := readHistory(path)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("readHistory() = %+v, %v; want two entries", entries, err)
+	}
+	devices := map[string]bool{}
+	for _, entry := range entries {
+		devices[entry.Device] = true
+	}
+	if !devices[dev.server.URL+"/"] || !devices["http://127.0.0.1:1/"] {
+		t.Errorf("Expected normalized device URLs, got %+v", entries)
+	}
+	if got := (historyFilter{Device: address}); !got.matches(historyEntry{Device: dev.server.URL + "/"}) {
+		t.Errorf("Filter %q does not select the update recorded for it", address)
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 12, 0, 0, 0, time.Local) }
+	entries := []historyEntry{
+		{Device: "http://10.0.0.1:8080/", Version: "1.0.0", Started: day(1)},
+		{Device: "http://10.0.0.2:8080/", Version: "1.0.0", Started: day(2)},
+		{Device: "http://10.0.0.1:8080/", Version: "1.1.0", Started: day(3)},
+	}
+
+	since, _ := parseHistoryTime("2024-03-02", false)
+	until, _ := parseHistoryTime("2024-03-02", true)
+	tests := []struct {
+		name   string
+		filter historyFilter
+		want   int
+	}{
+		{"all", historyFilter{}, 3},
+		{"device without trailing slash", historyFilter{Device: "http://10.0.0.1:8080"}, 2},
+		{"device address", historyFilter{Device: "10.0.0.1", Port: 8080}, 2},
+		{"device address with port", historyFilter{Device: "10.0.0.2:8080"}, 1},
+		{"device on another port", historyFilter{Device: "10.0.0.1", Port: 9000}, 0},
+		{"version", historyFilter{Version: "1.0.0"}, 2},
+		{"since", historyFilter{Since: since}, 2},
+		{"until includes the date", historyFilter{Until: until}, 2},
+		{"single day", historyFilter{Since: since, Until: until}, 1},
+		{"device and version", historyFilter{Device: "http://10.0.0.1:8080/", Version: "1.1.0"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := 0
+			for _, entry := range entries {
+				if tt.filter.matches(entry) {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("matches() selected %d entries, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseHistoryTime("yesterday", false); err == nil {
+		t.Error("Expected an error for an invalid time")
+	}
+}
+
+func TestRunHistory_Export(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, entry := range []historyEntry{
+		{Device: "gw-1", Artifact: "fw.swu", Version: "1.0.0", Started: started, Finished: started.Add(time.Minute), Result: "passed"},
+		{Device: "gw-2", Artifact: "fw.swu", Version: "1.0.0", Started: started, Finished: started.Add(time.Minute), Result: "failed", Error: "installation failed, \"rootfs\""},
+	} {
+		if err := appendHistory(path, entry); err != nil {
+			t.Fatalf("appendHistory() error = %v", err)
+		}
+	}
+
+	var code int
+	output := captureStdout(t, func() { code = runHistory([]string{"-history-file", path, "-device", "gw-2", "-csv"}) })
+	if code != 0 {
+		t.Fatalf("runHistory() = %d, want 0", code)
+	}
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV %q: %v", output, err)
+	}
+	if len(records) != 2 || records[0][0] != "device" || records[1][0] != "gw-2" || records[1][8] != "installation failed, \"rootfs\"" {
+		t.Errorf("Unexpected CSV export %q", records)
+	}
+
+	output = captureStdout(t, func() { code = runHistory([]string{"-history-file", path, "-version", "2.0.0", "-json"}) })
+	var exported []historyEntry
+	if err := json.Unmarshal([]byte(output), &exported); err != nil || code != 0 || len(exported) != 0 {
+		t.Errorf("Expected an empty JSON array, got %q (code %d, err %v)", output, code, err)
+	}
+
+	output = captureStdout(t, func() { code = runHistory([]string{"-history-file", path}) })
+	if code != 0 || !strings.Contains(output, "gw-1") || !strings.Contains(output, "failed: installation failed") {
+		t.Errorf("Unexpected table (code %d):\n%s", code, output)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Lifecycle events that trigger hooks
+const (
+	hookStart          = "start"           // The update of a device begins
+	hookUploadComplete = "upload-complete" // The device accepted the image
+	hookRestart        = "restart"         // The device was asked to restart
+	hookSuccess        = "success"         // The update completed successfully
+	hookFailure        = "failure"         // The update failed or was cancelled
+)
+
+// hookEvents lists the lifecycle events in the order they occur
+var hookEvents = []string{hookStart, hookUploadComplete, hookRestart, hookSuccess, hookFailure}
+
+// Hook defaults
+const (
+	defaultHookTimeout = 10 * time.Second
+	defaultHookRetries = 2
+)
+
+// hookWaitNotice is how long the hooks still running at exit are waited for before they are listed
+var hookWaitNotice = time.Second
+
+// hookRetryDelay is the pause before a hook is retried, multiplied by the attempt number
+var hookRetryDelay = time.Second
+
+// flagList collects a repeatable string flag
+type flagList []string
+
+func (l *flagList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *flagList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// hookEvent describes a lifecycle event; it is the default webhook body and the data of -webhook-template
+type hookEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Device   string    `json:"device"`
+	Group    string    `json:"group,omitempty"`
+	Artifact string    `json:"artifact,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Status   string    `json:"status"` // running, passed, failed or cancelled
+	Error    string    `json:"error,omitempty"`
+}
+
+// hookRunner delivers lifecycle events to webhooks and commands in the background
+type hookRunner struct {
+	webhooks []string
+	commands []string
+	template *template.Template // Webhook body template, nil for the JSON of hookEvent
+	events   map[string]bool    // Events that trigger hooks
+	timeout  time.Duration      // Per attempt
+	retries  int
+	client   *http.Client
+	wg       sync.WaitGroup
+
+	stderrLevel logLevel // Minimum level of the notice printed while waiting for hooks
+
+	mu      sync.Mutex
+	pending map[string]int // Deliveries in progress by hook and event
+}
+
+// newHookRunner creates the hook runner for the configured hooks, nil if there are none
+func newHookRunner(config Config) (*hookRunner, error) {
+	if len(config.Webhooks) == 0 && len(config.HookCommands) == 0 {
+		return nil, nil
+	}
+
+	h := &hookRunner{
+		webhooks: config.Webhooks,
+		commands: config.HookCommands,
+		events:   make(map[string]bool),
+		timeout:  config.HookTimeout,
+		retries:  max(config.HookRetries, 0),
+		client:   &http.Client{},
+
+		stderrLevel: config.StderrLevel,
+		pending:     make(map[string]int),
+	}
+	if h.timeout <= 0 {
+		h.timeout = defaultHookTimeout
+	}
+
+	for _, event := range config.HookEvents {
+		for _, name := range strings.Split(event, ",") {
+			name = strings.TrimSpace(name)
+			if !containsString(hookEvents, name) {
+				return nil, fmt.Errorf("unknown hook event %q, expected one of %s", name, strings.Join(hookEvents, ", "))
+			}
+			h.events[name] = true
+		}
+	}
+	if len(h.events) == 0 {
+		for _, name := range hookEvents {
+			h.events[name] = true
+		}
+	}
+
+	if config.WebhookTemplate != "" {
+		text, err := os.ReadFile(config.WebhookTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook template: %w", err)
+		}
+		h.template, err = template.New("webhook").Funcs(template.FuncMap{"json": templateJSON}).Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook template: %w", err)
+		}
+	}
+	return h, nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// templateJSON quotes a value for a JSON body template
+func templateJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// fire delivers an event to every hook in the background; warn reports hooks that keep failing
+func (h *hookRunner) fire(event hookEvent, warn func(format string, args ...interface{})) {
+	if !h.events[event.Event] {
+		return
+	}
+	for _, url := range h.webhooks {
+		h.deliver("webhook "+redactURL(url), event, warn, func(ctx context.Context) error { return h.post(ctx, url, event) })
+	}
+	for _, command := range h.commands {
+		h.deliver("hook command", event, warn, func(ctx context.Context) error { return runHookCommand(ctx, command, event) })
+	}
+}
+
+// deliver runs a hook in the background, retrying failed attempts
+func (h *hookRunner) deliver(name string, event hookEvent, warn func(format string, args ...interface{}), attempt func(ctx context.Context) error) {
+	delivery := name + " for " + event.Event
+	h.mu.Lock()
+	h.pending[delivery]++
+	h.mu.Unlock()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() {
+			h.mu.Lock()
+			if h.pending[delivery]--; h.pending[delivery] == 0 {
+				delete(h.pending, delivery)
+			}
+			h.mu.Unlock()
+		}()
+		var err error
+		for i := 0; i <= h.retries; i++ {
+			if i > 0 {
+				time.Sleep(time.Duration(i) * hookRetryDelay)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+			err = attempt(ctx)
+			cancel()
+			if err == nil {
+				return
+			}
+		}
+		warn("%s for %s failed after %d attempts: %v", name, event.Event, h.retries+1, err)
+	}()
+}
+
+// wait waits until all events have been delivered or given up on. Hooks that are still running
+// after hookWaitNotice are listed on stderr, since retries can delay the exit considerably.
+func (h *hookRunner) wait() {
+	if h == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(hookWaitNotice):
+	}
+	if h.stderrLevel <= levelInfo {
+		limit := time.Duration(h.retries+1)*h.timeout + time.Duration(h.retries*(h.retries+1)/2)*hookRetryDelay
+		log.Printf("Waiting up to %s for hooks to finish: %s", limit, strings.Join(h.pendingHooks(), ", "))
+	}
+	<-done
+}
+
+// pendingHooks lists the deliveries in progress
+func (h *hookRunner) pendingHooks() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var names []string
+	for name, count := range h.pending {
+		if count > 1 {
+			name = fmt.Sprintf("%s (%d)", name, count)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// post sends an event to a webhook
+func (h *hookRunner) post(ctx context.Context, url string, event hookEvent) error {
+	body, err := h.body(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(text))
+	}
+	return nil
+}
+
+// body renders the webhook body of an event
+func (h *hookRunner) body(event hookEvent) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(event)
+	}
+	var body bytes.Buffer
+	if err := h.template.Execute(&body, event); err != nil {
+		return nil, fmt.Errorf("failed to render webhook template: %w", err)
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("webhook template did not produce valid JSON: %s", body.String())
+	}
+	return body.Bytes(), nil
+}
+
+// hookEnv returns the environment variables describing an event to a hook command
+func hookEnv(event hookEvent) []string {
+	return []string{
+		"SWUPDATE_EVENT=" + event.Event,
+		"SWUPDATE_TIME=" + event.Time.Format(time.RFC3339),
+		"SWUPDATE_DEVICE=" + event.Device,
+		"SWUPDATE_GROUP=" + event.Group,
+		"SWUPDATE_ARTIFACT=" + event.Artifact,
+		"SWUPDATE_VERSION=" + event.Version,
+		"SWUPDATE_SHA256=" + event.SHA256,
+		"SWUPDATE_STATUS=" + event.Status,
+		"SWUPDATE_ERROR=" + event.Error,
+	}
+}
+
+// runHookCommand runs a hook command with the event in its environment
+func runHookCommand(ctx context.Context, command string, event hookEvent) error {
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), hookEnv(event)...)
+	cmd.WaitDelay = time.Second // Do not wait for background processes holding the output open
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%w: %s", err, text)
+		}
+		return err
+	}
+	return nil
+}
+
+// fireHook reports a lifecycle event of the update to the hooks; err is the outcome of a finished update
+func (c *SWUpdateClient) fireHook(name string, err error) {
+	if c.hooks == nil || c.config.DryRun {
+		return
+	}
+
+	status := "running"
+	var message string
+	if name == hookSuccess || name == hookFailure {
+		outcome := updateOutcome(err)
+		status, message = outcome.Result, outcome.Error
+	}
+	c.hooks.fire(hookEvent{
+		Event:    name,
+		Time:     time.Now(),
+		Device:   redactURL(c.deviceName()),
+		Group:    c.config.DeviceGroup,
+		Artifact: c.artifactName(),
+		Version:  c.image.Version,
+		SHA256:   c.image.SHA256,
+		Status:   status,
+		Error:    message,
+	}, c.logWarning)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks_Webhook(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []map[string]interface{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		data, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(data, &body) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	template := writeTestFile(t, "hook.tmpl", []byte(`{"text": {{json (printf "%s: %s %s" .Event .Artifact .Status)}}, "version": {{json .Version}}}`))
+	hooks, err := newHookRunner(Config{Webhooks: []string{receiver.URL}, WebhookTemplate: template})
+	if err != nil {
+		t.Fatalf("newHookRunner() error = %v", err)
+	}
+
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second}, 64<<10)
+	client.config.Filename = writeTestFile(t, "image.swu", buildSWU(testSWDescription, []byte("payload")))
+	client.hooks = hooks
+
+	captureStdout(t, func() {
+		if code := runUpdate(context.Background(), client, true); code != 0 {
+			t.Errorf("runUpdate() = %d, want 0", code)
+		}
+	})
+	hooks.wait()
+
+	texts := map[string]bool{}
+	for _, body := range bodies {
+		texts[body["text"].(string)] = true
+	}
+	for _, want := range []string{"start: image.swu running", "upload-complete: image.swu running", "restart: image.swu running", "success: image.swu passed"} {
+		if !texts[want] {
+			t.Errorf("No webhook %q in %v", want, bodies)
+		}
+	}
+	if len(bodies) != 4 || bodies[len(bodies)-1]["version"] != "2.1.0" {
+		t.Errorf("Unexpected webhook bodies %v", bodies)
+	}
+}
+
+func TestHooks_Command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Uses a POSIX shell")
+	}
+	out := filepath.Join(t.TempDir(), "events")
+	hooks, err := newHookRunner(Config{
+		HookCommands: []string{`echo "$SWUPDATE_EVENT $SWUPDATE_STATUS $SWUPDATE_ERROR" >> ` + out},
+		HookEvents:   []string{"failure"},
+	})
+	if err != nil {
+		t.Fatalf("newHookRunner() error = %v", err)
+	}
+
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "FAILURE"}}
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second}, 64<<10)
+	client.hooks = hooks
+
+	captureStdout(t, func() { runUpdate(context.Background(), client, false) })
+	hooks.wait()
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Hook command did not run: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "failure failed installation failed on the device" {
+		t.Errorf("Hook command saw %q", got)
+	}
+}
+
+func TestHooks_RetryAndTimeout(t *testing.T) {
+	defer func(delay time.Duration) { hookRetryDelay = delay }(hookRetryDelay)
+	hookRetryDelay = 10 * time.Millisecond
+
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case 2:
+			select { // Longer than the hook timeout
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	hooks, err := newHookRunner(Config{Webhooks: []string{receiver.URL}, HookEvents: []string{"start"}, HookTimeout: 200 * time.Millisecond, HookRetries: 2})
+	if err != nil {
+		t.Fatalf("newHookRunner() error = %v", err)
+	}
+	client := NewSWUpdateClient(Config{Target: "http://10.0.0.1"})
+	client.hooks = hooks
+
+	start := time.Now()
+	client.fireHook(hookStart, nil)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("fireHook() blocked for %v", elapsed)
+	}
+	hooks.wait()
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("Webhook attempted %d times, want 3", got)
+	}
+}
+
+func TestHooks_WaitListsPendingHooks(t *testing.T) {
+	defer func(notice time.Duration) { hookWaitNotice = notice }(hookWaitNotice)
+	hookWaitNotice = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer receiver.Close()
+
+	hooks, err := newHookRunner(Config{Webhooks: []string{receiver.URL}, HookEvents: []string{"success"}, HookRetries: 0})
+	if err != nil {
+		t.Fatalf("newHookRunner() error = %v", err)
+	}
+	client := NewSWUpdateClient(Config{Target: "http://10.0.0.1"})
+	client.hooks = hooks
+	client.fireHook(hookSuccess, nil)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+	hooks.wait()
+
+	if want := "Waiting up to 10s for hooks to finish: webhook " + receiver.URL + " for success"; !strings.Contains(logs.String(), want) {
+		t.Errorf("Expected %q, got %q", want, logs.String())
+	}
+}
+
+func TestHooks_WarningAfterDashboardClosed(t *testing.T) {
+	clients := newDeviceClients(Config{}, []string{"http://10.0.0.1", "http://10.0.0.2"}, nil)
+	d := newDashboard(io.Discard, 120, 24, clients, func() {})
+	d.restore = func() {}
+	d.stop, d.done = make(chan struct{}), make(chan struct{})
+	close(d.done)
+
+	clients[0].logWarning("shown in the dashboard")
+	d.close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	clients[0].logWarning("webhook for success failed after 3 attempts")
+
+	if !strings.Contains(logs.String(), "Warning: webhook for success failed") {
+		t.Errorf("Warning after closing the dashboard not printed, got %q", logs.String())
+	}
+	if d.rows[0].message != "Warning: shown in the dashboard" {
+		t.Errorf("Unexpected dashboard message %q", d.rows[0].message)
+	}
+}
+
+func TestNewHookRunner_Options(t *testing.T) {
+	if hooks, err := newHookRunner(Config{}); hooks != nil || err != nil {
+		t.Errorf("Expected no hook runner without hooks, got %v, %v", hooks, err)
+	}
+	if _, err := newHookRunner(Config{Webhooks: []string{"http://hooks"}, HookEvents: []string{"start,finish"}}); err == nil || !strings.Contains(err.Error(), `"finish"`) {
+		t.Errorf("Expected an unknown event error, got %v", err)
+	}
+
+	hooks, err := newHookRunner(Config{HookCommands: []string{"true"}, HookEvents: []string{"success, failure", "restart"}})
+	if err != nil {
+		t.Fatalf("newHookRunner() error = %v", err)
+	}
+	if len(hooks.events) != 3 || !hooks.events[hookRestart] || hooks.events[hookStart] {
+		t.Errorf("Unexpected events %v", hooks.events)
+	}
+
+	template := writeTestFile(t, "bad.tmpl", []byte(`{"text": {{.Event}}}`))
+	hooks, _ = newHookRunner(Config{Webhooks: []string{"http://hooks"}, WebhookTemplate: template})
+	if _, err := hooks.body(hookEvent{Event: "start"}); err == nil {
+		t.Error("Expected an error for a template producing invalid JSON")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// jsonSchemaVersion is the version of the -json record format described by events.schema.json
+const jsonSchemaVersion = 1
+
+// Origins of JSON records
+const (
+	originClient = "client" // Emitted by the client itself
+	originDevice = "device" // Relayed from the device's WebSocket
+)
+
+// eventsSchema is the JSON Schema of the -json records, printed by -json-schema
+//
+//go:embed events.schema.json
+var eventsSchema string
+
+// newRecord builds a record in the versioned JSON envelope
+func (c *SWUpdateClient) newRecord(origin, msgType, level, message string, data map[string]interface{}) LogMessage {
+	return LogMessage{
+		Schema:  jsonSchemaVersion,
+		Time:    time.Now(),
+		Device:  c.deviceName(),
+		Phase:   c.currentStage(),
+		Origin:  origin,
+		Type:    msgType,
+		Level:   level,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// printJSONRecord prints a record as one line of JSON output
+func printJSONRecord(record LogMessage) {
+	jsonData, _ := json.Marshal(record)
+	fmt.Println(string(jsonData))
+}
+
+// printDeviceEvent prints a WebSocket event as a JSON record with a typed payload and sends it to the log sinks
+func (c *SWUpdateClient) printDeviceEvent(event SWUpdateEvent) {
+	record := c.newRecord(originDevice, event.Type, deviceEventLevel(event), event.Text, deviceEventData(event))
+	c.sendToSinks(record)
+	if c.shouldPrint(record) {
+		printJSONRecord(record)
+	}
+}
+
+// deviceEventData returns the typed payload of a WebSocket event, nil if it has none
+func deviceEventData(event SWUpdateEvent) map[string]interface{} {
+	data := map[string]interface{}{}
+	if event.Status != "" {
+		data["status"] = event.Status
+	}
+	if event.Name != "" {
+		data["name"] = event.Name
+	}
+	if event.Source != "" {
+		data["source"] = event.Source
+	}
+	for key, value := range map[string]string{"step": event.Step, "steps": event.Number, "percent": event.Percent} {
+		if n, err := strconv.Atoi(value); err == nil {
+			data[key] = n
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// deviceName identifies the device in JSON records: its label, or its URL for a single device
+func (c *SWUpdateClient) deviceName() string {
+	if c.config.DeviceLabel != "" {
+		return c.config.DeviceLabel
+	}
+	target, err := c.target()
+	if err != nil {
+		return ""
+	}
+	return target.String()
+}
+
+// currentStage returns the stage the update is in, empty before it started
+func (c *SWUpdateClient) currentStage() string {
+	stage, _ := c.stage.Load().(string)
+	return stage
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrintDeviceEvent_TypedPayload(t *testing.T) {
+	client := NewSWUpdateClient(Config{Target: "http://10.0.0.1:8080", JSONOutput: true})
+	client.enterStage(stageInstalling)
+
+	output := captureStdout(t, func() {
+		client.handleWebSocketEvent(SWUpdateEvent{Type: "step", Number: "3", Step: "2", Name: "rootfs", Percent: "40"})
+	})
+	record := findLogEvent(t, output, "step")
+
+	if record.Schema != jsonSchemaVersion || record.Origin != originDevice || record.Phase != stageInstalling {
+		t.Errorf("Unexpected envelope %+v", record)
+	}
+	if record.Device != "http://10.0.0.1:8080/" {
+		t.Errorf("Device = %q, want the device URL", record.Device)
+	}
+	want := map[string]interface{}{"step": float64(2), "steps": float64(3), "name": "rootfs", "percent": float64(40)}
+	if !reflect.DeepEqual(record.Data, want) {
+		t.Errorf("Data = %v, want %v", record.Data, want)
+	}
+}
+
+func TestLogEvent_Envelope(t *testing.T) {
+	client := NewSWUpdateClient(Config{JSONOutput: true, DeviceLabel: "board-1"})
+
+	output := captureStdout(t, func() {
+		client.logMessage("upload", "INFO", "Uploading firmware")
+	})
+	record := findLogEvent(t, output, "upload")
+	if record.Origin != originClient || record.Device != "board-1" || record.Time.IsZero() || record.Phase != "" {
+		t.Errorf("Unexpected envelope %+v", record)
+	}
+}
+
+func TestEventsSchema(t *testing.T) {
+	var schema struct {
+		Required   []string                          `json:"required"`
+		Properties map[string]map[string]interface{} `json:"properties"`
+	}
+	if err := json.Unmarshal([]byte(eventsSchema), &schema); err != nil {
+		t.Fatalf("events.schema.json is not valid JSON: %v", err)
+	}
+
+	if schema.Properties["schema"]["const"] != float64(jsonSchemaVersion) {
+		t.Errorf("Schema version %v does not match jsonSchemaVersion %d", schema.Properties["schema"]["const"], jsonSchemaVersion)
+	}
+
+	// Every envelope field is documented, and the fields that are always present are required
+	fields := reflect.TypeOf(LogMessage{})
+	for i := 0; i < fields.NumField(); i++ {
+		name, options, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("Field %q is missing from the schema", name)
+		}
+		required := false
+		for _, r := range schema.Required {
+			required = required || r == name
+		}
+		if required != (options != "omitempty") {
+			t.Errorf("Field %q: required = %v, but omitempty = %v", name, required, options == "omitempty")
+		}
+	}
+}
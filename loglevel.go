@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// logLevel orders messages by severity. The zero value means the level was not configured,
+// NewSWUpdateClient replaces it with the default.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota + 1
+	levelInfo
+	levelWarn
+	levelError
+	levelOff // Only as a threshold: nothing is output
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+	levelOff:   "off",
+}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel parses a level given on the command line: debug, info, warn, error or off
+func parseLogLevel(name string) (logLevel, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warning" {
+		name = "warn"
+	}
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("invalid log level %q, expected debug, info, warn, error or off", name)
+}
+
+// recordLevel returns the level of a record's DEBUG, INFO, WARN or ERROR level field; anything else is info
+func recordLevel(level string) logLevel {
+	switch level {
+	case "DEBUG":
+		return levelDebug
+	case "WARN":
+		return levelWarn
+	case "ERROR":
+		return levelError
+	default:
+		return levelInfo
+	}
+}
+
+// resultTypes are the record types that are still printed with -quiet: the final result of an update
+var resultTypes = map[string]bool{"completion": true, "cancelled": true, "outcome": true}
+
+// deviceEventLevel returns the record level of a WebSocket event: the device's own level for warnings
+// and errors, INFO for the progress of the update and DEBUG for the device's informational messages
+func deviceEventLevel(event SWUpdateEvent) string {
+	switch {
+	case event.Level == "ERROR" || event.Level == "WARN":
+		return event.Level
+	case event.Type == "status" && event.Status == "FAILURE":
+		return "ERROR"
+	case event.Type == "status" && event.Status != "IDLE", event.Type == "step":
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// defaultLogLevels fills in the levels that were not configured: info for -log-level, and for
+// -stderr-level the log level, or error with -quiet
+func defaultLogLevels(config *Config) {
+	if config.LogLevel == 0 {
+		config.LogLevel = levelInfo
+	}
+	if config.StderrLevel != 0 {
+		return
+	}
+	switch {
+	case config.Quiet:
+		config.StderrLevel = levelError
+	case config.Verbose:
+		config.StderrLevel = levelDebug
+	default:
+		config.StderrLevel = config.LogLevel
+	}
+}
+
+// logLevel returns the lowest level of messages that are output; -verbose is the same as -log-level debug
+func (c *SWUpdateClient) logLevel() logLevel {
+	if c.config.Verbose {
+		return levelDebug
+	}
+	return c.config.LogLevel
+}
+
+// shouldPrint reports whether a record is printed on stdout
+func (c *SWUpdateClient) shouldPrint(record LogMessage) bool {
+	if c.config.Quiet {
+		return resultTypes[record.Type]
+	}
+	return recordLevel(record.Level) >= c.logLevel()
+}
+
+// logf writes a diagnostic to stderr through the log package if its level reaches -stderr-level
+func (c *SWUpdateClient) logf(level logLevel, format string, args ...interface{}) {
+	if level < c.config.StderrLevel {
+		return
+	}
+	log.Printf("%s%s", c.devicePrefix(), fmt.Sprintf(format, args...))
+}
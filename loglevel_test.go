@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]logLevel{"debug": levelDebug, "INFO": levelInfo, "warning": levelWarn, " error ": levelError, "off": levelOff} {
+		if got, err := parseLogLevel(name); err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := parseLogLevel("trace"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
+
+func TestDeviceEventLevel(t *testing.T) {
+	tests := []struct {
+		event SWUpdateEvent
+		want  string
+	}{
+		{SWUpdateEvent{Type: "status", Status: "RUN"}, "INFO"},
+		{SWUpdateEvent{Type: "status", Status: "IDLE"}, "DEBUG"},
+		{SWUpdateEvent{Type: "status", Status: "FAILURE"}, "ERROR"},
+		{SWUpdateEvent{Type: "step", Step: "1", Number: "2"}, "INFO"},
+		{SWUpdateEvent{Type: "message", Level: "INFO", Text: "Found installer"}, "DEBUG"},
+		{SWUpdateEvent{Type: "message", Level: "WARN", Text: "Low space"}, "WARN"},
+		{SWUpdateEvent{Type: "message", Level: "ERROR", Text: "Write failed"}, "ERROR"},
+		{SWUpdateEvent{Type: "source", Source: "WEBSERVER"}, "DEBUG"},
+	}
+	for _, tt := range tests {
+		if got := deviceEventLevel(tt.event); got != tt.want {
+			t.Errorf("deviceEventLevel(%+v) = %s, want %s", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestLogLevel_FiltersClientAndDeviceMessages(t *testing.T) {
+	emit := func(client *SWUpdateClient) {
+		client.logMessage("connection", "INFO", "Connecting")
+		client.handleWebSocketEvent(SWUpdateEvent{Type: "message", Level: "INFO", Text: "Device chatter"})
+		client.handleWebSocketEvent(SWUpdateEvent{Type: "message", Level: "WARN", Text: "Device warning"})
+		client.logMessage("timeout", "ERROR", "Client error")
+		client.logMessage("completion", "INFO", "Update process completed")
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"default", Config{}, []string{"Connecting", "Warning: Device warning", "Error: Client error", "Update process completed"}},
+		{"debug", Config{LogLevel: levelDebug}, []string{"Connecting", "Device chatter", "Warning: Device warning", "Error: Client error", "Update process completed"}},
+		{"verbose", Config{Verbose: true, LogLevel: levelError}, []string{"Connecting", "Device chatter", "Warning: Device warning", "Error: Client error", "Update process completed"}},
+		{"warn", Config{LogLevel: levelWarn}, []string{"Warning: Device warning", "Error: Client error"}},
+		{"quiet", Config{Quiet: true, LogLevel: levelDebug}, []string{"Update process completed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Target = "http://192.168.1.100"
+			output := captureStdout(t, func() { emit(NewSWUpdateClient(tt.config)) })
+			if got := strings.Split(strings.TrimSpace(output), "\n"); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogLevel_JSONDeviceRecords(t *testing.T) {
+	client := NewSWUpdateClient(Config{Target: "http://192.168.1.100", JSONOutput: true, LogLevel: levelWarn})
+	output := captureStdout(t, func() {
+		client.handleWebSocketEvent(SWUpdateEvent{Type: "status", Status: "RUN"})
+		client.handleWebSocketEvent(SWUpdateEvent{Type: "status", Status: "FAILURE"})
+	})
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the FAILURE record, got %q", lines)
+	}
+	var record LogMessage
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Origin != originDevice || record.Level != "ERROR" || record.Data["status"] != "FAILURE" {
+		t.Errorf("Unexpected record %+v", record)
+	}
+}
+
+func TestLogf_StderrLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	client := NewSWUpdateClient(Config{Target: "http://192.168.1.100", StderrLevel: levelWarn, LogLevel: levelDebug})
+	client.logf(levelDebug, "Connecting to WebSocket")
+	client.logWarning("slow device")
+	if got := buf.String(); strings.Contains(got, "Connecting") || !strings.Contains(got, "Warning: slow device") {
+		t.Errorf("Unexpected stderr output %q", got)
+	}
+
+	buf.Reset()
+	client.config.StderrLevel = levelOff
+	client.logWarning("slow device")
+	if buf.Len() != 0 {
+		t.Errorf("Expected no stderr output with -stderr-level off, got %q", buf.String())
+	}
+}
+
+func TestDefaultLogLevels(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Config
+		level, stderr logLevel
+	}{
+		{"unset", Config{}, levelInfo, levelInfo},
+		{"log level", Config{LogLevel: levelWarn}, levelWarn, levelWarn},
+		{"verbose", Config{Verbose: true}, levelInfo, levelDebug},
+		{"quiet", Config{Quiet: true}, levelInfo, levelError},
+		{"explicit stderr", Config{Quiet: true, StderrLevel: levelDebug}, levelInfo, levelDebug},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultLogLevels(&tt.config)
+			if tt.config.LogLevel != tt.level || tt.config.StderrLevel != tt.stderr {
+				t.Errorf("Levels = %v, %v, want %v, %v", tt.config.LogLevel, tt.config.StderrLevel, tt.level, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRunUpdate_QuietJSONFailure(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "FAILURE"}}
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, JSONOutput: true, Quiet: true}, 1<<10)
+
+	var code int
+	output := captureStdout(t, func() { code = runUpdate(context.Background(), client, false) })
+	if code != 1 {
+		t.Fatalf("runUpdate() = %d, want 1", code)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one result record, got %q", lines)
+	}
+	var record LogMessage
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Type != "outcome" || record.Level != "ERROR" || record.Data["result"] != "failed" || !strings.Contains(record.Data["error"].(string), "installation failed") {
+		t.Errorf("Unexpected result record %+v", record)
+	}
+}
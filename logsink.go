@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logSink receives every record of the client in addition to the console output
+type logSink interface {
+	send(record LogMessage) error
+	close() error
+}
+
+// Syslog facilities accepted by -syslog-facility
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSDID identifies the structured data of syslog messages; 32473 is the enterprise number
+// reserved for documentation and private use
+const syslogSDID = "swupdate@32473"
+
+// defaultJournalSocket is the systemd journal's native protocol socket
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// sinkQueueSize is how many records may wait for slow log sinks before records are dropped
+const sinkQueueSize = 1024
+
+// Reconnecting to a syslog server that went away
+const (
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+	syslogMinBackoff   = time.Second
+	syslogMaxBackoff   = time.Minute
+)
+
+// syslogSeverity maps a record level to a syslog severity, which journald uses as PRIORITY
+func syslogSeverity(level string) int {
+	switch level {
+	case "ERROR":
+		return 3
+	case "WARN":
+		return 4
+	case "DEBUG":
+		return 7
+	default:
+		return 6
+	}
+}
+
+// syslogSink sends records as RFC 5424 messages over UDP, TCP or a Unix socket
+type syslogSink struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	facility int
+	hostname string
+	conn     net.Conn
+	stream   bool          // Messages are framed with their length on stream connections
+	backoff  time.Duration // Delay before the next reconnect after a failed one, zero while connected
+	retryAt  time.Time     // No reconnect is attempted before this time
+}
+
+// newSyslogSink connects to a syslog server given as udp://host:port, tcp://host:port or unix:///path
+func newSyslogSink(location, facility string) (*syslogSink, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog address %q: %w", location, err)
+	}
+	s := &syslogSink{network: u.Scheme, facility: code, hostname: "-"}
+	switch u.Scheme {
+	case "udp", "tcp":
+		s.address = u.Host
+		if u.Port() == "" {
+			port := "514"
+			if u.Scheme == "tcp" {
+				port = "601"
+			}
+			s.address = net.JoinHostPort(u.Hostname(), port)
+		}
+	case "unix":
+		s.address = u.Path
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q, expected udp://, tcp:// or unix://", location)
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		s.hostname = hostname
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect opens the connection to the server; Unix sockets may be datagram (like /dev/log) or stream sockets
+func (s *syslogSink) connect() error {
+	var conn net.Conn
+	var err error
+	if s.network == "unix" {
+		if conn, err = net.Dial("unixgram", s.address); err != nil {
+			conn, err = net.Dial("unix", s.address)
+		}
+	} else {
+		conn, err = net.DialTimeout(s.network, s.address, syslogDialTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	s.conn = conn
+	s.stream = conn.LocalAddr().Network() == "tcp" || conn.LocalAddr().Network() == "unix"
+	return nil
+}
+
+// format renders a record as an RFC 5424 message
+func (s *syslogSink) format(record LogMessage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s swupdate-client %d %s [%s", s.facility*8+syslogSeverity(record.Level),
+		record.Time.UTC().Format("2006-01-02T15:04:05.000000Z"), s.hostname, os.Getpid(), syslogMsgID(record.Type), syslogSDID)
+	for _, param := range [][2]string{{"device", record.Device}, {"phase", record.Phase}, {"level", record.Level}, {"origin", record.Origin}} {
+		if param[1] != "" {
+			fmt.Fprintf(&b, ` %s="%s"`, param[0], strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(param[1]))
+		}
+	}
+	b.WriteString("] ")
+	b.WriteString(record.Message)
+	return b.String()
+}
+
+// syslogMsgID returns a record type as a syslog MSGID: up to 32 printable ASCII characters, "-" if empty
+func syslogMsgID(msgType string) string {
+	id := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, msgType)
+	if id == "" {
+		return "-"
+	}
+	if len(id) > 32 {
+		id = id[:32]
+	}
+	return id
+}
+
+// send writes a record, reconnecting if the connection was lost. Failed reconnects are retried
+// with an exponential backoff; records sent in between are discarded.
+func (s *syslogSink) send(record LogMessage) error {
+	message := s.format(record)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if err := s.write(message); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if now := time.Now(); now.Before(s.retryAt) {
+		return fmt.Errorf("syslog server %s unavailable, reconnecting in %s", s.address, s.retryAt.Sub(now).Round(time.Second))
+	}
+	if err := s.connect(); err != nil {
+		s.backoff = min(max(2*s.backoff, syslogMinBackoff), syslogMaxBackoff)
+		s.retryAt = time.Now().Add(s.backoff)
+		return err
+	}
+	s.backoff = 0
+	if err := s.write(message); err != nil {
+		return fmt.Errorf("failed to write to syslog: %w", err)
+	}
+	return nil
+}
+
+// write sends a message on the connection, with RFC 6587 octet counting on streams. A server that
+// stops reading makes the write time out instead of blocking the sender.
+func (s *syslogSink) write(message string) error {
+	if s.stream {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := s.conn.Write([]byte(message))
+	return err
+}
+
+func (s *syslogSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// journalSink sends records to the systemd journal over its native protocol with structured fields
+type journalSink struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+// newJournalSink opens a datagram socket for the journal socket at path
+func newJournalSink(path string) (*journalSink, error) {
+	addr := &net.UnixAddr{Name: path, Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal socket: %w", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("systemd journal is not available: %w", err)
+	}
+	return &journalSink{conn: conn, addr: addr}, nil
+}
+
+// journalFields returns the journal fields of a record
+func journalFields(record LogMessage) [][2]string {
+	fields := [][2]string{
+		{"MESSAGE", record.Message},
+		{"PRIORITY", strconv.Itoa(syslogSeverity(record.Level))},
+		{"SYSLOG_IDENTIFIER", "swupdate-client"},
+		{"LEVEL", record.Level},
+		{"DEVICE", record.Device},
+		{"PHASE", record.Phase},
+		{"ORIGIN", record.Origin},
+		{"EVENT_TYPE", record.Type},
+	}
+	kept := fields[:0]
+	for _, field := range fields {
+		if field[1] != "" {
+			kept = append(kept, field)
+		}
+	}
+	return kept
+}
+
+// encodeJournalEntry encodes fields in the journal's native protocol; values with newlines are
+// sent with an explicit length
+func encodeJournalEntry(fields [][2]string) []byte {
+	var b bytes.Buffer
+	for _, field := range fields {
+		name, value := field[0], field[1]
+		if !strings.Contains(value, "\n") {
+			b.WriteString(name + "=" + value + "\n")
+			continue
+		}
+		b.WriteString(name + "\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value + "\n")
+	}
+	return b.Bytes()
+}
+
+func (j *journalSink) send(record LogMessage) error {
+	if _, err := j.conn.WriteToUnix(encodeJournalEntry(journalFields(record)), j.addr); err != nil {
+		return fmt.Errorf("failed to write to the journal: %w", err)
+	}
+	return nil
+}
+
+func (j *journalSink) close() error {
+	return j.conn.Close()
+}
+
+// logSinks fans records out to the configured sinks, shared by all devices. Records are queued
+// and sent by a background goroutine, so a slow or unreachable log server never delays the update.
+type logSinks struct {
+	sinks       []logSink
+	stderrLevel logLevel // Sink failures are reported on stderr at warn level
+	queue       chan LogMessage
+	done        chan struct{} // Closed when the sender goroutine exits
+	dropped     atomic.Int64  // Records dropped because the queue was full
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newLogSinks starts sending queued records to sinks
+func newLogSinks(sinks []logSink, stderrLevel logLevel) *logSinks {
+	l := &logSinks{sinks: sinks, stderrLevel: stderrLevel, queue: make(chan LogMessage, sinkQueueSize), done: make(chan struct{})}
+	go l.run()
+	return l
+}
+
+// openLogSinks opens the sinks configured by -syslog and -journald, nil if there are none
+func openLogSinks(config Config) (*logSinks, error) {
+	var sinks []logSink
+	if config.Syslog != "" {
+		sink, err := newSyslogSink(config.Syslog, config.SyslogFacility)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if config.JournalSocket != "" {
+		sink, err := newJournalSink(config.JournalSocket)
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return newLogSinks(sinks, config.StderrLevel), nil
+}
+
+// send queues a record for the sinks without blocking. When the queue is full the record is
+// dropped, which is reported once.
+func (l *logSinks) send(record LogMessage) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- record:
+	default:
+		if l.dropped.Add(1) == 1 {
+			l.warn("log sinks are falling behind, dropping records")
+		}
+	}
+}
+
+// run delivers queued records to every sink and reports the first failure of each sink
+func (l *logSinks) run() {
+	defer close(l.done)
+	failed := make(map[logSink]bool)
+	for record := range l.queue {
+		for _, sink := range l.sinks {
+			if err := sink.send(record); err != nil && !failed[sink] {
+				failed[sink] = true
+				l.warn("%v", err)
+			}
+		}
+	}
+}
+
+// warn reports a problem of the sinks on stderr unless -stderr-level hides warnings
+func (l *logSinks) warn(format string, args ...interface{}) {
+	if levelWarn >= l.stderrLevel {
+		log.Printf("Warning: "+format, args...)
+	}
+}
+
+// close sends the queued records, waiting at most syslogWriteTimeout, and closes all sinks
+func (l *logSinks) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.queue)
+	l.mu.Unlock()
+
+	select {
+	case <-l.done:
+	case <-time.After(syslogWriteTimeout):
+		l.warn("gave up sending the remaining records to the log sinks")
+	}
+	if dropped := l.dropped.Load(); dropped > 0 {
+		l.warn("%d records were not sent to the log sinks", dropped)
+	}
+	for _, sink := range l.sinks {
+		sink.close()
+	}
+}
+
+// sendToSinks queues a record that reaches -log-level for the log sinks, if any are configured;
+// credentials in the device URL are redacted since the sinks usually forward to shared log servers.
+func (c *SWUpdateClient) sendToSinks(record LogMessage) {
+	if c.sinks == nil || recordLevel(record.Level) < c.logLevel() {
+		return
+	}
+	record.Device = redactURL(record.Device)
+	c.sinks.send(record)
+}
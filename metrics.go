@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names exposed on -metrics-listen
+const (
+	metricUpdatesStarted   = "swupdate_updates_started_total"
+	metricUpdatesSucceeded = "swupdate_updates_succeeded_total"
+	metricUpdatesFailed    = "swupdate_updates_failed_total"
+	metricUpdatesCancelled = "swupdate_updates_cancelled_total"
+	metricUploadBytes      = "swupdate_upload_bytes_total"
+	metricUploadThroughput = "swupdate_upload_throughput_bytes_per_second"
+	metricInstallDuration  = "swupdate_install_duration_seconds"
+	metricWebSocketDrops   = "swupdate_websocket_disconnects_total"
+	metricTLSErrors        = "swupdate_tls_errors_total"
+)
+
+// metricFamily describes an exposed metric; histograms have buckets
+type metricFamily struct {
+	name    string
+	help    string
+	buckets []float64
+}
+
+// metricFamilies are exposed in this order, each labelled with the device group
+var metricFamilies = []metricFamily{
+	{name: metricUpdatesStarted, help: "Updates started."},
+	{name: metricUpdatesSucceeded, help: "Updates that completed successfully."},
+	{name: metricUpdatesFailed, help: "Updates that failed."},
+	{name: metricUpdatesCancelled, help: "Updates that were cancelled."},
+	{name: metricUploadBytes, help: "Image bytes sent to devices."},
+	{name: metricUploadThroughput, help: "Throughput of completed uploads.", buckets: []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}},
+	{name: metricInstallDuration, help: "Time from the end of the upload to a successful installation.", buckets: []float64{5, 10, 30, 60, 120, 300, 600, 1200, 1800}},
+	{name: metricWebSocketDrops, help: "Progress WebSocket connections lost unexpectedly."},
+	{name: metricTLSErrors, help: "Failed TLS handshakes with devices."},
+}
+
+// metricSeries is the value of a metric for one device group
+type metricSeries struct {
+	value   float64  // Counter value, or the sum of a histogram
+	count   uint64   // Observations of a histogram
+	buckets []uint64 // Observations per histogram bucket, not cumulative
+}
+
+// updateMetrics collects the metrics of all devices for -metrics-listen
+type updateMetrics struct {
+	mu     sync.Mutex
+	series map[string]map[string]*metricSeries // Metric name to device group to series
+}
+
+func newUpdateMetrics() *updateMetrics {
+	return &updateMetrics{series: make(map[string]map[string]*metricSeries)}
+}
+
+// get returns the series of a metric for a group, creating it; the caller holds mu
+func (m *updateMetrics) get(name, group string) *metricSeries {
+	groups := m.series[name]
+	if groups == nil {
+		groups = make(map[string]*metricSeries)
+		m.series[name] = groups
+	}
+	series := groups[group]
+	if series == nil {
+		series = &metricSeries{}
+		groups[group] = series
+	}
+	return series
+}
+
+// add increases a counter
+func (m *updateMetrics) add(name, group string, delta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name, group).value += delta
+}
+
+// observe records a value in a histogram
+func (m *updateMetrics) observe(name, group string, value float64) {
+	var buckets []float64
+	for _, family := range metricFamilies {
+		if family.name == name {
+			buckets = family.buckets
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series := m.get(name, group)
+	if series.buckets == nil {
+		series.buckets = make([]uint64, len(buckets))
+	}
+	for i, bound := range buckets {
+		if value <= bound {
+			series.buckets[i]++
+			break
+		}
+	}
+	series.value += value
+	series.count++
+}
+
+// write renders all metrics in the Prometheus text exposition format
+func (m *updateMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, family := range metricFamilies {
+		kind := "counter"
+		if family.buckets != nil {
+			kind = "histogram"
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, kind)
+
+		groups := make([]string, 0, len(m.series[family.name]))
+		for group := range m.series[family.name] {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			series := m.series[family.name][group]
+			label := `group="` + escapeLabelValue(group) + `"`
+			if family.buckets == nil {
+				fmt.Fprintf(w, "%s{%s} %s\n", family.name, label, formatMetricValue(series.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range family.buckets {
+				cumulative += series.buckets[i]
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", family.name, label, formatMetricValue(bound), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", family.name, label, series.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", family.name, label, formatMetricValue(series.value))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", family.name, label, series.count)
+		}
+	}
+}
+
+// escapeLabelValue escapes a label value for the text exposition format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatMetricValue formats a sample value without exponent for integral values
+func formatMetricValue(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ServeHTTP exposes the metrics
+func (m *updateMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// serveMetrics starts serving /metrics on addr and returns the server to shut down
+func serveMetrics(addr string, metrics *updateMetrics) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "Warning: metrics server failed: %v\n", err)
+		}
+	}()
+	return server, nil
+}
+
+// lingerMetrics keeps serving metrics for linger after the run so the final values can be scraped,
+// then shuts the server down
+func lingerMetrics(ctx context.Context, server *http.Server, linger time.Duration) {
+	if linger > 0 && ctx.Err() == nil {
+		select {
+		case <-time.After(linger):
+		case <-ctx.Done():
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = server.Shutdown(shutdownCtx)
+}
+
+// countMetric increases a counter of the device's group, if metrics are collected
+func (c *SWUpdateClient) countMetric(name string, delta float64) {
+	if c.metrics != nil {
+		c.metrics.add(name, c.config.DeviceGroup, delta)
+	}
+}
+
+// observeUpdate records the outcome of a finished update in the metrics
+func (c *SWUpdateClient) observeUpdate(err error) {
+	if c.metrics == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		c.countMetric(metricUpdatesSucceeded, 1)
+	case errors.Is(err, errCancelled):
+		c.countMetric(metricUpdatesCancelled, 1)
+	default:
+		c.countMetric(metricUpdatesFailed, 1)
+	}
+
+	phases, _, _, _ := c.report.snapshot()
+	for i, phase := range phases {
+		switch {
+		case phase.Name == "upload" && c.upload.complete.Load() && phase.Duration > 0:
+			c.metrics.observe(metricUploadThroughput, c.config.DeviceGroup, float64(c.upload.sent.Load())/phase.Duration.Seconds())
+		case phase.Name == "install" && phase.Failure == "" && (i+1 < len(phases) || err == nil):
+			c.metrics.observe(metricInstallDuration, c.config.DeviceGroup, phase.Duration.Seconds())
+		}
+	}
+}
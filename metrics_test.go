@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics returns the exposition served by metrics
+func scrapeMetrics(t *testing.T, metrics *updateMetrics) string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	return recorder.Body.String()
+}
+
+func expectMetricLines(t *testing.T, exposition string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(exposition, "\n"+line+"\n") {
+			t.Errorf("Metrics do not contain %q:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestMetrics_Update(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, DeviceGroup: "gateways"}, 64<<10)
+	client.metrics = newUpdateMetrics()
+
+	captureStdout(t, func() {
+		if code := runUpdate(context.Background(), client, false); code != 0 {
+			t.Errorf("runUpdate() = %d, want 0", code)
+		}
+	})
+
+	exposition := scrapeMetrics(t, client.metrics)
+	expectMetricLines(t, exposition,
+		`# TYPE swupdate_updates_started_total counter`,
+		`swupdate_updates_started_total{group="gateways"} 1`,
+		`swupdate_updates_succeeded_total{group="gateways"} 1`,
+		`swupdate_upload_bytes_total{group="gateways"} 65536`,
+		`# TYPE swupdate_upload_throughput_bytes_per_second histogram`,
+		`swupdate_upload_throughput_bytes_per_second_count{group="gateways"} 1`,
+		`swupdate_install_duration_seconds_bucket{group="gateways",le="5"} 1`,
+		`swupdate_install_duration_seconds_count{group="gateways"} 1`,
+	)
+	if strings.Contains(exposition, "swupdate_updates_failed_total{") {
+		t.Errorf("Unexpected failure count:\n%s", exposition)
+	}
+}
+
+func TestMetrics_UploadBytesWhileUploading(t *testing.T) {
+	const size = 32 << 20
+	dev := newPhaseDevice(t)
+	var client *SWUpdateClient
+	var during string
+	dev.upload = func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.CopyN(io.Discard, r.Body, 64<<10)
+		during = scrapeMetrics(t, client.metrics)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	client = dev.client(t, Config{InstallTimeout: 5 * time.Second}, size)
+	client.metrics = newUpdateMetrics()
+	captureStdout(t, func() { runUpdate(context.Background(), client, false) })
+
+	var sent float64
+	for _, line := range strings.Split(during, "\n") {
+		if value, ok := strings.CutPrefix(line, `swupdate_upload_bytes_total{group=""} `); ok {
+			sent, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	if sent < 64<<10 || sent >= size {
+		t.Errorf("Expected the bytes sent so far while uploading, got %v:\n%s", sent, during)
+	}
+	final := scrapeMetrics(t, client.metrics)
+	expectMetricLines(t, final, fmt.Sprintf(`swupdate_upload_bytes_total{group=""} %d`, client.upload.sent.Load()))
+}
+
+func TestMetrics_TLSError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client := NewSWUpdateClient(Config{Target: server.URL, ConnectTimeout: 5 * time.Second, DeviceGroup: "lab"})
+	client.metrics = newUpdateMetrics()
+	if err := client.connectWebSocket(context.Background()); err == nil {
+		t.Fatal("Expected the untrusted certificate to be rejected")
+	}
+
+	expectMetricLines(t, scrapeMetrics(t, client.metrics), `swupdate_tls_errors_total{group="lab"} 1`)
+}
+
+func TestMetrics_HistogramBuckets(t *testing.T) {
+	metrics := newUpdateMetrics()
+	for _, seconds := range []float64{3, 45, 45, 4000} {
+		metrics.observe(metricInstallDuration, `a "quoted" group`, seconds)
+	}
+
+	expectMetricLines(t, scrapeMetrics(t, metrics),
+		`swupdate_install_duration_seconds_bucket{group="a \"quoted\" group",le="5"} 1`,
+		`swupdate_install_duration_seconds_bucket{group="a \"quoted\" group",le="30"} 1`,
+		`swupdate_install_duration_seconds_bucket{group="a \"quoted\" group",le="60"} 3`,
+		`swupdate_install_duration_seconds_bucket{group="a \"quoted\" group",le="1800"} 3`,
+		`swupdate_install_duration_seconds_bucket{group="a \"quoted\" group",le="+Inf"} 4`,
+		`swupdate_install_duration_seconds_sum{group="a \"quoted\" group"} 4093`,
+	)
+}
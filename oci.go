@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Media types of registry manifests
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType       = "application/vnd.oci.image.index.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// ociTitleAnnotation carries the original file name of a layer pushed with tools like oras
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+// ociReference is a parsed oci://registry/repository:tag or @digest reference
+type ociReference struct {
+	Registry   string // Registry host and optional port
+	Repository string // Repository path
+	Reference  string // Tag or digest
+}
+
+// ociDescriptor describes a manifest or blob in a registry
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest covers image manifests, artifact manifests and indexes
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+	Blobs     []ociDescriptor `json:"blobs,omitempty"`
+}
+
+// parseOCIReference parses oci://registry/repo[:tag|@digest]; the tag defaults to "latest"
+func parseOCIReference(location string) (ociReference, error) {
+	rest := strings.TrimPrefix(location, "oci://")
+	registry, repo, ok := strings.Cut(rest, "/")
+	if !ok || registry == "" || repo == "" {
+		return ociReference{}, fmt.Errorf("invalid OCI reference %q: expected oci://registry/repository:tag", location)
+	}
+
+	ref := ociReference{Registry: registry, Reference: "latest"}
+	if i := strings.Index(repo, "@"); i >= 0 {
+		ref.Repository, ref.Reference = repo[:i], repo[i+1:]
+		if !strings.HasPrefix(ref.Reference, "sha256:") {
+			return ociReference{}, fmt.Errorf("invalid OCI reference %q: only sha256 digests are supported", location)
+		}
+	} else if i := strings.LastIndex(repo, ":"); i >= 0 {
+		ref.Repository, ref.Reference = repo[:i], repo[i+1:]
+	} else {
+		ref.Repository = repo
+	}
+
+	if ref.Repository == "" || ref.Reference == "" {
+		return ociReference{}, fmt.Errorf("invalid OCI reference %q", location)
+	}
+	return ref, nil
+}
+
+// apiHost returns the host serving the registry API, mapping Docker Hub to its API endpoint
+func (r ociReference) apiHost() string {
+	if r.Registry == "docker.io" || r.Registry == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return r.Registry
+}
+
+// ociRegistry is a minimal read-only client for the OCI distribution API
+type ociRegistry struct {
+	ref      ociReference
+	scheme   string
+	client   *http.Client
+	username string
+	password string
+	token    string // Bearer token obtained from the registry's token service
+}
+
+// newOCIRegistry creates a registry client, loading credentials from the Docker configuration
+func (c *SWUpdateClient) newOCIRegistry(ref ociReference) (*ociRegistry, error) {
+	scheme := "https"
+	host := ref.Registry
+	if h, _, err := splitHostPort(host); err == nil {
+		host = h
+	}
+	if c.config.OCIPlainHTTP || host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		scheme = "http"
+	}
+
+	username, password, err := dockerCredentials(ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+	return &ociRegistry{ref: ref, scheme: scheme, client: http.DefaultClient, username: username, password: password}, nil
+}
+
+// get issues an authenticated GET to a registry API path, answering a bearer or basic challenge once
+func (r *ociRegistry) get(ctx context.Context, path string, accept ...string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s://%s/v2/%s/%s", r.scheme, r.ref.apiHost(), r.ref.Repository, path)
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		switch {
+		case r.token != "":
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		case r.username != "":
+			req.SetBasicAuth(r.username, r.password)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("registry request failed: %w", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			if err := r.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return nil, fmt.Errorf("registry returned status %d for %s: %s", resp.StatusCode, path, strings.TrimSpace(string(body)))
+	}
+}
+
+// authenticate answers a WWW-Authenticate challenge by fetching a bearer token from the token service
+func (r *ociRegistry) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.username == "" {
+			return fmt.Errorf("registry %s requires credentials (docker login)", r.ref.Registry)
+		}
+		// Credentials are already sent with every request, a second attempt would fail the same way
+		return fmt.Errorf("registry %s rejected the configured credentials", r.ref.Registry)
+	case "bearer":
+	default:
+		return fmt.Errorf("registry %s requires unsupported authentication %q", r.ref.Registry, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid token realm in registry challenge %q", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("registry token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry token request failed with status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("invalid registry token response: %w", err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("registry token response contained no token")
+	}
+	return nil
+}
+
+// resolveManifest fetches the manifest for the reference, following an index to its first manifest
+func (r *ociRegistry) resolveManifest(ctx context.Context) (*ociManifest, error) {
+	reference := r.ref.Reference
+	for depth := 0; depth < 2; depth++ {
+		resp, err := r.get(ctx, "manifests/"+reference, ociManifestMediaType, ociIndexMediaType, dockerManifestMediaType, dockerListMediaType)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+
+		if strings.HasPrefix(reference, "sha256:") {
+			if sum := sha256.Sum256(data); "sha256:"+hex.EncodeToString(sum[:]) != reference {
+				return nil, fmt.Errorf("manifest digest mismatch for %s", reference)
+			}
+		}
+
+		var manifest ociManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+		if manifest.MediaType == "" {
+			manifest.MediaType = resp.Header.Get("Content-Type")
+		}
+
+		if len(manifest.Manifests) == 0 {
+			return &manifest, nil
+		}
+		reference = manifest.Manifests[0].Digest
+	}
+	return nil, fmt.Errorf("manifest index for %s is nested too deeply", r.ref.Reference)
+}
+
+// selectLayer picks the firmware layer: the one with the requested media type, otherwise
+// a layer whose title ends in .swu, otherwise the only layer
+func selectLayer(manifest *ociManifest, mediaType string) (ociDescriptor, error) {
+	layers := append(append([]ociDescriptor{}, manifest.Layers...), manifest.Blobs...)
+	if len(layers) == 0 {
+		return ociDescriptor{}, fmt.Errorf("manifest has no layers")
+	}
+
+	if mediaType != "" {
+		for _, layer := range layers {
+			if layer.MediaType == mediaType {
+				return layer, nil
+			}
+		}
+		return ociDescriptor{}, fmt.Errorf("manifest has no layer with media type %s", mediaType)
+	}
+
+	for _, layer := range layers {
+		if strings.HasSuffix(layer.Annotations[ociTitleAnnotation], ".swu") {
+			return layer, nil
+		}
+	}
+	if len(layers) == 1 {
+		return layers[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("manifest has %d layers, select one with -oci-media-type", len(layers))
+}
+
+// openOCIFirmware resolves an oci:// reference and streams the selected layer, verifying its
+// digest and size as it is read
+func (c *SWUpdateClient) openOCIFirmware(ctx context.Context) (*firmwareSource, error) {
+	ref, err := parseOCIReference(c.config.Filename)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := c.newOCIRegistry(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := registry.resolveManifest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", c.config.Filename, err)
+	}
+	layer, err := selectLayer(manifest, c.config.OCIMediaType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select firmware layer of %s: %w", c.config.Filename, err)
+	}
+
+	algorithm, expected, ok := strings.Cut(layer.Digest, ":")
+	if !ok || algorithm != "sha256" {
+		return nil, fmt.Errorf("unsupported layer digest %q", layer.Digest)
+	}
+
+	resp, err := registry.get(ctx, "blobs/"+layer.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch firmware layer: %w", err)
+	}
+
+	name := layer.Annotations[ociTitleAnnotation]
+	if name == "" {
+		name = defaultUploadName
+	}
+	c.logMessage("download", "INFO", fmt.Sprintf("Streaming firmware layer %s from %s", layer.Digest, c.config.Filename))
+
+	return &firmwareSource{
+		Name: filepath.Base(name),
+		Size: layer.Size,
+		Reader: &digestVerifyingReader{
+			ReadCloser: resp.Body,
+			hash:       sha256.New(),
+			expected:   expected,
+			size:       layer.Size,
+		},
+	}, nil
+}
+
+// digestVerifyingReader fails the final read if the content does not match the expected
+// digest and size, so a corrupt layer aborts the upload instead of completing it
+type digestVerifyingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+	size     int64
+	read     int64
+}
+
+func (r *digestVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+
+	if r.read > r.size {
+		return n, fmt.Errorf("firmware layer is larger than its declared size %d", r.size)
+	}
+	if err == io.EOF {
+		if r.read != r.size {
+			return n, fmt.Errorf("firmware layer is truncated: got %d of %d bytes", r.read, r.size)
+		}
+		if digest := hex.EncodeToString(r.hash.Sum(nil)); digest != r.expected {
+			return n, fmt.Errorf("firmware layer digest mismatch: expected sha256:%s, got sha256:%s", r.expected, digest)
+		}
+	}
+	return n, err
+}
+
+// dockerConfigFile mirrors the parts of ~/.docker/config.json used for registry authentication
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerConfigPath returns the location of the Docker client configuration
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// dockerCredentials looks up registry credentials in the Docker configuration, including credential helpers.
+// It returns empty credentials if the registry has no entry.
+func dockerCredentials(registry string) (string, string, error) {
+	path := dockerConfigPath()
+	if path == "" {
+		return "", "", nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read docker config: %w", err)
+	}
+
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	keys := []string{registry}
+	if registry == "docker.io" || registry == "index.docker.io" || registry == "registry-1.docker.io" {
+		keys = append(keys, "https://index.docker.io/v1/")
+	}
+
+	if helper := config.CredHelpers[registry]; helper != "" {
+		return credentialHelper(helper, registry)
+	}
+
+	for key, entry := range config.Auths {
+		if !matchesRegistryKey(key, keys) {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid auth for %s in docker config: %w", key, err)
+			}
+			username, password, _ := strings.Cut(string(decoded), ":")
+			return username, password, nil
+		}
+		if entry.Username != "" {
+			return entry.Username, entry.Password, nil
+		}
+	}
+
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, registry)
+	}
+	return "", "", nil
+}
+
+// matchesRegistryKey compares a docker config auths key, which may be a URL, with registry names
+func matchesRegistryKey(key string, registries []string) bool {
+	host := key
+	if u, err := url.Parse(key); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	for _, registry := range registries {
+		if key == registry || host == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialHelper queries a docker-credential-<helper> program for registry credentials
+func credentialHelper(helper, registry string) (string, string, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	output, err := cmd.Output()
+	if err != nil {
+		// Helpers exit non-zero when they hold no credentials for the registry
+		return "", "", nil
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(output, &creds); err != nil {
+		return "", "", fmt.Errorf("invalid output from docker-credential-%s: %w", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header into its scheme and parameters
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := make(map[string]string)
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(strings.TrimSpace(rest), ",") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, after, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(v)
+			rest = after
+		}
+	}
+	return scheme, params
+}
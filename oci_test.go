@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRegistry is a minimal OCI distribution server with token authentication
+type testRegistry struct {
+	server   *httptest.Server
+	manifest []byte
+	blobs    map[string][]byte
+}
+
+func newTestRegistry(t *testing.T, layers map[string][]byte, mediaType string) *testRegistry {
+	t.Helper()
+
+	reg := &testRegistry{blobs: make(map[string][]byte)}
+	manifest := ociManifest{MediaType: ociManifestMediaType}
+	for name, content := range layers {
+		digest := "sha256:" + sha256Hex(content)
+		reg.blobs[digest] = content
+		manifest.Layers = append(manifest.Layers, ociDescriptor{
+			MediaType:   mediaType,
+			Digest:      digest,
+			Size:        int64(len(content)),
+			Annotations: map[string]string{ociTitleAnnotation: name},
+		})
+	}
+	reg.manifest, _ = json.Marshal(manifest)
+
+	reg.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, pass, _ := r.BasicAuth()
+			if user != "robot" || pass != "s3cret" || r.URL.Query().Get("scope") != "repository:firmware/board:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"registry-token"}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:firmware/board:pull"`, reg.server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/v2/firmware/board/manifests/v1.0":
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			_, _ = w.Write(reg.manifest)
+		case strings.HasPrefix(r.URL.Path, "/v2/firmware/board/blobs/"):
+			blob, ok := reg.blobs[strings.TrimPrefix(r.URL.Path, "/v2/firmware/board/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(blob)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(reg.server.Close)
+	return reg
+}
+
+// writeDockerConfig points DOCKER_CONFIG at a config.json with credentials for the registry
+func writeDockerConfig(t *testing.T, registry string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:s3cret"))
+	config := fmt.Sprintf(`{"auths":{"%s":{"auth":"%s"}}}`, registry, auth)
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+func TestParseOCIReference(t *testing.T) {
+	tests := []struct {
+		location string
+		want     ociReference
+		wantErr  bool
+	}{
+		{location: "oci://registry.example.com/firmware/board:v1", want: ociReference{"registry.example.com", "firmware/board", "v1"}},
+		{location: "oci://localhost:5000/board", want: ociReference{"localhost:5000", "board", "latest"}},
+		{location: "oci://localhost:5000/board@sha256:abc", want: ociReference{"localhost:5000", "board", "sha256:abc"}},
+		{location: "oci://registry.example.com", wantErr: true},
+		{location: "oci://localhost/board@md5:abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseOCIReference(tt.location)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseOCIReference(%q) error = %v, wantErr %v", tt.location, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseOCIReference(%q) = %+v, want %+v", tt.location, got, tt.want)
+		}
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("Unexpected scheme %q", scheme)
+	}
+	if params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:a/b:pull,push" {
+		t.Errorf("Unexpected params %v", params)
+	}
+}
+
+func TestSelectLayer(t *testing.T) {
+	manifest := &ociManifest{Layers: []ociDescriptor{
+		{MediaType: "application/vnd.example.readme", Annotations: map[string]string{ociTitleAnnotation: "README.md"}},
+		{MediaType: "application/vnd.swupdate.image", Annotations: map[string]string{ociTitleAnnotation: "board.swu"}},
+	}}
+
+	layer, err := selectLayer(manifest, "")
+	if err != nil || layer.MediaType != "application/vnd.swupdate.image" {
+		t.Errorf("Expected .swu titled layer, got %+v, %v", layer, err)
+	}
+	layer, err = selectLayer(manifest, "application/vnd.example.readme")
+	if err != nil || layer.Annotations[ociTitleAnnotation] != "README.md" {
+		t.Errorf("Expected layer by media type, got %+v, %v", layer, err)
+	}
+	if _, err := selectLayer(manifest, "application/missing"); err == nil {
+		t.Error("Expected error for missing media type")
+	}
+}
+
+func TestUploadFirmware_OCI(t *testing.T) {
+	content := bytes.Repeat([]byte("oci firmware"), 100)
+	reg := newTestRegistry(t, map[string][]byte{"board.swu": content}, "application/vnd.swupdate.image")
+	registry := strings.TrimPrefix(reg.server.URL, "http://")
+	writeDockerConfig(t, registry)
+
+	rcv := newFirmwareReceiver(t)
+	client := NewSWUpdateClient(Config{
+		Target:       rcv.server.URL,
+		Filename:     "oci://" + registry + "/firmware/board:v1.0",
+		OCIMediaType: "application/vnd.swupdate.image",
+		Timeout:      5 * time.Second,
+	})
+	if err := client.uploadFirmware(context.Background()); err != nil {
+		t.Fatalf("uploadFirmware() error = %v", err)
+	}
+	if rcv.name != "board.swu" || !bytes.Equal(rcv.data, content) {
+		t.Errorf("Device received %d bytes named %q", len(rcv.data), rcv.name)
+	}
+}
+
+func TestOpenOCIFirmware_DigestMismatch(t *testing.T) {
+	reg := newTestRegistry(t, map[string][]byte{"board.swu": []byte("original")}, "application/vnd.swupdate.image")
+	for digest := range reg.blobs {
+		reg.blobs[digest] = []byte("tampered")
+	}
+	registry := strings.TrimPrefix(reg.server.URL, "http://")
+	writeDockerConfig(t, registry)
+
+	client := NewSWUpdateClient(Config{Filename: "oci://" + registry + "/firmware/board:v1.0"})
+	source, err := client.openFirmware(context.Background())
+	if err != nil {
+		t.Fatalf("openFirmware() error = %v", err)
+	}
+	defer source.Reader.Close()
+
+	if _, err := io.ReadAll(source.Reader); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("Expected digest mismatch while reading, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Names of the update phases that have their own timeout
+const (
+	phaseConnect     = "connect"
+	phaseUpload      = "upload"
+	phaseUploadStall = "upload-stall"
+	phaseInstall     = "install"
+	phaseRestart     = "restart"
+	phaseRebootWait  = "reboot-wait"
+)
+
+// Default phase timeouts
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultStallTimeout   = time.Minute
+	defaultInstallTimeout = 10 * time.Minute
+	defaultRestartTimeout = 30 * time.Second
+)
+
+// Probing the device while waiting for it to reboot
+const (
+	rebootPollInterval = time.Second
+	rebootProbeTimeout = 5 * time.Second
+)
+
+// errProgressLost is returned when the WebSocket closes before the device reports the result
+// of the installation
+var errProgressLost = errors.New("lost progress connection to the device before the installation result")
+
+// phaseTimeoutError reports which phase of the update exceeded its timeout
+type phaseTimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+	Detail  string
+}
+
+func (e *phaseTimeoutError) Error() string {
+	msg := fmt.Sprintf("%s timeout (%s) exceeded", e.Phase, e.Timeout)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// withPhaseTimeout derives a context that is cancelled with a phaseTimeoutError once the
+// phase's timeout expires. A zero timeout means the phase has no limit of its own.
+func withPhaseTimeout(ctx context.Context, phase string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, &phaseTimeoutError{Phase: phase, Timeout: timeout})
+}
+
+// phaseError returns the phase timeout that cancelled ctx in place of err, if any
+func phaseError(ctx context.Context, err error) error {
+	var timeout *phaseTimeoutError
+	if errors.As(context.Cause(ctx), &timeout) {
+		return timeout
+	}
+	return err
+}
+
+// runContext returns the context for a whole run, limited by -timeout unless it is zero
+func runContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// dial opens a TCP connection to the device within the connect timeout
+func (c *SWUpdateClient) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.config.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil && isTimeout(err) && ctx.Err() == nil {
+		return nil, &phaseTimeoutError{Phase: phaseConnect, Timeout: c.config.ConnectTimeout, Detail: "dial " + addr}
+	}
+	return conn, err
+}
+
+// dialTLS returns a dial function that also completes the TLS handshake within the connect timeout
+func (c *SWUpdateClient) dialTLS(tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := c.dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			host, _, _ := net.SplitHostPort(addr)
+			if i := strings.Index(host, "%"); i >= 0 {
+				host = host[:i]
+			}
+			config.ServerName = host
+		}
+
+		handshakeCtx, cancel := withPhaseTimeout(ctx, phaseConnect, c.config.ConnectTimeout)
+		defer cancel()
+		span := c.startSpan("tls-handshake")
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+			conn.Close()
+			if handshakeCtx.Err() == nil {
+				c.countMetric(metricTLSErrors, 1)
+			}
+			err = phaseError(handshakeCtx, err)
+			c.endSpan(span, err, map[string]interface{}{"server.address": config.ServerName})
+			return nil, err
+		}
+		state := tlsConn.ConnectionState()
+		c.endSpan(span, nil, map[string]interface{}{
+			"server.address":       config.ServerName,
+			"tls.protocol.version": strings.TrimPrefix(tls.VersionName(state.Version), "TLS "),
+			"tls.cipher":           tls.CipherSuiteName(state.CipherSuite),
+			"tls.resumed":          state.DidResume,
+		})
+		return tlsConn, nil
+	}
+}
+
+// watchUploadStall cancels the upload if less than -min-upload-rate is sent within a -stall-timeout
+// window. Once the whole image has been sent the device is only awaited for its response.
+func (c *SWUpdateClient) watchUploadStall(ctx context.Context, cancel context.CancelCauseFunc) {
+	window := c.config.StallTimeout
+	if window <= 0 {
+		return
+	}
+	minBytes := int64(float64(c.config.MinUploadRate) * window.Seconds())
+	if minBytes < 1 {
+		minBytes = 1
+	}
+
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	last := c.upload.sent.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if c.upload.complete.Load() {
+				return
+			}
+			sent := c.upload.sent.Load()
+			if sent-last < minBytes {
+				cancel(&phaseTimeoutError{
+					Phase:   phaseUploadStall,
+					Timeout: window,
+					Detail:  fmt.Sprintf("only %s sent in the last %s", formatSize(sent-last), window),
+				})
+				return
+			}
+			last = sent
+		}
+	}
+}
+
+// awaitInstall waits for the device to report the result of the installation
+func (c *SWUpdateClient) awaitInstall(ctx context.Context) error {
+	installCtx, cancel := withPhaseTimeout(ctx, phaseInstall, c.config.InstallTimeout)
+	defer cancel()
+
+	result, err := c.waitForResult(installCtx)
+	if err != nil {
+		if errors.Is(err, errProgressLost) {
+			return err
+		}
+		return phaseError(installCtx, err)
+	}
+	if result == "FAILURE" {
+		return fmt.Errorf("installation failed on the device")
+	}
+	return nil
+}
+
+// waitForResult waits until the device reports SUCCESS or FAILURE and returns it. It fails with
+// errProgressLost when the WebSocket closes first, or with the context error when ctx is done.
+func (c *SWUpdateClient) waitForResult(ctx context.Context) (string, error) {
+	for {
+		result, lost, updated := c.state.result()
+		if result != "" {
+			return result, nil
+		}
+		if lost {
+			return "", errProgressLost
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// waitForReboot waits for the device to go down after the restart request and come back up
+func (c *SWUpdateClient) waitForReboot(ctx context.Context) error {
+	rebootCtx, cancel := withPhaseTimeout(ctx, phaseRebootWait, c.config.RebootTimeout)
+	defer cancel()
+
+	c.logMessage("restart", "INFO", fmt.Sprintf("Waiting up to %s for the device to reboot", c.config.RebootTimeout))
+	start := time.Now()
+	wentDown := false
+	ticker := time.NewTicker(rebootPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rebootCtx.Done():
+			err := phaseError(rebootCtx, rebootCtx.Err())
+			if _, ok := err.(*phaseTimeoutError); ok && !wentDown {
+				return &phaseTimeoutError{Phase: phaseRebootWait, Timeout: c.config.RebootTimeout, Detail: "the device did not go down"}
+			}
+			return err
+		case <-ticker.C:
+		}
+
+		up := c.probeDevice(rebootCtx)
+		if !up {
+			wentDown = true
+			continue
+		}
+		if wentDown {
+			c.logMessage("restart", "INFO", fmt.Sprintf("Device is back online after %s", time.Since(start).Round(time.Second)))
+			return nil
+		}
+	}
+}
+
+// probeDevice reports whether the device's web server answers HTTP requests
+func (c *SWUpdateClient) probeDevice(ctx context.Context) bool {
+	target, err := c.target()
+	if err != nil {
+		return false
+	}
+	client, err := c.httpClient(target)
+	if err != nil {
+		return false
+	}
+	defer client.CloseIdleConnections()
+
+	probeCtx, cancel := context.WithTimeout(ctx, rebootProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(probeCtx, "GET", target.String(), nil)
+	if err != nil {
+		return false
+	}
+	if err := c.applyHeaders(req); err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// phaseDevice is a test device whose upload, WebSocket and restart behaviour is scripted per test
+type phaseDevice struct {
+	server      *httptest.Server
+	upload      func(w http.ResponseWriter, r *http.Request)
+	afterUpload []SWUpdateEvent
+	dropSocket  bool                                         // Close the WebSocket after sending afterUpload
+	restart     func(w http.ResponseWriter, r *http.Request) // Handles /restart instead of accepting it
+	downProbes  int32                                        // Probes of / that fail after the restart request
+	restarted   atomic.Bool
+	release     chan struct{}
+}
+
+func newPhaseDevice(t *testing.T) *phaseDevice {
+	t.Helper()
+
+	dev := &phaseDevice{release: make(chan struct{})}
+	uploaded := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	dev.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			select {
+			case <-uploaded:
+			case <-dev.release:
+				return
+			}
+			for _, event := range dev.afterUpload {
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+			if dev.dropSocket {
+				return
+			}
+			_, _, _ = conn.ReadMessage()
+		case "/upload":
+			if dev.upload != nil {
+				dev.upload(w, r)
+				return
+			}
+			_, _ = io.Copy(io.Discard, r.Body)
+			close(uploaded)
+		case "/restart":
+			dev.restarted.Store(true)
+			if dev.restart != nil {
+				dev.restart(w, r)
+			}
+		case "/":
+			if dev.restarted.Load() && atomic.AddInt32(&dev.downProbes, -1) >= 0 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			}
+		}
+	}))
+	t.Cleanup(dev.server.Close)
+	t.Cleanup(func() { close(dev.release) })
+	return dev
+}
+
+func (dev *phaseDevice) client(t *testing.T, config Config, imageSize int) *SWUpdateClient {
+	config.Target = dev.server.URL
+	config.Filename = writeTestFile(t, "image.swu", bytes.Repeat([]byte("x"), imageSize))
+	return NewSWUpdateClient(config)
+}
+
+func expectPhaseTimeout(t *testing.T, err error, phase string) {
+	t.Helper()
+
+	var timeout *phaseTimeoutError
+	if !errors.As(err, &timeout) || timeout.Phase != phase {
+		t.Fatalf("Expected %s timeout, got %v", phase, err)
+	}
+	if !strings.Contains(err.Error(), phase+" timeout") {
+		t.Errorf("Error %q does not name the phase", err)
+	}
+}
+
+func TestUpdate_UploadStall(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.upload = func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.CopyN(io.Discard, r.Body, 64*1024)
+		<-dev.release
+	}
+
+	// Large enough not to fit into the socket buffers
+	client := dev.client(t, Config{StallTimeout: 200 * time.Millisecond}, 32<<20)
+	expectPhaseTimeout(t, client.Update(context.Background(), false), phaseUploadStall)
+}
+
+func TestUpdate_UploadTimeout(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.upload = func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-dev.release:
+		}
+	}
+
+	// The image is fully sent, so only the overall upload timeout applies while waiting for the response
+	client := dev.client(t, Config{UploadTimeout: 300 * time.Millisecond, StallTimeout: 100 * time.Millisecond}, 1<<20)
+	expectPhaseTimeout(t, client.Update(context.Background(), false), phaseUpload)
+}
+
+func TestUpdate_InstallResult(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "RUN"}, {Type: "status", Status: "FAILURE"}}
+
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second}, 1<<20)
+	if err := client.Update(context.Background(), true); err == nil || !strings.Contains(err.Error(), "installation failed") {
+		t.Errorf("Expected installation failure, got %v", err)
+	}
+	if dev.restarted.Load() {
+		t.Error("Device was restarted after a failed installation")
+	}
+}
+
+func TestUpdate_InstallTimeout(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "RUN"}}
+
+	client := dev.client(t, Config{InstallTimeout: 200 * time.Millisecond}, 1<<20)
+	expectPhaseTimeout(t, client.Update(context.Background(), false), phaseInstall)
+}
+
+func TestUpdate_ProgressConnectionLost(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "RUN"}}
+	dev.dropSocket = true
+
+	client := dev.client(t, Config{InstallTimeout: 10 * time.Second}, 1<<20)
+	start := time.Now()
+	if err := client.Update(context.Background(), false); !errors.Is(err, errProgressLost) {
+		t.Fatalf("Expected lost progress connection error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Update waited %s for a result after the connection was lost", elapsed)
+	}
+}
+
+func TestUpdate_RebootWait(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+	dev.downProbes = 2
+
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, RebootTimeout: 10 * time.Second}, 1<<20)
+	if err := client.Update(context.Background(), true); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if remaining := atomic.LoadInt32(&dev.downProbes); remaining > 0 {
+		t.Errorf("Reboot wait ended before the device went down and came back (%d down probes left)", remaining)
+	}
+}
+
+func TestUpdate_RebootWaitTimeout(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, RebootTimeout: 1500 * time.Millisecond}, 1<<20)
+	err := client.Update(context.Background(), true)
+	expectPhaseTimeout(t, err, phaseRebootWait)
+	if !strings.Contains(err.Error(), "did not go down") {
+		t.Errorf("Expected the error to say the device never went down, got %v", err)
+	}
+}
+
+func TestConnectTimeout_TLSHandshake(t *testing.T) {
+	// Accepts TCP connections but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewSWUpdateClient(Config{
+		Target:         "https://" + listener.Addr().String(),
+		ConnectTimeout: 200 * time.Millisecond,
+	})
+	err = client.connectWebSocket(context.Background())
+	expectPhaseTimeout(t, err, phaseConnect)
+
+	target, _ := client.target()
+	httpClient, err := client.httpClient(target)
+	if err != nil {
+		t.Fatalf("httpClient() error = %v", err)
+	}
+	_, err = httpClient.Get(target.restartURL())
+	expectPhaseTimeout(t, err, phaseConnect)
+}
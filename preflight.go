@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// hwRegexPrefix marks a hardware-compatibility entry as a regular expression, as in SWUpdate
+const hwRegexPrefix = "#RE:"
+
+// preflightFirmware runs the checks that must pass before the image is sent to the device
+func (c *SWUpdateClient) preflightFirmware(ctx context.Context, firmware *firmwareSource) error {
+	checks := c.config.HWRevision != "" || c.versionPolicyEnabled() || c.config.PublicKeyFile != "" || c.config.DryRun
+	if !checks && !c.recordsImage() {
+		return nil
+	}
+
+	desc, err := peekSWDescription(firmware)
+	switch {
+	case err != nil && !checks:
+		return nil // Only wanted for the session file and history
+	case err != nil:
+		return c.refuse(fmt.Errorf("cannot read image metadata: %w", err))
+	}
+	c.image.Version, c.image.Manifest = desc.version(), string(desc.Raw)
+	if !checks {
+		return nil
+	}
+	if c.config.DryRun {
+		version := c.image.Version
+		if version == "" {
+			version = "unknown"
+		}
+		c.logMessage("dry-run", "INFO", fmt.Sprintf("Image %s parsed, sw-description version %s", firmware.Name, version))
+	}
+
+	if c.config.PublicKeyFile != "" || c.config.DryRun {
+		if err := c.checkSignature(desc); err != nil {
+			return err
+		}
+	}
+
+	if c.config.HWRevision != "" {
+		if err := c.checkHardwareCompatibility(desc); err != nil {
+			return err
+		}
+	}
+	if c.versionPolicyEnabled() {
+		if err := c.checkVersionPolicy(ctx, desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHardwareCompatibility refuses images whose hardware-compatibility does not include the
+// configured revision. Images that declare no compatibility are accepted, as SWUpdate does.
+func (c *SWUpdateClient) checkHardwareCompatibility(desc *swDescription) error {
+	board, revision := parseHWRevision(c.config.HWRevision)
+
+	accepted, ok, err := desc.hardwareCompatibility(board)
+	if err != nil {
+		return c.refuse(err)
+	}
+	if !ok {
+		c.logMessage("preflight", "INFO", "Image declares no hardware compatibility, skipping check")
+		return nil
+	}
+
+	matched, err := hardwareRevisionMatches(accepted, revision)
+	if err != nil {
+		return c.refuse(err)
+	}
+	if !matched {
+		return c.refuse(fmt.Errorf("image is not compatible with hardware revision %s (accepts %s)",
+			revision, strings.Join(accepted, ", ")))
+	}
+
+	c.logMessage("preflight", "INFO", fmt.Sprintf("Hardware revision %s is compatible with the image", revision))
+	return nil
+}
+
+// checkSignature checks the image's sw-description.sig. With -public-key the signature must verify;
+// without one an image with an empty signature is refused and the dry run reports whether the image
+// is signed, since the device may require signed images.
+func (c *SWUpdateClient) checkSignature(desc *swDescription) error {
+	if c.config.PublicKeyFile == "" {
+		switch {
+		case !desc.Signed:
+			c.logMessage("dry-run", "WARN", "Image is not signed: it has no "+swDescriptionSigName)
+		case len(desc.Signature) == 0:
+			return c.refuse(fmt.Errorf("image has an empty %s", swDescriptionSigName))
+		default:
+			c.logMessage("dry-run", "INFO", fmt.Sprintf("Image is signed (%s, %d bytes), not verified without -public-key", swDescriptionSigName, len(desc.Signature)))
+		}
+		return nil
+	}
+
+	key, err := loadPublicKey(c.config.PublicKeyFile)
+	if err != nil {
+		return err
+	}
+	if len(desc.Signature) == 0 {
+		return c.refuse(fmt.Errorf("image is not signed: %s is missing or empty", swDescriptionSigName))
+	}
+	if err := verifySignature(key, desc.Raw, desc.Signature); err != nil {
+		return c.refuse(fmt.Errorf("signature of sw-description does not verify with %s: %w", c.config.PublicKeyFile, err))
+	}
+	c.logMessage("preflight", "INFO", fmt.Sprintf("Signature of sw-description verified with %s", c.config.PublicKeyFile))
+	return nil
+}
+
+// loadPublicKey reads a PEM public key in PKIX ("PUBLIC KEY") or PKCS#1 ("RSA PUBLIC KEY") form
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to read public key: %s is not PEM encoded", path)
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return key, nil
+}
+
+// verifySignature checks a SHA-256 signature of data as created by "openssl dgst -sha256 -sign":
+// RSA PKCS#1 v1.5 or PSS, or ECDSA
+func verifySignature(key crypto.PublicKey, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err == nil {
+			return nil
+		}
+		return rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// refuse returns err unless -force is set, in which case it is logged as a warning and ignored
+func (c *SWUpdateClient) refuse(err error) error {
+	if !c.config.Force {
+		return err
+	}
+	c.logMessage("preflight", "WARN", fmt.Sprintf("%v (continuing because -force is set)", err))
+	return nil
+}
+
+// parseHWRevision splits a revision given as "revision" or in /etc/hwrevision form "board revision"
+func parseHWRevision(spec string) (board, revision string) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", fields[0]
+	}
+	return fields[0], fields[1]
+}
+
+// hardwareRevisionMatches reports whether the revision is accepted by any hardware-compatibility entry.
+// Entries are exact revisions or, with a "#RE:" prefix, regular expressions.
+func hardwareRevisionMatches(accepted []string, revision string) (bool, error) {
+	for _, entry := range accepted {
+		if pattern, ok := strings.CutPrefix(entry, hwRegexPrefix); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return false, fmt.Errorf("invalid hardware-compatibility expression %q: %w", pattern, err)
+			}
+			if re.MatchString(revision) {
+				return true, nil
+			}
+			continue
+		}
+		if entry == revision {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHardwareRevisionMatches(t *testing.T) {
+	accepted := []string{"1.0", `#RE:^2\.[0-9]+$`}
+
+	tests := []struct {
+		revision string
+		want     bool
+	}{
+		{"1.0", true},
+		{"2.7", true},
+		{"1.1", false},
+		{"2.x", false},
+		{"12.1", false},
+	}
+	for _, tt := range tests {
+		if got, err := hardwareRevisionMatches(accepted, tt.revision); err != nil || got != tt.want {
+			t.Errorf("hardwareRevisionMatches(%q) = %v, %v; want %v", tt.revision, got, err, tt.want)
+		}
+	}
+
+	if _, err := hardwareRevisionMatches([]string{"#RE:("}, "1.0"); err == nil {
+		t.Error("Expected error for invalid expression")
+	}
+}
+
+func TestParseHWRevision(t *testing.T) {
+	if board, rev := parseHWRevision("1.0"); board != "" || rev != "1.0" {
+		t.Errorf("parseHWRevision(1.0) = %q, %q", board, rev)
+	}
+	if board, rev := parseHWRevision(" myboard  3.0 "); board != "myboard" || rev != "3.0" {
+		t.Errorf("parseHWRevision(myboard 3.0) = %q, %q", board, rev)
+	}
+}
+
+func TestUploadFirmware_HardwareCompatibility(t *testing.T) {
+	image := buildSWU(testSWDescription, bytes.Repeat([]byte("rootfs"), 100))
+	file := writeTestFile(t, "image.swu", image)
+
+	tests := []struct {
+		name       string
+		hwRevision string
+		force      bool
+		wantErr    bool
+	}{
+		{"exact match", "1.2", false, false},
+		{"regex match", "2.4", false, false},
+		{"board section", "myboard 3.0", false, false},
+		{"mismatch refused", "1.1", false, true},
+		{"board mismatch refused", "myboard 1.0", false, true},
+		{"mismatch forced", "1.1", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newFirmwareReceiver(t)
+			client := NewSWUpdateClient(Config{
+				Target:     rcv.server.URL,
+				Filename:   file,
+				HWRevision: tt.hwRevision,
+				Force:      tt.force,
+				Timeout:    5 * time.Second,
+			})
+
+			err := client.uploadFirmware(context.Background())
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "not compatible") {
+					t.Errorf("Expected compatibility error, got %v", err)
+				}
+				if rcv.data != nil {
+					t.Error("Firmware was uploaded despite mismatch")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("uploadFirmware() error = %v", err)
+			}
+			if !bytes.Equal(rcv.data, image) {
+				t.Errorf("Device received %d bytes, want the unchanged %d byte image", len(rcv.data), len(image))
+			}
+		})
+	}
+}
+
+func TestUploadFirmware_HardwareCheckNeedsImage(t *testing.T) {
+	rcv := newFirmwareReceiver(t)
+	file := writeTestFile(t, "image.swu", []byte("not a swu image"))
+
+	client := NewSWUpdateClient(Config{Target: rcv.server.URL, Filename: file, HWRevision: "1.0", Timeout: 5 * time.Second})
+	if err := client.uploadFirmware(context.Background()); err == nil {
+		t.Error("Expected error for unreadable sw-description")
+	}
+
+	client.config.Force = true
+	if err := client.uploadFirmware(context.Background()); err != nil {
+		t.Errorf("uploadFirmware() with -force error = %v", err)
+	}
+}
+
+func TestUploadFirmware_Signature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	keyFile := writeTestFile(t, "public.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}))
+	digest := sha256.Sum256([]byte(testSWDescription))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		image   []byte
+		wantErr string
+	}{
+		{"valid", buildSignedSWU(testSWDescription, signature, []byte("rootfs")), ""},
+		{"tampered", buildSignedSWU(testSWDescription+"\n", signature, []byte("rootfs")), "does not verify"},
+		{"empty", buildSignedSWU(testSWDescription, nil, []byte("rootfs")), "missing or empty"},
+		{"unsigned", buildSWU(testSWDescription, []byte("rootfs")), "missing or empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newFirmwareReceiver(t)
+			client := NewSWUpdateClient(Config{
+				Target:        rcv.server.URL,
+				Filename:      writeTestFile(t, "image.swu", tt.image),
+				PublicKeyFile: keyFile,
+				Timeout:       5 * time.Second,
+			})
+			err := client.uploadFirmware(context.Background())
+			if tt.wantErr == "" {
+				if err != nil || !bytes.Equal(rcv.data, tt.image) {
+					t.Errorf("uploadFirmware() error = %v, device received %d of %d bytes", err, len(rcv.data), len(tt.image))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if rcv.data != nil {
+				t.Error("Firmware was uploaded despite the signature check")
+			}
+		})
+	}
+}
+
+func TestCheckSignature_DryRunWithoutKey(t *testing.T) {
+	client := NewSWUpdateClient(Config{Target: "http://192.168.1.100", DryRun: true, JSONOutput: true})
+
+	output := captureStdout(t, func() {
+		if err := client.checkSignature(&swDescription{}); err != nil {
+			t.Errorf("Unsigned image refused: %v", err)
+		}
+		if err := client.checkSignature(&swDescription{Signed: true, Signature: []byte("sig")}); err != nil {
+			t.Errorf("Signed image refused: %v", err)
+		}
+	})
+	if !strings.Contains(output, "Image is not signed") || !strings.Contains(output, "Image is signed (sw-description.sig, 3 bytes)") {
+		t.Errorf("Expected the signature state in the dry-run output:\n%s", output)
+	}
+	if err := client.checkSignature(&swDescription{Signed: true}); err == nil || !strings.Contains(err.Error(), "empty sw-description.sig") {
+		t.Errorf("Expected an empty signature to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Terminal progress display
+const (
+	progressRefresh   = 200 * time.Millisecond // How often the status block is redrawn
+	progressBarWidth  = 30                     // Width of the bars in characters
+	plainStepInterval = 10                     // Percent steps between install progress lines without a terminal
+)
+
+// progressUI renders the update progress on a terminal: a status block with the upload bar, one
+// install bar per image and the current step is kept at the bottom of the screen, and messages
+// scroll above it.
+type progressUI struct {
+	mu     sync.Mutex
+	out    io.Writer
+	width  int
+	upload *uploadProgress
+
+	images  []string       // Image names in the order the device reported them
+	percent map[string]int // Install progress per image
+	step    string         // Current step
+	steps   string         // Total number of steps
+
+	rate     float64   // Upload rate over the last second
+	lastSent int64     // Bytes sent when the rate was last computed
+	lastTime time.Time // When the rate was last computed
+
+	lines int // Height of the drawn status block
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newTerminalUI returns a progress UI for stdout, or nil when stdout is not a terminal
+func newTerminalUI(upload *uploadProgress) *progressUI {
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	width, _, err := term.GetSize(fd)
+	if err != nil || width <= 0 {
+		width = 80
+	}
+	return newProgressUI(os.Stdout, width, upload)
+}
+
+func newProgressUI(out io.Writer, width int, upload *uploadProgress) *progressUI {
+	return &progressUI{out: out, width: width, upload: upload, percent: make(map[string]int)}
+}
+
+// start redraws the status block periodically until finish is called
+func (u *progressUI) start() {
+	u.mu.Lock()
+	u.stop, u.done = make(chan struct{}), make(chan struct{})
+	u.lastTime = time.Now()
+	u.mu.Unlock()
+
+	go func() {
+		defer close(u.done)
+		ticker := time.NewTicker(progressRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case now := <-ticker.C:
+				u.mu.Lock()
+				if elapsed := now.Sub(u.lastTime); elapsed >= time.Second {
+					sent := u.upload.sent.Load()
+					u.rate = float64(sent-u.lastSent) / elapsed.Seconds()
+					u.lastSent, u.lastTime = sent, now
+				}
+				u.redraw()
+				u.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// finish stops redrawing and leaves the final status block on the screen
+func (u *progressUI) finish() {
+	if u.stop == nil {
+		return
+	}
+	close(u.stop)
+	<-u.done
+	u.stop = nil
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rate = 0
+	u.redraw()
+	u.lines = 0
+}
+
+// println prints a message above the status block
+func (u *progressUI) println(line string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.clear()
+	fmt.Fprintln(u.out, line)
+	u.draw()
+}
+
+// stepEvent records the install progress of a step event
+func (u *progressUI) stepEvent(event SWUpdateEvent) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if event.Step != "" && event.Number != "" {
+		u.step, u.steps = event.Step, event.Number
+	}
+	if event.Name == "" || event.Percent == "" {
+		return
+	}
+	percent, err := strconv.Atoi(event.Percent)
+	if err != nil {
+		return
+	}
+	if _, ok := u.percent[event.Name]; !ok {
+		u.images = append(u.images, event.Name)
+	}
+	u.percent[event.Name] = percent
+}
+
+// redraw replaces the status block on the screen
+func (u *progressUI) redraw() {
+	u.clear()
+	u.draw()
+}
+
+// clear erases the status block
+func (u *progressUI) clear() {
+	if u.lines > 0 {
+		fmt.Fprintf(u.out, "\x1b[%dA\r\x1b[J", u.lines)
+		u.lines = 0
+	}
+}
+
+// draw prints the status block below the cursor
+func (u *progressUI) draw() {
+	lines := u.statusLines()
+	for _, line := range lines {
+		if u.width > 1 && len(line) >= u.width {
+			line = line[:u.width-1]
+		}
+		fmt.Fprintln(u.out, line)
+	}
+	u.lines = len(lines)
+}
+
+// statusLines returns the lines of the status block
+func (u *progressUI) statusLines() []string {
+	var lines []string
+
+	sent, size := u.upload.sent.Load(), u.upload.size.Load()
+	switch {
+	case size > 0:
+		line := fmt.Sprintf("%-12s %s %3d%%  %s / %s", "Upload", progressBar(sent*100/size), sent*100/size, formatSize(sent), formatSize(size))
+		if u.rate > 0 {
+			line += "  " + formatRate(u.rate)
+		}
+		lines = append(lines, line)
+	case sent > 0:
+		lines = append(lines, fmt.Sprintf("%-12s %s sent  %s", "Upload", formatSize(sent), formatRate(u.rate)))
+	}
+
+	for _, name := range u.images {
+		lines = append(lines, fmt.Sprintf("%-12s %s %3d%%", name, progressBar(int64(u.percent[name])), u.percent[name]))
+	}
+
+	if u.step != "" {
+		lines = append(lines, fmt.Sprintf("Step %s of %s", u.step, u.steps))
+	}
+	return lines
+}
+
+// progressBar renders percent as a bar of progressBarWidth characters
+func progressBar(percent int64) string {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	filled := int(percent) * progressBarWidth / 100
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled) + "]"
+}
+
+// reportStepProgress decides whether an install progress line is printed without a terminal.
+// Only every plainStepInterval percent and completion are reported per image.
+func (c *SWUpdateClient) reportStepProgress(name, percentText string) bool {
+	percent, err := strconv.Atoi(percentText)
+	if err != nil {
+		return true
+	}
+	if c.stepPercent == nil {
+		c.stepPercent = make(map[string]int)
+	}
+	last, seen := c.stepPercent[name]
+	if seen && (percent == last || percent != 100 && percent/plainStepInterval == last/plainStepInterval) {
+		return false
+	}
+	c.stepPercent[name] = percent
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProgressUI_StatusLines(t *testing.T) {
+	var upload uploadProgress
+	upload.size.Store(4 << 20)
+	upload.sent.Store(1 << 20)
+
+	ui := newProgressUI(&bytes.Buffer{}, 120, &upload)
+	ui.rate = 2 << 20
+	ui.stepEvent(SWUpdateEvent{Type: "step", Step: "2", Number: "3", Name: "rootfs", Percent: "40"})
+	ui.stepEvent(SWUpdateEvent{Type: "step", Name: "kernel", Percent: "100"})
+
+	lines := ui.statusLines()
+	want := []string{
+		"Upload       [#######-----------------------]  25%  1.00 MB / 4.00 MB  2.00 MB/s",
+		"rootfs       [############------------------]  40%",
+		"kernel       [##############################] 100%",
+		"Step 2 of 3",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statusLines() =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestProgressUI_MessagesScrollAboveStatus(t *testing.T) {
+	var out bytes.Buffer
+	var upload uploadProgress
+	ui := newProgressUI(&out, 80, &upload)
+
+	ui.stepEvent(SWUpdateEvent{Type: "step", Step: "1", Number: "2"})
+	ui.redraw()
+	ui.println("Warning: low disk space")
+
+	// The one-line status block is erased, the message printed and the block drawn again below it
+	want := "Step 1 of 2\n\x1b[1A\r\x1b[JWarning: low disk space\nStep 1 of 2\n"
+	if out.String() != want {
+		t.Errorf("Output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestHandleStepEvent_TerminalUI(t *testing.T) {
+	var out bytes.Buffer
+	client := NewSWUpdateClient(Config{})
+	client.ui = newProgressUI(&out, 80, &client.upload)
+
+	output := captureStdout(t, func() {
+		client.handleWebSocketEvent(SWUpdateEvent{Type: "step", Name: "rootfs", Percent: "50"})
+	})
+	if output != "" {
+		t.Errorf("Step event printed %q instead of updating the progress display", output)
+	}
+	if client.ui.percent["rootfs"] != 50 {
+		t.Errorf("Progress display has rootfs at %d%%, want 50%%", client.ui.percent["rootfs"])
+	}
+}
+
+func TestReportStepProgress_Plain(t *testing.T) {
+	client := NewSWUpdateClient(Config{})
+
+	var printed []string
+	for _, percent := range []string{"0", "1", "5", "9", "10", "10", "15", "42", "99", "100", "100"} {
+		if client.reportStepProgress("rootfs", percent) {
+			printed = append(printed, percent)
+		}
+	}
+	if got := strings.Join(printed, ","); got != "0,10,42,99,100" {
+		t.Errorf("Printed progress %s, want 0,10,42,99,100", got)
+	}
+	if !client.reportStepProgress("kernel", "37") {
+		t.Error("The first progress of another image was not printed")
+	}
+}
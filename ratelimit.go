@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// uploadProgressInterval is how often upload progress and throughput are reported
+const uploadProgressInterval = 2 * time.Second
+
+// rateLimiter is a token bucket limiting throughput in bytes per second. One limiter can be
+// shared by several uploads to enforce an aggregate limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64   // Tokens (bytes) added per second
+	burst  float64   // Bucket capacity
+	tokens float64   // Currently available tokens
+	last   time.Time // Last refill
+}
+
+// newRateLimiter creates a limiter for rate bytes per second with a burst of about 100ms of traffic
+func newRateLimiter(rate int64) *rateLimiter {
+	burst := float64(rate) / 10
+	if burst < 4096 {
+		burst = 4096
+	}
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	for remaining := float64(n); remaining > 0; {
+		chunk := remaining
+		if chunk > l.burst {
+			chunk = l.burst
+		}
+
+		delay := l.reserve(chunk)
+		if delay == 0 {
+			remaining -= chunk
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// reserve takes n tokens if available, otherwise returns how long until they will be
+func (l *rateLimiter) reserve(n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= n {
+		l.tokens -= n
+		return 0
+	}
+	return time.Duration((n - l.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitedReader delays reads so that every limiter's rate is respected
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+	chunk    int
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if waitErr := l.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// limitUpload applies -rate-limit and the aggregate limit shared with other devices to the upload stream
+func (c *SWUpdateClient) limitUpload(ctx context.Context, r io.Reader) io.Reader {
+	var limiters []*rateLimiter
+	if c.config.RateLimit > 0 {
+		limiters = append(limiters, newRateLimiter(c.config.RateLimit))
+	}
+	if c.totalLimit != nil {
+		limiters = append(limiters, c.totalLimit)
+	}
+	if len(limiters) == 0 {
+		return r
+	}
+
+	chunk := 32 * 1024
+	for _, l := range limiters {
+		if int(l.burst) < chunk {
+			chunk = int(l.burst)
+		}
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: limiters, chunk: chunk}
+}
+
+// reportUploadProgress periodically logs how much of the image has been sent and the effective rate
+func (c *SWUpdateClient) reportUploadProgress(ctx context.Context) {
+	ticker := time.NewTicker(uploadProgressInterval)
+	defer ticker.Stop()
+
+	last, lastTime := c.upload.sent.Load(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if c.upload.complete.Load() {
+				return
+			}
+			if c.ui != nil || c.row != nil {
+				continue // The progress display shows the upload
+			}
+			sent, size := c.upload.sent.Load(), c.upload.size.Load()
+			rate := float64(sent-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = sent, now
+
+			data := map[string]interface{}{"bytes_sent": sent, "rate": int64(rate)}
+			message := fmt.Sprintf("Uploading: %s at %s", formatSize(sent), formatRate(rate))
+			if size > 0 {
+				data["image_size"] = size
+				data["percent"] = sent * 100 / size
+				message = fmt.Sprintf("Uploading: %s of %s (%d%%) at %s", formatSize(sent), formatSize(size), sent*100/size, formatRate(rate))
+			}
+			c.logEvent("upload-progress", "INFO", message, data)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Throughput(t *testing.T) {
+	limiter := newRateLimiter(400 << 10)
+	r := &rateLimitedReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, 200<<10)), limiters: []*rateLimiter{limiter}, chunk: 32 << 10}
+
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatalf("Copy error = %v", err)
+	}
+	// 200KB at 400KB/s, less the initial burst of 40KB
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Reading 200KB at 400KB/s took %s", elapsed)
+	}
+}
+
+func TestRateLimiter_SharedAggregate(t *testing.T) {
+	total := newRateLimiter(400 << 10)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := &rateLimitedReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, 100<<10)), limiters: []*rateLimiter{total}, chunk: 32 << 10}
+			_, _ = io.Copy(io.Discard, r)
+		}()
+	}
+	wg.Wait()
+
+	// Both readers together are limited to 400KB/s
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("Reading 2x100KB through a shared 400KB/s limit took only %s", elapsed)
+	}
+}
+
+func TestRateLimiter_Cancel(t *testing.T) {
+	limiter := newRateLimiter(1 << 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := limiter.wait(ctx, 64<<10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("wait() returned %s after cancellation", elapsed)
+	}
+}
+
+func TestUpdate_RateLimit(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{{Type: "status", Status: "SUCCESS"}}
+
+	client := dev.client(t, Config{RateLimit: 512 << 10, InstallTimeout: 5 * time.Second}, 384<<10)
+	start := time.Now()
+	if err := client.Update(context.Background(), false); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Uploading 384KB at 512KB/s took only %s", elapsed)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultStatusWait is how long the client listens for the device's current status before uploading
+const defaultStatusWait = time.Second
+
+// busyStatuses are the SWUpdate states in which the device cannot accept another image
+var busyStatuses = map[string]bool{
+	"START":      true,
+	"RUN":        true,
+	"DOWNLOAD":   true,
+	"PROGRESS":   true,
+	"SUBPROCESS": true,
+}
+
+// deviceState tracks the most recent update status reported over the WebSocket
+type deviceState struct {
+	mu      sync.Mutex
+	status  string        // Last reported status, empty until the device reports one
+	outcome string        // SUCCESS or FAILURE of the last installation since clearResult
+	lost    bool          // The WebSocket listener exited, no further updates will arrive
+	updated chan struct{} // Closed and replaced whenever the status is updated
+}
+
+func newDeviceState() *deviceState {
+	return &deviceState{updated: make(chan struct{})}
+}
+
+// observe records the status from status events. Step events are only sent while an
+// image is being installed, so they mark the device as busy.
+func (s *deviceState) observe(event SWUpdateEvent) {
+	var status string
+	switch event.Type {
+	case "status":
+		status = event.Status
+	case "step":
+		status = "PROGRESS"
+	default:
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	if status == "SUCCESS" || status == "FAILURE" {
+		s.outcome = status
+	}
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// current returns the last status and a channel that is closed on the next update
+func (s *deviceState) current() (string, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status, s.updated
+}
+
+// result returns the outcome of the installation, whether the progress connection was lost
+// and a channel that is closed on the next update
+func (s *deviceState) result() (string, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.outcome, s.lost, s.updated
+}
+
+// disconnect records that the WebSocket listener exited and wakes up anyone waiting for an update
+func (s *deviceState) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lost = true
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// clearResult forgets the outcome of earlier installations before a new image is sent
+func (s *deviceState) clearResult() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcome = ""
+}
+
+// checkDeviceReady waits briefly for the device's current status and fails with a
+// "device busy" error if an update is in progress. With -wait-idle it waits for the
+// device to become idle instead. An idle SWUpdate may not report any status, so
+// silence during the -status-wait window counts as ready.
+func (c *SWUpdateClient) checkDeviceReady(ctx context.Context) error {
+	if c.config.StatusWait <= 0 || c.wsConn == nil {
+		return nil
+	}
+
+	status, updated := c.state.current()
+	if status == "" {
+		timer := time.NewTimer(c.config.StatusWait)
+		select {
+		case <-updated:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+		status, updated = c.state.current()
+	}
+
+	if !busyStatuses[status] {
+		c.logMessage("readiness", "INFO", fmt.Sprintf("Device is ready (%s)", describeStatus(status)))
+		return nil
+	}
+
+	if c.config.WaitIdle <= 0 {
+		return fmt.Errorf("device busy: an update is already in progress (status: %s)", status)
+	}
+
+	c.logMessage("readiness", "WARN", fmt.Sprintf("Device is busy (status: %s), waiting up to %s for it to become idle", status, c.config.WaitIdle))
+	timer := time.NewTimer(c.config.WaitIdle)
+	defer timer.Stop()
+	for busyStatuses[status] {
+		select {
+		case <-updated:
+			status, updated = c.state.current()
+		case <-timer.C:
+			return fmt.Errorf("device busy: still in status %s after waiting %s", status, c.config.WaitIdle)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	c.logMessage("readiness", "INFO", fmt.Sprintf("Device is ready (status: %s)", status))
+	return nil
+}
+
+func describeStatus(status string) string {
+	if status == "" {
+		return "no status reported"
+	}
+	return "status: " + status
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// statusDevice is a test device that sends status events on WebSocket connect and counts uploads
+type statusDevice struct {
+	server  *httptest.Server
+	uploads int32
+}
+
+func newStatusDevice(t *testing.T, events []SWUpdateEvent, interval time.Duration) *statusDevice {
+	t.Helper()
+
+	dev := &statusDevice{}
+	upgrader := websocket.Upgrader{}
+	dev.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ws":
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for _, event := range events {
+				time.Sleep(interval)
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		case "/upload":
+			atomic.AddInt32(&dev.uploads, 1)
+		}
+	}))
+	t.Cleanup(dev.server.Close)
+	return dev
+}
+
+func TestUpdate_DeviceReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		events     []SWUpdateEvent
+		waitIdle   time.Duration
+		wantErr    string
+		wantUpload bool
+	}{
+		{
+			name:       "silent device is ready",
+			wantUpload: true,
+		},
+		{
+			name:       "idle device",
+			events:     []SWUpdateEvent{{Type: "status", Status: "IDLE"}},
+			wantUpload: true,
+		},
+		{
+			name:    "running update",
+			events:  []SWUpdateEvent{{Type: "status", Status: "RUN"}},
+			wantErr: "device busy",
+		},
+		{
+			name:    "progress implies busy",
+			events:  []SWUpdateEvent{{Type: "step", Name: "rootfs", Percent: "40"}},
+			wantErr: "device busy",
+		},
+		{
+			name: "wait until idle",
+			events: []SWUpdateEvent{
+				{Type: "status", Status: "RUN"},
+				{Type: "status", Status: "SUCCESS"},
+				{Type: "status", Status: "IDLE"},
+			},
+			waitIdle:   5 * time.Second,
+			wantUpload: true,
+		},
+		{
+			name:     "wait times out",
+			events:   []SWUpdateEvent{{Type: "status", Status: "START"}},
+			waitIdle: 200 * time.Millisecond,
+			wantErr:  "still in status START",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := newStatusDevice(t, tt.events, 50*time.Millisecond)
+			client := NewSWUpdateClient(Config{
+				Target:     dev.server.URL,
+				Filename:   writeTestFile(t, "image.swu", []byte("firmware")),
+				StatusWait: 300 * time.Millisecond,
+				WaitIdle:   tt.waitIdle,
+				Timeout:    10 * time.Second,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := client.Update(ctx, false)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			if uploaded := atomic.LoadInt32(&dev.uploads) > 0; uploaded != tt.wantUpload {
+				t.Errorf("Uploaded = %v, want %v", uploaded, tt.wantUpload)
+			}
+		})
+	}
+}
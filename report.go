@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases recorded in run reports, in the order they run
+var reportPhases = []struct {
+	name  string
+	stage string
+}{
+	{"preflight", stageConnecting},
+	{"upload", stageUploading},
+	{"install", stageInstalling},
+	{"restart", stageRebooting},
+	{"verification", stageVerifying},
+}
+
+// phaseRecord is the outcome of one phase of a device's update
+type phaseRecord struct {
+	Name     string
+	Started  time.Time
+	Duration time.Duration
+	Failure  string   // Why the phase failed, empty if it passed
+	Errors   []string // ERROR messages logged during the phase
+}
+
+// updateReport records the phases of a device's update for -report and -report-markdown
+type updateReport struct {
+	mu       sync.Mutex
+	started  time.Time
+	finished time.Time
+	phases   []*phaseRecord
+	result   string // passed, failed or cancelled
+}
+
+// begin closes the current phase and starts the one of stage
+func (r *updateReport) begin(stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, phase := range reportPhases {
+		if phase.stage != stage {
+			continue
+		}
+		now := time.Now()
+		if r.started.IsZero() {
+			r.started = now
+		}
+		r.closePhase(now)
+		r.phases = append(r.phases, &phaseRecord{Name: phase.name, Started: now})
+		return
+	}
+}
+
+// closePhase sets the duration of the current phase
+func (r *updateReport) closePhase(now time.Time) {
+	if current := r.current(); current != nil && current.Duration == 0 {
+		current.Duration = now.Sub(current.Started)
+	}
+}
+
+// current returns the phase in progress, nil before the first
+func (r *updateReport) current() *phaseRecord {
+	if len(r.phases) == 0 {
+		return nil
+	}
+	return r.phases[len(r.phases)-1]
+}
+
+// noteError records an ERROR message in the current phase
+func (r *updateReport) noteError(message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current := r.current(); current != nil {
+		current.Errors = append(current.Errors, message)
+	}
+}
+
+// failPhase marks the current phase as failed without ending the update
+func (r *updateReport) failPhase(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current := r.current(); current != nil && current.Failure == "" {
+		current.Failure = err.Error()
+	}
+}
+
+// finish records the result of the update; a failure is attributed to the phase in progress
+func (r *updateReport) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.finished = time.Now()
+	if r.started.IsZero() {
+		r.started = r.finished
+	}
+	r.closePhase(r.finished)
+
+	r.result = "passed"
+	switch {
+	case errors.Is(err, errCancelled):
+		r.result = "cancelled"
+	case err != nil:
+		r.result = "failed"
+	}
+	if err != nil {
+		if current := r.current(); current != nil {
+			current.Failure = err.Error()
+		}
+	}
+	for _, phase := range r.phases {
+		if phase.Failure != "" && r.result == "passed" {
+			r.result = "failed"
+		}
+	}
+}
+
+// snapshot returns the recorded phases, the names of the phases that did not run, the result and the duration
+func (r *updateReport) snapshot() (phases []phaseRecord, skipped []string, result string, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ran := make(map[string]bool)
+	for _, phase := range r.phases {
+		phases = append(phases, *phase)
+		ran[phase.Name] = true
+	}
+	for _, phase := range reportPhases {
+		if !ran[phase.name] {
+			skipped = append(skipped, phase.name)
+		}
+	}
+	return phases, skipped, r.result, r.finished.Sub(r.started)
+}
+
+// JUnit XML report format
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitSeconds formats a duration as JUnit's decimal seconds
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// junitReport builds a JUnit report with one test suite per device and one test case per phase
+func junitReport(clients []*SWUpdateClient) junitTestSuites {
+	report := junitTestSuites{Name: "swupdate-client"}
+	var total time.Duration
+	for _, client := range clients {
+		phases, skipped, _, duration := client.report.snapshot()
+		device := client.deviceName()
+		suite := junitTestSuite{Name: device, Time: junitSeconds(duration)}
+		if len(phases) > 0 {
+			suite.Timestamp = phases[0].Started.UTC().Format("2006-01-02T15:04:05")
+		}
+
+		// Device messages may arrive before the phase they belong to has started, so a failure
+		// lists all ERROR messages logged up to it
+		var errorLog []string
+		for _, phase := range phases {
+			errorLog = append(errorLog, phase.Errors...)
+			testCase := junitTestCase{Name: phase.Name, ClassName: device, Time: junitSeconds(phase.Duration)}
+			if phase.Failure != "" {
+				testCase.Failure = &junitMessage{Message: phase.Failure, Text: strings.Join(errorLog, "\n")}
+				suite.Failures++
+			} else if len(phase.Errors) > 0 {
+				testCase.SystemErr = strings.Join(phase.Errors, "\n")
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		for _, name := range skipped {
+			suite.Cases = append(suite.Cases, junitTestCase{Name: name, ClassName: device, Time: junitSeconds(0), Skipped: &junitMessage{Message: "not run"}})
+			suite.Skipped++
+		}
+		suite.Tests = len(suite.Cases)
+
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Skipped += suite.Skipped
+		total = max(total, duration)
+		report.Suites = append(report.Suites, suite)
+	}
+	report.Time = junitSeconds(total)
+	return report
+}
+
+// writeJUnitReport writes the JUnit XML report of the run to path
+func writeJUnitReport(path string, clients []*SWUpdateClient) error {
+	data, err := xml.MarshalIndent(junitReport(clients), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JUnit report: %w", err)
+	}
+	data = append([]byte(xml.Header), append(data, '\n')...)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+	return nil
+}
+
+// markdownReport renders a Markdown summary of the run with a table per device
+func markdownReport(clients []*SWUpdateClient) string {
+	var b strings.Builder
+	b.WriteString("# Firmware Update Report\n\n")
+	b.WriteString("| Device | Result | Duration | Failed phase |\n")
+	b.WriteString("|--------|--------|----------|--------------|\n")
+	for _, client := range clients {
+		phases, _, result, duration := client.report.snapshot()
+		failed := ""
+		for _, phase := range phases {
+			if phase.Failure != "" {
+				failed = phase.Name
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", markdownCell(client.deviceName()), result, duration.Round(time.Millisecond), failed)
+	}
+
+	for _, client := range clients {
+		phases, skipped, _, _ := client.report.snapshot()
+		fmt.Fprintf(&b, "\n## %s\n\n", client.deviceName())
+		b.WriteString("| Phase | Result | Duration | Details |\n")
+		b.WriteString("|-------|--------|----------|---------|\n")
+		for _, phase := range phases {
+			result, details := "passed", strings.Join(phase.Errors, "; ")
+			if phase.Failure != "" {
+				result, details = "failed", phase.Failure
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", phase.Name, result, phase.Duration.Round(time.Millisecond), markdownCell(details))
+		}
+		for _, name := range skipped {
+			fmt.Fprintf(&b, "| %s | skipped | | |\n", name)
+		}
+	}
+	return b.String()
+}
+
+// markdownCell escapes text for a Markdown table cell
+func markdownCell(text string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ").Replace(text)
+}
+
+// writeMarkdownReport writes the Markdown summary of the run to path
+func writeMarkdownReport(path string, clients []*SWUpdateClient) error {
+	if err := os.WriteFile(path, []byte(markdownReport(clients)), 0o644); err != nil {
+		return fmt.Errorf("failed to write Markdown report: %w", err)
+	}
+	return nil
+}
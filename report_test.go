@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport_FailedInstall(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{
+		{Type: "message", Level: "ERROR", Text: "rootfs: checksum mismatch"},
+		{Type: "status", Status: "FAILURE"},
+	}
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second}, 64<<10)
+
+	var code int
+	captureStdout(t, func() { code = runUpdate(context.Background(), client, true) })
+	if code != 1 {
+		t.Fatalf("runUpdate() = %d, want 1", code)
+	}
+
+	report := junitReport([]*SWUpdateClient{client})
+	if report.Tests != 5 || report.Failures != 1 || report.Skipped != 2 || len(report.Suites) != 1 {
+		t.Fatalf("Unexpected totals: %d tests, %d failures, %d skipped, %d suites", report.Tests, report.Failures, report.Skipped, len(report.Suites))
+	}
+
+	cases := report.Suites[0].Cases
+	names := []string{}
+	for _, testCase := range cases {
+		names = append(names, testCase.Name)
+	}
+	if got := strings.Join(names, ","); got != "preflight,upload,install,restart,verification" {
+		t.Errorf("Test cases %s, want preflight,upload,install,restart,verification", got)
+	}
+
+	install := cases[2]
+	if install.Failure == nil || !strings.Contains(install.Failure.Message, "installation failed") {
+		t.Fatalf("Expected the install phase to fail, got %+v", install)
+	}
+	if !strings.Contains(install.Failure.Text, "rootfs: checksum mismatch") {
+		t.Errorf("Failure %q does not include the device's ERROR messages", install.Failure.Text)
+	}
+	if cases[0].Failure != nil || cases[1].Failure != nil || cases[3].Skipped == nil {
+		t.Errorf("Expected preflight and upload to pass and restart to be skipped: %+v", cases)
+	}
+
+	markdown := markdownReport([]*SWUpdateClient{client})
+	for _, want := range []string{"| failed |", "| install | failed |", "installation failed", "| restart | skipped |"} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("Markdown report does not contain %q:\n%s", want, markdown)
+		}
+	}
+}
+
+func TestWriteJUnitReport_DeviceSuites(t *testing.T) {
+	clients := newDeviceClients(Config{}, []string{"http://10.0.0.1", "http://10.0.0.2"}, nil)
+	for _, client := range clients {
+		client.enterStage(stageConnecting)
+		client.enterStage(stageUploading)
+		client.report.finish(nil)
+	}
+
+	path := filepath.Join(t.TempDir(), "junit.xml")
+	if err := writeJUnitReport(path, clients); err != nil {
+		t.Fatalf("writeJUnitReport() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+
+	var report junitTestSuites
+	if err := xml.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Report is not valid XML: %v\n%s", err, data)
+	}
+	if len(report.Suites) != 2 || report.Suites[0].Name != "http://10.0.0.1" || report.Suites[1].Name != "http://10.0.0.2" {
+		t.Errorf("Expected a suite per device, got %+v", report.Suites)
+	}
+	if report.Tests != 10 || report.Failures != 0 || report.Skipped != 6 {
+		t.Errorf("Unexpected totals: %d tests, %d failures, %d skipped", report.Tests, report.Failures, report.Skipped)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of session file entries
+const (
+	sessionConfig   = "config"   // The effective configuration, secrets redacted
+	sessionArtifact = "artifact" // The uploaded image: name, size, SHA-256 and sw-description
+	sessionFrame    = "frame"    // A raw WebSocket frame received from the device
+	sessionHTTP     = "http"     // Metadata of an HTTP request to the device
+	sessionRecord   = "record"   // A message of the client
+	sessionOutcome  = "outcome"  // The result of the update
+)
+
+// sessionEntry is one line of a session file
+type sessionEntry struct {
+	Time     time.Time       `json:"time"`
+	Kind     string          `json:"kind"`
+	Phase    string          `json:"phase,omitempty"`
+	Config   *Config         `json:"config,omitempty"`
+	Artifact *sessionImage   `json:"artifact,omitempty"`
+	Frame    json.RawMessage `json:"frame,omitempty"`
+	HTTP     *sessionRequest `json:"http,omitempty"`
+	Record   *LogMessage     `json:"record,omitempty"`
+	Outcome  *sessionResult  `json:"outcome,omitempty"`
+}
+
+// sessionImage describes the uploaded image
+type sessionImage struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`   // Digest of the bytes sent, empty if the upload did not complete
+	Version  string `json:"version,omitempty"`  // Version declared in sw-description
+	Manifest string `json:"manifest,omitempty"` // sw-description of the image
+}
+
+// sessionRequest is the metadata of an HTTP request and its response
+type sessionRequest struct {
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	Status          int               `json:"status,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	Duration        string            `json:"duration"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// sessionResult is the outcome of the update
+type sessionResult struct {
+	Result string `json:"result"` // passed, failed or cancelled
+	Error  string `json:"error,omitempty"`
+}
+
+// sessionLog writes the session file of one device's update
+type sessionLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// unsafeFileChars are replaced in device labels used in session file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// openSession creates a timestamped session file in -session-dir and records the configuration
+func (c *SWUpdateClient) openSession() (*sessionLog, error) {
+	name := "session-" + time.Now().UTC().Format("20060102T150405.000Z")
+	if c.config.DeviceLabel != "" {
+		name += "-" + strings.Trim(unsafeFileChars.ReplaceAllString(c.config.DeviceLabel, "_"), "_")
+	}
+	path := filepath.Join(c.config.SessionDir, name+".jsonl")
+
+	if err := os.MkdirAll(c.config.SessionDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session file: %w", err)
+	}
+
+	s := &sessionLog{path: path, file: file, writer: bufio.NewWriter(file)}
+	config := redactConfig(c.config)
+	s.write(sessionEntry{Kind: sessionConfig, Config: &config})
+	return s, nil
+}
+
+// redactConfig returns a copy of config that is safe to store. Webhook URLs and commands often
+// embed credentials in their path or arguments, so they are redacted entirely. The webhook
+// template is only recorded by its file name.
+func redactConfig(config Config) Config {
+	if config.Token != "" {
+		config.Token = "<redacted>"
+	}
+	if config.TokenCommand != "" {
+		config.TokenCommand = "<redacted>"
+	}
+	config.Target = redactURL(config.Target)
+	config.IPAddress = redactURL(config.IPAddress)
+	config.Filename = redactURL(config.Filename)
+	config.DeviceVersionURL = redactURL(config.DeviceVersionURL)
+	config.S3Endpoint = redactURL(config.S3Endpoint)
+	config.TraceEndpoint = redactURL(config.TraceEndpoint)
+	config.Syslog = redactURL(config.Syslog)
+	config.Webhooks = redactAll(config.Webhooks)
+	config.HookCommands = redactAll(config.HookCommands)
+
+	headers := make([]string, 0, len(config.Headers))
+	for _, header := range config.Headers {
+		name, value, err := parseHeader(header)
+		if err != nil {
+			continue
+		}
+		headers = append(headers, name+": "+redactHeader(name, value))
+	}
+	config.Headers = headers
+	return config
+}
+
+// redactAll replaces every value with a placeholder, keeping their number
+func redactAll(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	redacted := make([]string, len(values))
+	for i := range redacted {
+		redacted[i] = "<redacted>"
+	}
+	return redacted
+}
+
+// write appends an entry to the session file
+func (s *sessionLog) write(entry sessionEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil {
+		return
+	}
+	s.writer.Write(append(data, '\n'))
+}
+
+// updateOutcome returns the outcome of an update that ended with err
+func updateOutcome(err error) sessionResult {
+	switch {
+	case err == nil:
+		return sessionResult{Result: "passed"}
+	case errors.Is(err, errCancelled):
+		return sessionResult{Result: "cancelled", Error: err.Error()}
+	default:
+		return sessionResult{Result: "failed", Error: err.Error()}
+	}
+}
+
+// close records the outcome of the update and closes the file
+func (s *sessionLog) close(err error) error {
+	result := updateOutcome(err)
+	s.write(sessionEntry{Kind: sessionOutcome, Outcome: &result})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flushErr := s.writer.Flush()
+	s.writer = nil
+	if closeErr := s.file.Close(); flushErr == nil {
+		flushErr = closeErr
+	}
+	if flushErr != nil {
+		return fmt.Errorf("failed to write session file: %w", flushErr)
+	}
+	return nil
+}
+
+// artifact records the uploaded image
+func (s *sessionLog) artifact(image sessionImage) {
+	s.write(sessionEntry{Kind: sessionArtifact, Artifact: &image})
+}
+
+// sessionTransport records the metadata of every request it sends in the session file
+type sessionTransport struct {
+	base    http.RoundTripper
+	session *sessionLog
+	stage   func() string
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	entry := &sessionRequest{
+		Method:         req.Method,
+		URL:            redactURL(req.URL.String()),
+		RequestHeaders: redactHeaders(req.Header),
+		Duration:       time.Since(start).String(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Status = resp.StatusCode
+		entry.ResponseHeaders = redactHeaders(resp.Header)
+	}
+	t.session.write(sessionEntry{Kind: sessionHTTP, Phase: t.stage(), HTTP: entry})
+	return resp, err
+}
+
+// runReplay re-renders a session file through the text or JSON printers and returns the exit code
+func runReplay(path string, config Config) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to open session file: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	var client *SWUpdateClient
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry sessionEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s:%d: invalid session entry: %v\n", path, line, err)
+			return 1
+		}
+
+		if client == nil {
+			replayConfig := config
+			if entry.Config != nil {
+				replayConfig.Target = entry.Config.Target
+				replayConfig.IPAddress, replayConfig.Port = entry.Config.IPAddress, entry.Config.Port
+				replayConfig.TLS, replayConfig.BasePath = entry.Config.TLS, entry.Config.BasePath
+				replayConfig.DeviceLabel = entry.Config.DeviceLabel
+			}
+			client = NewSWUpdateClient(replayConfig)
+		}
+		if err := client.replayEntry(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s:%d: invalid session entry: %v\n", path, line, err)
+			return 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to read session file: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// replayEntry prints a session entry as it was shown during the update
+func (c *SWUpdateClient) replayEntry(entry sessionEntry) error {
+	if err := entry.validate(); err != nil {
+		return err
+	}
+	switch entry.Kind {
+	case sessionConfig:
+		c.replayLine(entry, "session", "INFO", fmt.Sprintf("Session of %s recorded at %s", c.deviceName(), entry.Time.Format(time.RFC3339)), nil)
+	case sessionArtifact:
+		image := entry.Artifact
+		c.replayLine(entry, "artifact", "INFO", fmt.Sprintf("Image %s (%s), SHA-256 %s", image.Name, formatSize(image.Size), image.SHA256), map[string]interface{}{
+			"name": image.Name, "size": image.Size, "sha256": image.SHA256,
+		})
+	case sessionFrame:
+		var event SWUpdateEvent
+		if err := json.Unmarshal(entry.Frame, &event); err != nil {
+			return nil
+		}
+		record := c.newRecord(originDevice, event.Type, deviceEventLevel(event), event.Text, deviceEventData(event))
+		if !c.config.JSONOutput {
+			var ok bool
+			if record, ok = c.deviceTextRecord(event); !ok {
+				return nil
+			}
+		}
+		record.Time, record.Phase = entry.Time, entry.Phase
+		c.printRecord(record)
+	case sessionHTTP:
+		request := entry.HTTP
+		result := request.Error
+		if result == "" {
+			result = fmt.Sprintf("%d", request.Status)
+		}
+		c.replayLine(entry, "http", "DEBUG", fmt.Sprintf("%s %s: %s (%s)", request.Method, request.URL, result, request.Duration), map[string]interface{}{
+			"method": request.Method, "url": request.URL, "status": request.Status, "duration": request.Duration, "error": request.Error,
+		})
+	case sessionRecord:
+		c.printRecord(*entry.Record)
+	case sessionOutcome:
+		message := "Outcome: " + entry.Outcome.Result
+		if entry.Outcome.Error != "" {
+			message += ": " + entry.Outcome.Error
+		}
+		c.replayLine(entry, "outcome", "INFO", message, map[string]interface{}{"result": entry.Outcome.Result, "error": entry.Outcome.Error})
+	}
+	return nil
+}
+
+// validate checks that an entry carries the payload of its kind
+func (entry sessionEntry) validate() error {
+	var missing bool
+	switch entry.Kind {
+	case sessionArtifact:
+		missing = entry.Artifact == nil
+	case sessionFrame:
+		missing = len(entry.Frame) == 0
+	case sessionHTTP:
+		missing = entry.HTTP == nil
+	case sessionRecord:
+		missing = entry.Record == nil
+	case sessionOutcome:
+		missing = entry.Outcome == nil
+	}
+	if missing {
+		return fmt.Errorf("%s entry has no %q field", entry.Kind, entry.Kind)
+	}
+	return nil
+}
+
+// replayLine prints a replayed session entry that has no record of its own
+func (c *SWUpdateClient) replayLine(entry sessionEntry, msgType, level, message string, data map[string]interface{}) {
+	record := c.newRecord(originClient, msgType, level, message, data)
+	record.Time, record.Phase = entry.Time, entry.Phase
+	if !c.shouldPrint(record) {
+		return
+	}
+	if c.config.JSONOutput {
+		printJSONRecord(record)
+		return
+	}
+	c.printLine(message)
+}
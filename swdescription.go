@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// swDescriptionName is the name of the first entry of every .swu image
+const swDescriptionName = "sw-description"
+
+// swDescriptionSigName is the entry following sw-description in signed images
+const swDescriptionSigName = "sw-description.sig"
+
+// maxSWDescriptionSize bounds how much of a stream is buffered while looking for sw-description
+const maxSWDescriptionSize = 1 << 20
+
+// maxSignatureSize bounds the sw-description.sig entry
+const maxSignatureSize = 64 << 10
+
+// cpioHeaderSize is the size of a "newc" (070701) or "crc" (070702) cpio header
+const cpioHeaderSize = 110
+
+// swDescription is the parsed sw-description of a .swu image
+type swDescription struct {
+	Raw       []byte                 // Original file contents
+	Settings  map[string]interface{} // Parsed libconfig or JSON settings
+	Signed    bool                   // The image has a sw-description.sig entry
+	Signature []byte                 // Contents of sw-description.sig
+}
+
+// software returns the top-level "software" group
+func (d *swDescription) software() map[string]interface{} {
+	group, _ := d.Settings["software"].(map[string]interface{})
+	return group
+}
+
+// version returns the version declared by the image, empty if it declares none
+func (d *swDescription) version() string {
+	version, ok := d.software()["version"]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(version)
+}
+
+// hardwareCompatibility returns the hardware revisions accepted by the image: those of the
+// software.<board> section if a board is given and the image has one, otherwise those of software.
+// Without a board, an image declaring them in a single section only uses that section. The second
+// result is false if the image declares none. It is an error if the image declares them only for
+// other boards, or in several sections when no board is given.
+func (d *swDescription) hardwareCompatibility(board string) ([]string, bool, error) {
+	software := d.software()
+	if software == nil {
+		return nil, false, nil
+	}
+
+	if board != "" {
+		if section, ok := software[board].(map[string]interface{}); ok {
+			if revisions, ok := section["hardware-compatibility"]; ok {
+				return stringList(revisions), true, nil
+			}
+		}
+	}
+	if revisions, ok := software["hardware-compatibility"]; ok {
+		return stringList(revisions), true, nil
+	}
+
+	sections := make(map[string]interface{})
+	findSettings(software, "hardware-compatibility", "", sections)
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch {
+	case len(names) == 0:
+		return nil, false, nil
+	case board != "":
+		return nil, false, fmt.Errorf("image declares hardware compatibility only for %s, not for board %s", strings.Join(names, ", "), board)
+	case len(names) > 1:
+		return nil, false, fmt.Errorf("image declares hardware compatibility for several sections (%s), give -hw-revision as \"board revision\"", strings.Join(names, ", "))
+	}
+	return stringList(sections[names[0]]), true, nil
+}
+
+// findSettings collects a setting from all subgroups of a group, keyed by the dotted path of the subgroup
+func findSettings(group map[string]interface{}, name, path string, found map[string]interface{}) {
+	for key, value := range group {
+		sub, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		subPath := key
+		if path != "" {
+			subPath = path + "." + key
+		}
+		if setting, ok := sub[name]; ok {
+			found[subPath] = setting
+		}
+		findSettings(sub, name, subPath, found)
+	}
+}
+
+// stringList converts a list or scalar setting to strings
+func stringList(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		out = append(out, fmt.Sprint(item))
+	}
+	return out
+}
+
+// peekSWDescription reads sw-description and its signature from the start of the firmware stream
+// and puts the consumed bytes back, so the source can still be uploaded unchanged
+func peekSWDescription(source *firmwareSource) (*swDescription, error) {
+	var consumed bytes.Buffer
+	r := io.TeeReader(io.LimitReader(source.Reader, maxSWDescriptionSize+maxSignatureSize), &consumed)
+	raw, err := readSWDescription(r)
+	var signature []byte
+	signed := false
+	if err == nil {
+		signature, signed = readSignature(r)
+	}
+
+	source.Reader = &multiReadCloser{
+		Reader: io.MultiReader(&consumed, source.Reader),
+		Closer: source.Reader,
+	}
+	if err != nil {
+		return nil, err
+	}
+	desc, err := parseSWDescription(raw)
+	if err != nil {
+		return nil, err
+	}
+	desc.Signed, desc.Signature = signed, signature
+	return desc, nil
+}
+
+// multiReadCloser reads from a replacement reader but closes the original source
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readSWDescription reads the sw-description entry at the start of a .swu cpio archive
+func readSWDescription(r io.Reader) ([]byte, error) {
+	name, data, err := readCPIOEntry(r, maxSWDescriptionSize)
+	if err != nil {
+		return nil, err
+	}
+	if name != swDescriptionName {
+		return nil, fmt.Errorf("first entry of the image is %q, expected %s", name, swDescriptionName)
+	}
+	return data, nil
+}
+
+// readSignature reads the sw-description.sig entry that follows sw-description in signed images.
+// It reports false if the next entry is something else or cannot be read.
+func readSignature(r io.Reader) ([]byte, bool) {
+	name, data, err := readCPIOEntry(r, maxSignatureSize)
+	if err != nil || name != swDescriptionSigName {
+		return nil, false
+	}
+	return data, true
+}
+
+// readCPIOEntry reads the next entry of a cpio archive, including the padding after its data
+func readCPIOEntry(r io.Reader, maxSize uint64) (string, []byte, error) {
+	header := make([]byte, cpioHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, fmt.Errorf("failed to read cpio header: %w", err)
+	}
+	if magic := string(header[:6]); magic != "070701" && magic != "070702" {
+		return "", nil, fmt.Errorf("not a .swu image: unsupported cpio magic %q", magic)
+	}
+
+	fileSize, err := strconv.ParseUint(string(header[54:62]), 16, 32)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid cpio header: %w", err)
+	}
+	nameSize, err := strconv.ParseUint(string(header[94:102]), 16, 32)
+	if err != nil || nameSize == 0 {
+		return "", nil, fmt.Errorf("invalid cpio header: bad name size")
+	}
+
+	// The name is NUL terminated and padded so that header and name end on a 4-byte boundary
+	nameLen := int(nameSize) + pad4(cpioHeaderSize+int(nameSize))
+	nameBuf := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, nameBuf); err != nil {
+		return "", nil, fmt.Errorf("failed to read cpio entry name: %w", err)
+	}
+	name := string(bytes.TrimRight(nameBuf[:nameSize], "\x00"))
+	if fileSize > maxSize {
+		return "", nil, fmt.Errorf("%s is too large (%d bytes)", name, fileSize)
+	}
+
+	data := make([]byte, fileSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	// The data is padded to a 4-byte boundary as well; the end of the archive may follow instead
+	_, _ = io.ReadFull(r, make([]byte, pad4(int(fileSize))))
+	return name, data, nil
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// parseSWDescription parses sw-description in libconfig or JSON syntax
+func parseSWDescription(raw []byte) (*swDescription, error) {
+	desc := &swDescription{Raw: raw}
+
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &desc.Settings); err != nil {
+			return nil, fmt.Errorf("invalid sw-description JSON: %w", err)
+		}
+		return desc, nil
+	}
+
+	p := &libconfigParser{r: bufio.NewReader(bytes.NewReader(raw)), line: 1}
+	settings, err := p.parseSettings(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sw-description: %w", err)
+	}
+	desc.Settings = settings
+	return desc, nil
+}
+
+// libconfigParser is a small recursive-descent parser for the libconfig syntax used by sw-description
+type libconfigParser struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (p *libconfigParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *libconfigParser) next() (rune, error) {
+	ch, _, err := p.r.ReadRune()
+	if ch == '\n' {
+		p.line++
+	}
+	return ch, err
+}
+
+func (p *libconfigParser) peek() rune {
+	ch, _, err := p.r.ReadRune()
+	if err != nil {
+		return 0
+	}
+	_ = p.r.UnreadRune()
+	return ch
+}
+
+// skipSpace skips whitespace and #, // and /* */ comments
+func (p *libconfigParser) skipSpace() {
+	for {
+		ch := p.peek()
+		switch {
+		case ch == 0:
+			return
+		case unicode.IsSpace(ch):
+			_, _ = p.next()
+		case ch == '#':
+			p.skipLine()
+		case ch == '/':
+			b, _ := p.r.Peek(2)
+			switch {
+			case len(b) == 2 && b[1] == '/':
+				p.skipLine()
+			case len(b) == 2 && b[1] == '*':
+				_, _ = p.next()
+				_, _ = p.next()
+				var prev rune
+				for {
+					c, err := p.next()
+					if err != nil || (prev == '*' && c == '/') {
+						break
+					}
+					prev = c
+				}
+			default:
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *libconfigParser) skipLine() {
+	for {
+		ch, err := p.next()
+		if err != nil || ch == '\n' {
+			return
+		}
+	}
+}
+
+// parseSettings parses "name = value;" settings until EOF (depth 0) or a closing brace
+func (p *libconfigParser) parseSettings(depth int) (map[string]interface{}, error) {
+	settings := make(map[string]interface{})
+	for {
+		p.skipSpace()
+		ch := p.peek()
+		if ch == 0 {
+			if depth > 0 {
+				return nil, p.errorf("unexpected end of input, missing '}'")
+			}
+			return settings, nil
+		}
+		if ch == '}' {
+			if depth == 0 {
+				return nil, p.errorf("unexpected '}'")
+			}
+			_, _ = p.next()
+			return settings, nil
+		}
+
+		name, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if sep, _ := p.next(); sep != '=' && sep != ':' {
+			return nil, p.errorf("expected '=' or ':' after %q", name)
+		}
+
+		value, err := p.parseValue(depth)
+		if err != nil {
+			return nil, err
+		}
+		settings[name] = value
+
+		p.skipSpace()
+		if ch := p.peek(); ch == ';' || ch == ',' {
+			_, _ = p.next()
+		}
+	}
+}
+
+func (p *libconfigParser) parseName() (string, error) {
+	if p.peek() == '"' {
+		return p.parseString()
+	}
+	var name strings.Builder
+	for {
+		ch := p.peek()
+		if !(unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_' || ch == '-' || ch == '*' || ch == '.') {
+			break
+		}
+		_, _ = p.next()
+		name.WriteRune(ch)
+	}
+	if name.Len() == 0 {
+		return "", p.errorf("expected setting name, got %q", p.peek())
+	}
+	return name.String(), nil
+}
+
+func (p *libconfigParser) parseValue(depth int) (interface{}, error) {
+	p.skipSpace()
+	switch ch := p.peek(); ch {
+	case '{':
+		_, _ = p.next()
+		return p.parseSettings(depth + 1)
+	case '[':
+		_, _ = p.next()
+		return p.parseList(']', depth)
+	case '(':
+		_, _ = p.next()
+		return p.parseList(')', depth)
+	case '"':
+		// Adjacent string literals are concatenated
+		var s strings.Builder
+		for p.peek() == '"' {
+			part, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			s.WriteString(part)
+			p.skipSpace()
+		}
+		return s.String(), nil
+	case 0:
+		return nil, p.errorf("unexpected end of input, expected a value")
+	}
+	return p.parseScalar()
+}
+
+func (p *libconfigParser) parseList(end rune, depth int) ([]interface{}, error) {
+	items := []interface{}{}
+	for {
+		p.skipSpace()
+		if p.peek() == end {
+			_, _ = p.next()
+			return items, nil
+		}
+		value, err := p.parseValue(depth)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+
+		p.skipSpace()
+		switch ch := p.peek(); ch {
+		case ',':
+			_, _ = p.next()
+		case end:
+		default:
+			return nil, p.errorf("expected ',' or %q in list, got %q", end, ch)
+		}
+	}
+}
+
+func (p *libconfigParser) parseString() (string, error) {
+	_, _ = p.next() // opening quote
+	var s strings.Builder
+	for {
+		ch, err := p.next()
+		if err != nil {
+			return "", p.errorf("unterminated string")
+		}
+		switch ch {
+		case '"':
+			return s.String(), nil
+		case '\\':
+			esc, err := p.next()
+			if err != nil {
+				return "", p.errorf("unterminated string")
+			}
+			switch esc {
+			case 'n':
+				s.WriteRune('\n')
+			case 't':
+				s.WriteRune('\t')
+			case 'r':
+				s.WriteRune('\r')
+			case 'f':
+				s.WriteRune('\f')
+			default:
+				s.WriteRune(esc)
+			}
+		default:
+			s.WriteRune(ch)
+		}
+	}
+}
+
+// parseScalar parses booleans, integers (including hex and L suffix) and floats
+func (p *libconfigParser) parseScalar() (interface{}, error) {
+	var token strings.Builder
+	for {
+		ch := p.peek()
+		if ch == 0 || unicode.IsSpace(ch) || strings.ContainsRune(";,)]}", ch) {
+			break
+		}
+		_, _ = p.next()
+		token.WriteRune(ch)
+	}
+	text := token.String()
+
+	switch strings.ToLower(text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	number := strings.TrimRight(text, "lL")
+	if n, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid value %q", text)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildSWU builds a minimal .swu (cpio newc) archive whose first entry is sw-description
+func buildSWU(description string, payload []byte) []byte {
+	return buildSWUEntries(description, nil, payload)
+}
+
+// buildSignedSWU builds a .swu archive with a sw-description.sig entry after sw-description
+func buildSignedSWU(description string, signature, payload []byte) []byte {
+	return buildSWUEntries(description, [][2]string{{swDescriptionSigName, string(signature)}}, payload)
+}
+
+func buildSWUEntries(description string, extra [][2]string, payload []byte) []byte {
+	var buf bytes.Buffer
+	writeEntry := func(name string, data []byte) {
+		fmt.Fprintf(&buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			1, 0100644, 0, 0, 1, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		buf.Write(make([]byte, pad4(cpioHeaderSize+len(name)+1)))
+		buf.Write(data)
+		buf.Write(make([]byte, pad4(len(data))))
+	}
+	writeEntry(swDescriptionName, []byte(description))
+	for _, entry := range extra {
+		writeEntry(entry[0], []byte(entry[1]))
+	}
+	writeEntry("rootfs.ext4", payload)
+	writeEntry("TRAILER!!!", nil)
+	return buf.Bytes()
+}
+
+const testSWDescription = `
+software =
+{
+	version = "2.1.0";
+	description = "Firmware " /* vendor */ "update";
+
+	hardware-compatibility: [ "1.0", "1.2", "#RE:^2\\.[0-9]+$" ];
+
+	myboard = {
+		hardware-compatibility = [ "3.0" ];
+		images: (
+			{
+				filename = "rootfs.ext4";
+				device = "/dev/mmcblk0p2";
+				installed-directly = true;
+				size = 0x100000;
+			}
+		);
+	};
+}
+# trailing comment
+`
+
+func TestParseSWDescription_Libconfig(t *testing.T) {
+	desc, err := parseSWDescription([]byte(testSWDescription))
+	if err != nil {
+		t.Fatalf("parseSWDescription() error = %v", err)
+	}
+
+	software := desc.software()
+	if software["version"] != "2.1.0" || software["description"] != "Firmware update" {
+		t.Errorf("Unexpected software settings: %v", software)
+	}
+
+	images := software["myboard"].(map[string]interface{})["images"].([]interface{})
+	image := images[0].(map[string]interface{})
+	if image["installed-directly"] != true || image["size"] != int64(0x100000) {
+		t.Errorf("Unexpected image settings: %v", image)
+	}
+}
+
+func TestParseSWDescription_JSON(t *testing.T) {
+	desc, err := parseSWDescription([]byte(`{"software": {"version": "1.0", "hardware-compatibility": ["rev-a"]}}`))
+	if err != nil {
+		t.Fatalf("parseSWDescription() error = %v", err)
+	}
+	if got, ok, err := desc.hardwareCompatibility(""); err != nil || !ok || !reflect.DeepEqual(got, []string{"rev-a"}) {
+		t.Errorf("hardwareCompatibility() = %v, %v, %v", got, ok, err)
+	}
+}
+
+func TestParseSWDescription_Invalid(t *testing.T) {
+	for _, input := range []string{"software = {", "software = { version = ; }", "= 1;"} {
+		if _, err := parseSWDescription([]byte(input)); err == nil {
+			t.Errorf("parseSWDescription(%q) expected error", input)
+		}
+	}
+}
+
+func TestHardwareCompatibility_BoardSection(t *testing.T) {
+	desc, err := parseSWDescription([]byte(testSWDescription))
+	if err != nil {
+		t.Fatalf("parseSWDescription() error = %v", err)
+	}
+
+	tests := []struct {
+		board string
+		want  []string
+	}{
+		{"", []string{"1.0", "1.2", `#RE:^2\.[0-9]+$`}},
+		{"myboard", []string{"3.0"}},
+		{"otherboard", []string{"1.0", "1.2", `#RE:^2\.[0-9]+$`}},
+	}
+	for _, tt := range tests {
+		if got, ok, err := desc.hardwareCompatibility(tt.board); err != nil || !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hardwareCompatibility(%q) = %v, %v, %v; want %v", tt.board, got, ok, err, tt.want)
+		}
+	}
+}
+
+func TestHardwareCompatibility_OnlyBoardSections(t *testing.T) {
+	desc, err := parseSWDescription([]byte(`{"software": {
+		"boardA": {"hardware-compatibility": ["1.0"], "stable": {"images": []}},
+		"boardB": {"hardware-compatibility": ["2.0"]}
+	}}`))
+	if err != nil {
+		t.Fatalf("parseSWDescription() error = %v", err)
+	}
+
+	if got, ok, err := desc.hardwareCompatibility("boardB"); err != nil || !ok || !reflect.DeepEqual(got, []string{"2.0"}) {
+		t.Errorf("hardwareCompatibility(boardB) = %v, %v, %v", got, ok, err)
+	}
+	// An image built for other boards must not pass as declaring no compatibility
+	if _, ok, err := desc.hardwareCompatibility("boardC"); ok || err == nil || !strings.Contains(err.Error(), "boardA, boardB") {
+		t.Errorf("hardwareCompatibility(boardC) = %v, %v; want an error naming the sections", ok, err)
+	}
+	// Without a board the result must not depend on the map order
+	for i := 0; i < 20; i++ {
+		if _, _, err := desc.hardwareCompatibility(""); err == nil || !strings.Contains(err.Error(), "several sections") {
+			t.Fatalf("hardwareCompatibility(\"\") error = %v, want several sections", err)
+		}
+	}
+
+	single, _ := parseSWDescription([]byte(`{"software": {"boardA": {"hardware-compatibility": ["1.0"]}}}`))
+	if got, ok, err := single.hardwareCompatibility(""); err != nil || !ok || !reflect.DeepEqual(got, []string{"1.0"}) {
+		t.Errorf("hardwareCompatibility() with a single section = %v, %v, %v", got, ok, err)
+	}
+}
+
+func TestPeekSWDescription_RestoresStream(t *testing.T) {
+	image := buildSWU(testSWDescription, bytes.Repeat([]byte{0xAB}, 4096))
+	source := &firmwareSource{Name: "fw.swu", Size: int64(len(image)), Reader: io.NopCloser(bytes.NewReader(image))}
+
+	desc, err := peekSWDescription(source)
+	if err != nil {
+		t.Fatalf("peekSWDescription() error = %v", err)
+	}
+	if desc.software()["version"] != "2.1.0" {
+		t.Errorf("Unexpected version %v", desc.software()["version"])
+	}
+
+	data, _ := io.ReadAll(source.Reader)
+	if !bytes.Equal(data, image) {
+		t.Errorf("Stream not restored: got %d bytes, want %d", len(data), len(image))
+	}
+}
+
+func TestPeekSWDescription_NotAnImage(t *testing.T) {
+	content := bytes.Repeat([]byte("not a cpio archive "), 10)
+	source := &firmwareSource{Name: "fw.swu", Reader: io.NopCloser(bytes.NewReader(content))}
+
+	if _, err := peekSWDescription(source); err == nil {
+		t.Fatal("Expected error for non-cpio input")
+	}
+	if data, _ := io.ReadAll(source.Reader); !bytes.Equal(data, content) {
+		t.Error("Stream not restored after failed peek")
+	}
+}
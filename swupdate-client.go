@@ -4,18 +4,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -31,17 +35,81 @@ var (
 
 // Config holds all configuration parameters for the SWUpdate client
 type Config struct {
-	IPAddress      string        // Target device IP address
+	IPAddress      string        // Target device host name, IP address or URL
+	Target         string        // Full device URL; takes precedence over IPAddress, Port, TLS and BasePath
+	BasePath       string        // Path prefix of the SWUpdate web server (e.g. behind a reverse proxy)
 	Port           int           // SWUpdate web server port
-	Filename       string        // Path to firmware file (.swu)
-	Timeout        time.Duration // Network operation timeout
-	Verbose        bool          // Enable detailed logging
+	Filename       string        // Path, "-" for stdin, or http(s)://, s3://, oci:// URL of the firmware file (.swu)
+	FileSHA256     string        // Expected SHA-256 of the firmware file, verified before upload
+	UploadName     string        // File name sent in the multipart upload instead of the source's name
+	CacheDir       string        // Content-addressed cache for downloaded firmware; empty disables caching
+	S3Endpoint     string        // Endpoint of the S3-compatible object store for s3:// URLs
+	S3Region       string        // Region used to sign s3:// requests
+	OCIMediaType   string        // Media type of the firmware layer in oci:// artifacts
+	OCIPlainHTTP   bool          // Access the OCI registry over plain HTTP
+	Timeout        time.Duration // Deadline for the whole run; 0 for no limit
+	Verbose        bool          // Enable detailed logging, the same as LogLevel debug
+	LogLevel       logLevel      // Lowest level of messages printed and sent to the log sinks
+	Quiet          bool          // Print only the final result of each update
+	StderrLevel    logLevel      // Lowest level of the diagnostics written to stderr by the log package
 	JSONOutput     bool          // Output structured JSON instead of human-readable text
 	TLS            bool          // Use HTTPS/WSS instead of HTTP/WS
 	InsecureTLS    bool          // Skip TLS certificate verification
 	CertFile       string        // Path to custom CA certificate file
 	ClientCertFile string        // Path to client certificate file
 	ClientKeyFile  string        // Path to client private key file
+	ClientP12File  string        // Path to PKCS#12 client identity bundle
+
+	KeyPassphraseFile string // File containing the passphrase for an encrypted client key or bundle
+	KeyPassphraseEnv  string // Environment variable holding the passphrase for an encrypted client key or bundle
+
+	Headers      []string      // Extra "Name: value" headers sent with every request
+	Token        string        // Static bearer token
+	TokenFile    string        // File containing the bearer token, re-read for every request
+	TokenCommand string        // Command printing the bearer token
+	TokenTTL     time.Duration // How long command tokens without an expiry are cached
+
+	HWRevision    string // Hardware revision of the device ("revision" or "board revision") checked against the image
+	PublicKeyFile string // PEM public key the image's sw-description.sig is verified with before upload
+	Force         bool   // Upload even if pre-flight checks fail
+	DryRun        bool   // Run all pre-flight steps and report the requests without sending the image or restart
+
+	DeviceVersion      string // Firmware version installed on the device
+	DeviceVersionURL   string // Endpoint (path below the base path or full URL) returning the installed version
+	DeviceVersionField string // Dotted JSON field holding the version in the endpoint's response
+	AllowDowngrade     bool   // Install images older than the installed version
+	Reinstall          bool   // Install images of the same version as the installed one
+
+	StatusWait time.Duration // How long to wait for the device's current status before uploading; 0 disables the check
+	WaitIdle   time.Duration // How long to wait for a busy device to become idle instead of failing
+
+	ConnectTimeout time.Duration // TCP connect, TLS handshake and WebSocket handshake
+	UploadTimeout  time.Duration // Whole upload until the device responds; 0 for no limit
+	StallTimeout   time.Duration // Window in which the upload must reach MinUploadRate; 0 disables stall detection
+	MinUploadRate  int64         // Minimum upload throughput in bytes per second before the upload counts as stalled
+	InstallTimeout time.Duration // Waiting for the installation result after the upload; 0 does not wait
+	RestartTimeout time.Duration // Restart request
+	RebootTimeout  time.Duration // Waiting for the device to come back after the restart; 0 does not wait
+
+	RateLimit   int64  // Upload bandwidth limit in bytes per second; 0 for no limit
+	DeviceLabel string // Identifies the device in output when several devices are updated
+	SessionDir  string // Directory for session files recording each update; empty disables them
+	HistoryFile string // Update history the outcome of each update is appended to; empty disables it
+	DeviceGroup string // Group the device is counted in by -metrics-listen
+
+	TraceFile     string // File each update's trace is appended to as OTLP JSON; empty disables it
+	TraceEndpoint string // OTLP/HTTP collector each update's trace is sent to; empty disables it
+
+	Webhooks        []string      // URLs lifecycle events are posted to
+	WebhookTemplate string        // File with a text/template for the webhook body; empty posts the event as JSON
+	HookCommands    []string      // Commands run on lifecycle events with the event in SWUPDATE_* variables
+	HookEvents      []string      // Comma-separated lifecycle events that trigger hooks; empty for all
+	HookTimeout     time.Duration // Timeout of each hook attempt
+	HookRetries     int           // Retries of a failed hook
+
+	Syslog         string // Syslog server records are also sent to: udp://, tcp:// or unix:// address
+	SyslogFacility string // Facility of syslog messages
+	JournalSocket  string // systemd journal socket records are also sent to; empty disables it
 }
 
 // SWUpdateEvent represents a WebSocket event from the SWUpdate server
@@ -57,24 +125,55 @@ type SWUpdateEvent struct {
 	Source  string `json:"source,omitempty"`  // Update source information
 }
 
-// LogMessage represents a structured log entry for JSON output mode
+// LogMessage is the envelope of every record in JSON output mode, see events.schema.json
 type LogMessage struct {
-	Type    string    `json:"type"`            // Message category
-	Level   string    `json:"level,omitempty"` // Log level
-	Message string    `json:"message"`         // Log message content
-	Time    time.Time `json:"time"`            // Timestamp
+	Schema  int                    `json:"schema"`            // Record format version
+	Time    time.Time              `json:"time"`              // Timestamp
+	Device  string                 `json:"device,omitempty"`  // Device the record is about
+	Phase   string                 `json:"phase,omitempty"`   // Stage of the update
+	Origin  string                 `json:"origin"`            // client or device
+	Type    string                 `json:"type"`              // Message category or WebSocket event type
+	Level   string                 `json:"level,omitempty"`   // Log level
+	Message string                 `json:"message,omitempty"` // Log message content
+	Data    map[string]interface{} `json:"data,omitempty"`    // Structured event details
 }
 
 // SWUpdateClient manages communication with an SWUpdate-enabled device
 type SWUpdateClient struct {
-	config Config          // Client configuration
-	wsConn *websocket.Conn // WebSocket connection for progress monitoring
+	config   Config          // Client configuration
+	wsConn   *websocket.Conn // WebSocket connection for progress monitoring
+	tokens   *tokenSource    // Bearer token source, nil if no token is configured
+	identity *clientIdentity // Client certificate, loaded once and shared with the other devices
+	cache    *artifactCache  // Downloads into -cache-dir, shared with the other devices
+	state    *deviceState    // Update status last reported by the device
+
+	upload     uploadProgress // Progress of the image upload, reported on cancellation
+	totalLimit *rateLimiter   // Aggregate upload limit shared with the other devices, nil for none
+	cancelled  atomic.Value   // os.Signal that interrupted the update
+	stage      atomic.Value   // Stage of the update, reported in JSON records and the dashboard
+	report     *updateReport  // Phases of the update for -report and -report-markdown
+	session    *sessionLog    // Session file of the update, nil unless -session-dir is set
+	image      sessionImage   // The uploaded image, collected for the session file and the history
+	metrics    *updateMetrics // Metrics shared with the other devices, nil unless -metrics-listen is set
+	trace      *updateTrace   // Trace of the update, nil unless -trace-file or -trace-endpoint is set
+	hooks      *hookRunner    // Lifecycle hooks shared with the other devices, nil if none are configured
+	sinks      *logSinks      // Syslog and journal sinks shared with the other devices, nil if none are configured
+
+	ui          *progressUI    // Terminal progress display, nil for plain lines
+	row         *deviceRow     // Dashboard row when several devices are shown full-screen
+	stepPercent map[string]int // Install progress last printed per image without a terminal
 }
 
 // NewSWUpdateClient creates a new client instance with the given configuration
 func NewSWUpdateClient(config Config) *SWUpdateClient {
+	defaultLogLevels(&config)
 	return &SWUpdateClient{
-		config: config,
+		config:   config,
+		tokens:   newTokenSource(config),
+		identity: &clientIdentity{},
+		cache:    &artifactCache{},
+		state:    newDeviceState(),
+		report:   &updateReport{},
 	}
 }
 
@@ -85,62 +184,100 @@ func (c *SWUpdateClient) createTLSConfig() (*tls.Config, error) {
 	}
 
 	// Load custom CA certificate if provided
-	if c.config.CertFile != "" {
-		caCert, err := os.ReadFile(c.config.CertFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read CA certificate file: %w", err)
-		}
-
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(caCert) {
-			return nil, fmt.Errorf("failed to parse CA certificate")
-		}
-		tlsConfig.RootCAs = caCertPool
+	caCertPool, err := c.loadCACertPool()
+	if err != nil {
+		return nil, err
 	}
+	tlsConfig.RootCAs = caCertPool
 
 	// Load client certificate and key if provided
-	if c.config.ClientCertFile != "" && c.config.ClientKeyFile != "" {
-		clientCert, err := tls.LoadX509KeyPair(c.config.ClientCertFile, c.config.ClientKeyFile)
+	clientCert, err := c.clientCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// httpClient creates an HTTP client for requests to the device, with TLS configuration for HTTPS targets
+func (c *SWUpdateClient) httpClient(target deviceTarget) (*http.Client, error) {
+	// Requests are bounded by the phase contexts; the transport only limits connection setup
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = c.dial
+	transport.TLSHandshakeTimeout = c.config.ConnectTimeout
+
+	if target.secure() {
+		tlsConfig, err := c.createTLSConfig()
 		if err != nil {
-			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			return nil, fmt.Errorf("failed to create TLS configuration: %w", err)
 		}
-		tlsConfig.Certificates = []tls.Certificate{clientCert}
+		transport.TLSClientConfig = tlsConfig
+		transport.DialTLSContext = c.dialTLS(tlsConfig)
+	}
+	if c.session != nil {
+		return &http.Client{Transport: &sessionTransport{base: transport, session: c.session, stage: c.currentStage}}, nil
 	}
+	return &http.Client{Transport: transport}, nil
+}
 
-	return tlsConfig, nil
+// loadCACertPool loads the custom CA certificate file, returning nil to use the system roots when none is configured
+func (c *SWUpdateClient) loadCACertPool() (*x509.CertPool, error) {
+	if c.config.CertFile == "" {
+		return nil, nil
+	}
+
+	caCert, err := os.ReadFile(c.config.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate file: %w", err)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to parse CA certificate")
+	}
+	return caCertPool, nil
 }
 
 // connectWebSocket establishes a WebSocket connection for real-time progress monitoring
 func (c *SWUpdateClient) connectWebSocket(ctx context.Context) error {
-	scheme := "ws"
-	if c.config.TLS {
-		scheme = "wss"
+	target, err := c.target()
+	if err != nil {
+		return err
 	}
+	wsURL := target.webSocketURL()
 
-	wsURL := url.URL{
-		Scheme: scheme,
-		Host:   fmt.Sprintf("%s:%d", c.config.IPAddress, c.config.Port),
-		Path:   "/ws",
-	}
+	c.logf(levelDebug, "Connecting to WebSocket: %s", wsURL)
 
-	if c.config.Verbose {
-		log.Printf("Connecting to WebSocket: %s", wsURL.String())
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		NetDialContext:   c.dial,
+		HandshakeTimeout: c.config.ConnectTimeout,
 	}
 
-	dialer := websocket.DefaultDialer
-	dialer.HandshakeTimeout = c.config.Timeout
-
 	// Configure TLS if enabled
-	if c.config.TLS {
+	if target.secure() {
 		tlsConfig, err := c.createTLSConfig()
 		if err != nil {
 			return fmt.Errorf("failed to create TLS configuration: %w", err)
 		}
 		dialer.TLSClientConfig = tlsConfig
+		dialer.NetDialTLSContext = c.dialTLS(tlsConfig)
 	}
 
-	conn, _, err := dialer.DialContext(ctx, wsURL.String(), nil)
+	header, err := c.requestHeaders(ctx)
 	if err != nil {
+		return err
+	}
+
+	conn, _, err := dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		var timeout *phaseTimeoutError
+		if !errors.As(err, &timeout) && isTimeout(err) && ctx.Err() == nil {
+			err = &phaseTimeoutError{Phase: phaseConnect, Timeout: c.config.ConnectTimeout, Detail: "WebSocket handshake"}
+		}
 		return fmt.Errorf("failed to connect to WebSocket: %w", err)
 	}
 
@@ -158,6 +295,7 @@ func (c *SWUpdateClient) listenWebSocket(ctx context.Context) {
 		if wsConn != nil {
 			wsConn.Close()
 		}
+		c.state.disconnect()
 	}()
 
 	for {
@@ -165,14 +303,23 @@ func (c *SWUpdateClient) listenWebSocket(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		default:
-			var event SWUpdateEvent
-			err := wsConn.ReadJSON(&event)
+			_, frame, err := wsConn.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("WebSocket error: %v", err)
+					c.logf(levelWarn, "WebSocket error: %v", err)
+					c.countMetric(metricWebSocketDrops, 1)
 				}
 				return
 			}
+			if c.session != nil {
+				c.session.write(sessionEntry{Kind: sessionFrame, Phase: c.currentStage(), Frame: frame})
+			}
+
+			var event SWUpdateEvent
+			if err := json.Unmarshal(frame, &event); err != nil {
+				c.logf(levelWarn, "Invalid WebSocket message: %v", err)
+				return
+			}
 
 			c.handleWebSocketEvent(event)
 		}
@@ -180,183 +327,237 @@ func (c *SWUpdateClient) listenWebSocket(ctx context.Context) {
 }
 
 func (c *SWUpdateClient) logMessage(msgType, level, message string) {
-	if c.config.JSONOutput {
-		logMsg := LogMessage{
-			Type:    msgType,
-			Level:   level,
-			Message: message,
-			Time:    time.Now(),
-		}
-		jsonData, _ := json.Marshal(logMsg)
-		fmt.Println(string(jsonData))
-	} else {
-		switch level {
-		case "ERROR":
-			fmt.Printf("Error: %s\n", message)
-		case "WARN":
-			fmt.Printf("Warning: %s\n", message)
-		case "INFO":
-			if c.config.Verbose || msgType == "status" || msgType == "progress" {
-				fmt.Println(message)
-			}
-		default:
-			fmt.Println(message)
-		}
+	c.logEvent(msgType, level, message, nil)
+}
+
+// logEvent logs a message with structured details, which are only included in JSON output
+func (c *SWUpdateClient) logEvent(msgType, level, message string, data map[string]interface{}) {
+	record := c.newRecord(originClient, msgType, level, message, data)
+	if c.session != nil {
+		c.session.write(sessionEntry{Kind: sessionRecord, Record: &record})
 	}
+	c.emitRecord(record)
 }
 
-func (c *SWUpdateClient) handleWebSocketEvent(event SWUpdateEvent) {
+// emitRecord notes errors in the report, sends the record to the log sinks and prints it
+func (c *SWUpdateClient) emitRecord(record LogMessage) {
+	if record.Level == "ERROR" {
+		c.report.noteError(record.Message)
+	}
+	c.sendToSinks(record)
+	c.printRecord(record)
+}
+
+// printRecord prints a record as JSON or as a line of text output, unless its level is filtered
+func (c *SWUpdateClient) printRecord(record LogMessage) {
+	if !c.shouldPrint(record) {
+		return
+	}
 	if c.config.JSONOutput {
-		jsonData, _ := json.Marshal(event)
-		fmt.Println(string(jsonData))
+		printJSONRecord(record)
 		return
 	}
-
-	switch event.Type {
-	case "status":
-		c.handleStatusEvent(event)
-	case "step":
-		c.handleStepEvent(event)
-	case "message":
-		c.handleMessageEvent(event)
-	case "info":
-		c.handleInfoEvent(event)
-	case "source":
-		c.handleSourceEvent(event)
+	switch record.Level {
+	case "ERROR":
+		c.printLine("Error: " + record.Message)
+	case "WARN":
+		c.printLine("Warning: " + record.Message)
 	default:
-		c.handleUnknownEvent(event)
+		c.printLine(record.Message)
 	}
 }
 
-func (c *SWUpdateClient) handleStatusEvent(event SWUpdateEvent) {
-	statusMessages := map[string]struct {
-		level   string
-		message string
-	}{
-		"START":   {"INFO", "Update started"},
-		"RUN":     {"INFO", "Update running"},
-		"SUCCESS": {"INFO", "Update completed successfully"},
-		"FAILURE": {"ERROR", "Update failed"},
-		"DONE":    {"INFO", "Update process finished"},
-		"IDLE":    {"INFO", "System idle"},
-	}
-
-	if msg, ok := statusMessages[event.Status]; ok {
-		if event.Status == "IDLE" && !c.config.Verbose {
-			return
-		}
-		c.logMessage("status", msg.level, msg.message)
-	} else {
-		c.logMessage("status", "INFO", fmt.Sprintf("Status: %s", event.Status))
+// printLine prints a line of text output, above the progress display if there is one, or adds
+// it to the device's dashboard log
+func (c *SWUpdateClient) printLine(line string) {
+	switch {
+	case c.row != nil && c.row.log(line):
+	case c.ui != nil:
+		c.ui.println(c.devicePrefix() + line)
+	default:
+		fmt.Println(c.devicePrefix() + line)
 	}
 }
 
-func (c *SWUpdateClient) handleStepEvent(event SWUpdateEvent) {
-	if event.Percent != "" && event.Name != "" {
-		c.logMessage("progress", "INFO", fmt.Sprintf("Installing %s: %s%%", event.Name, event.Percent))
-	} else if event.Step != "" && event.Number != "" {
-		c.logMessage("progress", "INFO", fmt.Sprintf("Step %s of %s", event.Step, event.Number))
-	}
-}
+func (c *SWUpdateClient) handleWebSocketEvent(event SWUpdateEvent) {
+	c.state.observe(event)
+	c.traceDeviceEvent(event)
 
-func (c *SWUpdateClient) handleMessageEvent(event SWUpdateEvent) {
-	switch event.Level {
-	case "ERROR":
-		c.logMessage("message", "ERROR", event.Text)
-	case "WARN":
-		c.logMessage("message", "WARN", event.Text)
-	default:
-		if c.config.Verbose && event.Text != "" {
-			c.logMessage("message", "INFO", event.Text)
+	if c.config.JSONOutput {
+		switch {
+		case event.Level == "ERROR":
+			c.report.noteError(event.Text)
+		case event.Type == "status" && event.Status == "FAILURE":
+			c.report.noteError("Update failed")
 		}
+		c.printDeviceEvent(event)
+		return
 	}
-}
 
-func (c *SWUpdateClient) handleInfoEvent(event SWUpdateEvent) {
-	if c.config.Verbose && event.Text != "" {
-		c.logMessage("info", "INFO", event.Text)
+	if event.Type == "step" {
+		if c.ui != nil {
+			c.ui.stepEvent(event)
+			return
+		}
+		if c.row != nil {
+			c.row.stepEvent(event)
+			return
+		}
+	}
+	// The session already holds the frame, so the text record is not written to it again
+	if record, ok := c.deviceTextRecord(event); ok {
+		c.emitRecord(record)
 	}
 }
 
-func (c *SWUpdateClient) handleSourceEvent(event SWUpdateEvent) {
-	if c.config.Verbose {
-		c.logMessage("source", "INFO", fmt.Sprintf("Update source: %s", event.Source))
-	}
+// deviceStatusMessages are the text shown for the statuses reported by the device
+var deviceStatusMessages = map[string]string{
+	"START":   "Update started",
+	"RUN":     "Update running",
+	"SUCCESS": "Update completed successfully",
+	"FAILURE": "Update failed",
+	"DONE":    "Update process finished",
+	"IDLE":    "System idle",
 }
 
-func (c *SWUpdateClient) handleUnknownEvent(event SWUpdateEvent) {
-	if c.config.Verbose {
-		c.logMessage("unknown", "INFO", fmt.Sprintf("Unknown event type: %s", event.Type))
+// deviceTextRecord returns the record the text output shows for a WebSocket event, or false if
+// it shows none. It has no side effects besides thinning out the step progress lines, so
+// replay renders frames through it as well.
+func (c *SWUpdateClient) deviceTextRecord(event SWUpdateEvent) (LogMessage, bool) {
+	level := deviceEventLevel(event)
+	var msgType, message string
+	switch event.Type {
+	case "status":
+		msgType = "status"
+		var ok bool
+		if message, ok = deviceStatusMessages[event.Status]; !ok {
+			message = fmt.Sprintf("Status: %s", event.Status)
+		}
+	case "step":
+		msgType = "progress"
+		if event.Percent != "" && event.Name != "" {
+			if !c.reportStepProgress(event.Name, event.Percent) {
+				return LogMessage{}, false
+			}
+			message = fmt.Sprintf("Installing %s: %s%%", event.Name, event.Percent)
+		} else if event.Step != "" && event.Number != "" {
+			message = fmt.Sprintf("Step %s of %s", event.Step, event.Number)
+		} else {
+			return LogMessage{}, false
+		}
+	case "message":
+		if level == "DEBUG" && event.Text == "" {
+			return LogMessage{}, false
+		}
+		msgType, message = "message", event.Text
+	case "info":
+		if event.Text == "" {
+			return LogMessage{}, false
+		}
+		msgType, message = "info", event.Text
+	case "source":
+		msgType, message = "source", fmt.Sprintf("Update source: %s", event.Source)
+	default:
+		msgType, message = "unknown", fmt.Sprintf("Unknown event type: %s", event.Type)
 	}
+	return c.newRecord(originClient, msgType, level, message, nil), true
 }
 
 // uploadFirmware uploads the firmware file to the SWUpdate device via HTTP multipart form
 func (c *SWUpdateClient) uploadFirmware(ctx context.Context) error {
-	file, err := os.Open(c.config.Filename)
+	firmware, err := c.openFirmware(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", c.config.Filename, err)
+		return err
 	}
-	defer file.Close()
+	defer firmware.Reader.Close()
 
-	stat, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file stats: %w", err)
+	if err := c.preflightFirmware(ctx, firmware); err != nil {
+		return fmt.Errorf("pre-flight check failed: %w", err)
 	}
 
-	c.logMessage("upload", "INFO", fmt.Sprintf("Uploading firmware: %s (%.2f MB)",
-		filepath.Base(c.config.Filename),
-		float64(stat.Size())/(1024*1024)))
+	if !c.config.DryRun {
+		c.logMessage("upload", "INFO", fmt.Sprintf("Uploading firmware: %s (%s)", firmware.Name, formatSize(firmware.Size)))
+	}
 
-	var requestBody bytes.Buffer
-	multipartWriter := multipart.NewWriter(&requestBody)
+	// Stream the image between the multipart header and trailer instead of buffering it in memory
+	var head, tail bytes.Buffer
+	multipartWriter := multipart.NewWriter(&head)
 
-	part, err := multipartWriter.CreateFormFile("file", filepath.Base(c.config.Filename))
-	if err != nil {
+	if _, err := multipartWriter.CreateFormFile("file", firmware.Name); err != nil {
 		return fmt.Errorf("failed to create form file: %w", err)
 	}
-
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return fmt.Errorf("failed to copy file data: %w", err)
+	headLen := head.Len()
+	multipartWriter.Close()
+	tail.Write(head.Bytes()[headLen:])
+	head.Truncate(headLen)
+
+	uploadCtx, cancelUpload := withPhaseTimeout(ctx, phaseUpload, c.config.UploadTimeout)
+	defer cancelUpload()
+	stallCtx, cancelStall := context.WithCancelCause(uploadCtx)
+	defer cancelStall(nil)
+
+	var source io.Reader = firmware.Reader
+	if c.recordsImage() {
+		digest := sha256.New()
+		source = io.TeeReader(source, digest)
+		defer func() {
+			c.image.Name, c.image.Size = firmware.Name, firmware.Size
+			if c.upload.complete.Load() {
+				c.image.SHA256 = hex.EncodeToString(digest.Sum(nil))
+			}
+			if c.session != nil {
+				c.session.artifact(c.image)
+			}
+		}()
 	}
 
-	multipartWriter.Close()
+	c.upload.size.Store(firmware.Size)
+	image := &countingReader{r: c.limitUpload(stallCtx, source), progress: &c.upload}
+	if c.metrics != nil {
+		image.onRead = func(n int) { c.countMetric(metricUploadBytes, float64(n)) }
+	}
+	requestBody := io.MultiReader(&head, image, &tail)
 
-	scheme := "http"
-	if c.config.TLS {
-		scheme = "https"
+	target, err := c.target()
+	if err != nil {
+		return err
 	}
-	uploadURL := fmt.Sprintf("%s://%s:%d/upload", scheme, c.config.IPAddress, c.config.Port)
+	uploadURL := target.uploadURL()
 
-	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, &requestBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, requestBody)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	req.ContentLength = -1
+	if firmware.Size >= 0 {
+		req.ContentLength = int64(head.Len()) + firmware.Size + int64(tail.Len())
+	}
 
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
-
-	// Create HTTP client with TLS configuration
-	client := &http.Client{
-		Timeout: c.config.Timeout,
+	if err := c.applyHeaders(req); err != nil {
+		return err
 	}
 
-	if c.config.TLS {
-		tlsConfig, err := c.createTLSConfig()
-		if err != nil {
-			return fmt.Errorf("failed to create TLS configuration: %w", err)
-		}
-		client.Transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
-		}
+	client, err := c.httpClient(target)
+	if err != nil {
+		return err
 	}
 
-	if c.config.Verbose {
-		log.Printf("Uploading to: %s", uploadURL)
+	if c.config.DryRun {
+		c.describeRequest(fmt.Sprintf("upload %s (%s)", firmware.Name, formatSize(firmware.Size)), req)
+		return nil
 	}
 
-	resp, err := client.Do(req)
+	c.logf(levelDebug, "Uploading to: %s", uploadURL)
+
+	go c.watchUploadStall(stallCtx, cancelStall)
+	go c.reportUploadProgress(stallCtx)
+
+	c.enterStage(stageUploading)
+	c.state.clearResult()
+	resp, err := client.Do(req.WithContext(stallCtx))
 	if err != nil {
-		return fmt.Errorf("failed to upload firmware: %w", err)
+		return fmt.Errorf("failed to upload firmware: %w", phaseError(stallCtx, err))
 	}
 	defer resp.Body.Close()
 
@@ -370,39 +571,38 @@ func (c *SWUpdateClient) uploadFirmware(ctx context.Context) error {
 }
 
 func (c *SWUpdateClient) restartDevice(ctx context.Context) error {
-	scheme := "http"
-	if c.config.TLS {
-		scheme = "https"
+	target, err := c.target()
+	if err != nil {
+		return err
 	}
-	restartURL := fmt.Sprintf("%s://%s:%d/restart", scheme, c.config.IPAddress, c.config.Port)
+	restartURL := target.restartURL()
+
+	restartCtx, cancel := withPhaseTimeout(ctx, phaseRestart, c.config.RestartTimeout)
+	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "POST", restartURL, nil)
+	req, err := http.NewRequestWithContext(restartCtx, "POST", restartURL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create restart request: %w", err)
 	}
-
-	// Create HTTP client with TLS configuration
-	client := &http.Client{
-		Timeout: c.config.Timeout,
+	if err := c.applyHeaders(req); err != nil {
+		return err
 	}
 
-	if c.config.TLS {
-		tlsConfig, err := c.createTLSConfig()
-		if err != nil {
-			return fmt.Errorf("failed to create TLS configuration: %w", err)
-		}
-		client.Transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
-		}
+	client, err := c.httpClient(target)
+	if err != nil {
+		return err
 	}
 
-	if c.config.Verbose {
-		log.Printf("Sending restart request to: %s", restartURL)
+	if c.config.DryRun {
+		c.describeRequest("restart the device", req)
+		return nil
 	}
 
+	c.logf(levelDebug, "Sending restart request to: %s", restartURL)
+
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to restart device: %w", err)
+		return fmt.Errorf("failed to restart device: %w", phaseError(restartCtx, err))
 	}
 	defer resp.Body.Close()
 
@@ -416,55 +616,191 @@ func (c *SWUpdateClient) restartDevice(ctx context.Context) error {
 }
 
 // Update performs the complete firmware update process including WebSocket monitoring and optional restart
-func (c *SWUpdateClient) Update(ctx context.Context, restart bool) error {
-	wsCtx, wsCancel := context.WithCancel(ctx)
+func (c *SWUpdateClient) Update(ctx context.Context, restart bool) (err error) {
+	// Progress monitoring outlives a cancelled ctx so the outcome of an interrupted update can be reported
+	wsCtx, wsCancel := context.WithCancel(context.WithoutCancel(ctx))
 	defer wsCancel()
+	if c.ui != nil {
+		c.ui.start()
+		defer c.ui.finish()
+	}
+	defer func() {
+		var timeout *phaseTimeoutError
+		switch {
+		case err != nil && c.cancelSignal() != nil:
+			err = c.reportCancellation(wsCtx)
+		case errors.As(err, &timeout) && c.config.JSONOutput:
+			c.logEvent("timeout", "ERROR", timeout.Error(), map[string]interface{}{
+				"phase":   timeout.Phase,
+				"timeout": timeout.Timeout.String(),
+			})
+		}
+	}()
 
-	if err := c.connectWebSocket(wsCtx); err != nil {
-		log.Printf("Warning: Failed to connect to WebSocket: %v", err)
-		log.Println("Proceeding without progress monitoring...")
+	c.enterStage(stageConnecting)
+	if err := c.traced("websocket-connect", func() error { return c.connectWebSocket(ctx) }); err != nil {
+		if c.config.DryRun {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.logWarning("Failed to connect to WebSocket: %v; proceeding without progress monitoring", err)
 	} else {
 		go c.listenWebSocket(wsCtx)
 	}
 
-	if err := c.uploadFirmware(ctx); err != nil {
+	if err := c.checkDeviceReady(ctx); err != nil {
 		return err
 	}
 
-	time.Sleep(2 * time.Second)
+	if err := c.traced("upload", func() error { return c.uploadFirmware(ctx) }); err != nil {
+		return err
+	}
+
+	if !c.config.DryRun {
+		c.fireHook(hookUploadComplete, nil)
+		c.enterStage(stageInstalling)
+		if err := c.traced("install", func() error { return c.waitForInstall(ctx) }); err != nil {
+			return err
+		}
+	}
 
 	if restart {
-		if err := c.restartDevice(ctx); err != nil {
-			log.Printf("Warning: Failed to restart device: %v", err)
+		c.enterStage(stageRebooting)
+		if err := c.traced("restart", func() error { return c.restartDevice(ctx) }); err != nil {
+			if c.cancelSignal() != nil {
+				return err // Reported as a cancellation
+			}
+			c.logWarning("Failed to restart device: %v", err)
+			c.report.failPhase(err)
+		} else {
+			c.fireHook(hookRestart, nil)
+			if c.config.RebootTimeout > 0 && !c.config.DryRun {
+				c.enterStage(stageVerifying)
+				if err := c.traced("reboot-wait", func() error { return c.waitForReboot(ctx) }); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// waitForInstall waits for the installation result, or briefly for the device to start installing
+// without progress monitoring
+func (c *SWUpdateClient) waitForInstall(ctx context.Context) error {
+	if c.wsConn != nil && c.config.InstallTimeout > 0 {
+		return c.awaitInstall(ctx)
+	}
+	select {
+	case <-time.After(2 * time.Second):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func main() {
 	var config Config
 	var restart bool
 	var showVersion bool
-
-	flag.StringVar(&config.IPAddress, "ip", "192.168.1.100", "IP address of the swupdate device")
+	var targets targetList
+	var rateLimitTotal byteRate
+	var parallel int
+	var plain bool
+	var showSchema bool
+	var junitPath, markdownPath string
+	var metricsAddr string
+	var metricsLinger time.Duration
+	var journald bool
+	var logLevelName, stderrLevelName string
+
+	flag.StringVar(&config.IPAddress, "ip", "192.168.1.100", "Host name, IP address (IPv6 with optional %zone) or URL of the swupdate device")
 	flag.IntVar(&config.Port, "port", 8080, "Port of the swupdate web server")
-	flag.StringVar(&config.Filename, "file", "", "Firmware file (.swu) to upload")
-	flag.DurationVar(&config.Timeout, "timeout", 5*time.Minute, "Timeout for operations")
-	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose output")
+	flag.Var(&targets, "target", "Full device URL, e.g. https://[fe80::1%eth0]:8443/swupdate/ (overrides -ip, -port, -tls and -base-path; repeatable to update several devices; append ,hw=REVISION and ,version=VERSION for the device's hardware revision and installed version)")
+	flag.IntVar(&parallel, "parallel", 0, "Maximum number of devices updated at the same time (0 = all)")
+	flag.StringVar(&config.BasePath, "base-path", "", "Path prefix of the swupdate web server, e.g. when behind a reverse proxy")
+	flag.StringVar(&config.Filename, "file", "", "Firmware file (.swu) to upload: local path, - for stdin, http(s)://, s3:// or oci:// URL")
+	flag.StringVar(&config.UploadName, "upload-name", "", "File name sent to the device in the multipart upload (default: source file name)")
+	flag.StringVar(&config.FileSHA256, "file-sha256", "", "Expected SHA-256 of the firmware; remote images are downloaded and verified before upload")
+	flag.StringVar(&config.CacheDir, "cache-dir", "", "Directory for a content-addressed cache of downloaded firmware")
+	flag.StringVar(&config.S3Endpoint, "s3-endpoint", "", "S3-compatible endpoint for s3:// URLs (default: $AWS_ENDPOINT_URL or AWS)")
+	flag.StringVar(&config.S3Region, "s3-region", "", "Region for s3:// URLs (default: $AWS_REGION or us-east-1)")
+	flag.StringVar(&config.OCIMediaType, "oci-media-type", "", "Media type of the firmware layer in oci:// artifacts (default: the .swu titled or only layer)")
+	flag.BoolVar(&config.OCIPlainHTTP, "oci-plain-http", false, "Access the OCI registry over plain HTTP (implied for localhost)")
+	flag.DurationVar(&config.Timeout, "timeout", 0, "Deadline for the whole run (0 = no limit; see the per-phase timeouts)")
+	flag.DurationVar(&config.ConnectTimeout, "connect-timeout", defaultConnectTimeout, "Timeout for connecting to the device, including TLS and WebSocket handshakes")
+	flag.DurationVar(&config.UploadTimeout, "upload-timeout", 0, "Timeout for the whole upload until the device responds (0 = no limit)")
+	flag.DurationVar(&config.StallTimeout, "stall-timeout", defaultStallTimeout, "Fail the upload if less than -min-upload-rate is sent within this window (0 disables)")
+	flag.Var((*byteRate)(&config.MinUploadRate), "min-upload-rate", "Minimum upload throughput, e.g. 10KB/s (default: any progress)")
+	flag.DurationVar(&config.InstallTimeout, "install-timeout", defaultInstallTimeout, "Timeout for the installation result after the upload (0 = do not wait)")
+	flag.DurationVar(&config.RestartTimeout, "restart-timeout", defaultRestartTimeout, "Timeout for the restart request")
+	flag.DurationVar(&config.RebootTimeout, "reboot-timeout", 0, "Wait up to this long for the device to come back after -restart (0 = do not wait)")
+	flag.Var((*byteRate)(&config.RateLimit), "rate-limit", "Limit the upload bandwidth per device, e.g. 2MB/s")
+	flag.Var(&rateLimitTotal, "rate-limit-total", "Limit the combined upload bandwidth of all devices, e.g. 10MB/s")
+	flag.BoolVar(&config.Verbose, "verbose", false, "Enable verbose output, the same as -log-level debug")
+	flag.StringVar(&logLevelName, "log-level", "info", "Lowest level of messages printed and sent to syslog or the journal: debug, info, warn or error")
+	flag.BoolVar(&config.Quiet, "quiet", false, "Print only the final result of each update (no progress display or dashboard)")
+	flag.StringVar(&stderrLevelName, "stderr-level", "", "Lowest level of diagnostics and warnings written to stderr: debug, info, warn, error or off (default: -log-level, error with -quiet)")
 	flag.BoolVar(&config.JSONOutput, "json", false, "Output progress and messages in JSON format")
+	flag.BoolVar(&plain, "plain", false, "Print progress as plain lines even when stdout is a terminal (no progress display or dashboard)")
 	flag.BoolVar(&config.TLS, "tls", false, "Use HTTPS/WSS instead of HTTP/WS")
 	flag.BoolVar(&config.InsecureTLS, "insecure", false, "Skip TLS certificate verification")
 	flag.StringVar(&config.CertFile, "ca-cert", "", "Path to custom CA certificate file")
 	flag.StringVar(&config.ClientCertFile, "client-cert", "", "Path to client certificate file")
-	flag.StringVar(&config.ClientKeyFile, "client-key", "", "Path to client private key file")
+	flag.StringVar(&config.ClientKeyFile, "client-key", "", "Path to client private key file (PEM, optionally encrypted)")
+	flag.StringVar(&config.ClientP12File, "client-p12", "", "Path to PKCS#12 (.p12/.pfx) client certificate bundle")
+	flag.StringVar(&config.KeyPassphraseFile, "key-passphrase-file", "", "File containing the passphrase for an encrypted client key or bundle")
+	flag.StringVar(&config.KeyPassphraseEnv, "key-passphrase-env", "", "Environment variable holding the passphrase for an encrypted client key or bundle")
+	flag.Var((*headerList)(&config.Headers), "header", "Extra \"Name: value\" header sent with every request (repeatable)")
+	flag.StringVar(&config.Token, "token", "", "Bearer token sent in the Authorization header")
+	flag.StringVar(&config.TokenFile, "token-file", "", "File containing the bearer token (re-read for every request)")
+	flag.StringVar(&config.TokenCommand, "token-command", "", "Command printing the bearer token, or JSON with access_token and expires_in")
+	flag.DurationVar(&config.TokenTTL, "token-ttl", defaultTokenTTL, "How long a -token-command token without an expiry is cached")
+	flag.StringVar(&config.HWRevision, "hw-revision", "", "Hardware revision of the device (\"rev\" or \"board rev\"); refuse images that are not compatible")
+	flag.StringVar(&config.PublicKeyFile, "public-key", "", "PEM public key to verify the image's sw-description.sig with before upload")
+	flag.BoolVar(&config.Force, "force", false, "Upload even if the image fails pre-flight checks")
+	flag.StringVar(&config.DeviceVersion, "device-version", "", "Firmware version installed on the device; enables the version policy")
+	flag.StringVar(&config.DeviceVersionURL, "device-version-url", "", "Device endpoint (path or URL) returning the installed version as text or JSON; enables the version policy")
+	flag.StringVar(&config.DeviceVersionField, "device-version-field", defaultDeviceVersionField, "Dotted JSON field holding the version in the -device-version-url response")
+	flag.BoolVar(&config.AllowDowngrade, "allow-downgrade", false, "Allow installing an image older than the installed version")
+	flag.BoolVar(&config.Reinstall, "reinstall", false, "Allow installing the version that is already installed")
+	flag.DurationVar(&config.StatusWait, "status-wait", defaultStatusWait, "How long to wait for the device's current status before uploading (0 disables the busy check)")
+	flag.DurationVar(&config.WaitIdle, "wait-idle", 0, "Wait up to this long for a busy device to become idle instead of failing")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Run all pre-flight checks and show what would be sent, without uploading or restarting")
+	flag.StringVar(&config.SessionDir, "session-dir", "", "Write a timestamped session file of every update to this directory (see the replay command)")
+	flag.StringVar(&config.HistoryFile, "history-file", defaultHistoryFile(), "Append the outcome of every update to this file, on by default (see the history command; -history-file= disables it)")
+	flag.StringVar(&junitPath, "report", "", "Write a JUnit XML report with one test case per update phase to this file")
+	flag.StringVar(&markdownPath, "report-markdown", "", "Write a Markdown summary of the update to this file")
+	flag.StringVar(&metricsAddr, "metrics-listen", "", "Serve Prometheus metrics on this address, e.g. :9100, at /metrics during the run")
+	flag.DurationVar(&metricsLinger, "metrics-linger", 0, "Keep serving metrics this long after the run so the final values can be scraped")
+	flag.StringVar(&config.DeviceGroup, "device-group", "default", "Device group label of the metrics")
+	flag.StringVar(&config.TraceFile, "trace-file", "", "Append an OpenTelemetry trace of every update to this file as OTLP JSON")
+	flag.StringVar(&config.TraceEndpoint, "trace-endpoint", "", "Send an OpenTelemetry trace of every update to this OTLP/HTTP collector, e.g. http://localhost:4318")
+	flag.Var((*flagList)(&config.Webhooks), "webhook", "POST lifecycle events as JSON to this URL (repeatable)")
+	flag.StringVar(&config.WebhookTemplate, "webhook-template", "", "File with a Go template rendering the JSON webhook body")
+	flag.Var((*flagList)(&config.HookCommands), "hook-command", "Run this command on lifecycle events, described in SWUPDATE_* environment variables (repeatable)")
+	flag.Var((*flagList)(&config.HookEvents), "hook-events", "Comma-separated events that trigger hooks: start, upload-complete, restart, success, failure (default all)")
+	flag.DurationVar(&config.HookTimeout, "hook-timeout", defaultHookTimeout, "Timeout of each hook attempt")
+	flag.IntVar(&config.HookRetries, "hook-retries", defaultHookRetries, "Retries of a failed hook")
+	flag.StringVar(&config.Syslog, "syslog", "", "Also send all messages to this RFC 5424 syslog server: udp://host:514, tcp://host:601 or unix:///dev/log")
+	flag.StringVar(&config.SyslogFacility, "syslog-facility", "user", "Facility of syslog messages, e.g. daemon or local0")
+	flag.BoolVar(&journald, "journald", false, "Also send all messages to the systemd journal with DEVICE, PHASE and LEVEL fields")
 	flag.BoolVar(&restart, "restart", false, "Restart device after successful update")
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
+	flag.BoolVar(&showSchema, "json-schema", false, "Print the JSON Schema of the -json output and exit")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "SWUpdate Client - Upload firmware to swupdate-capable devices\n")
 		fmt.Fprintf(os.Stderr, "Version: %s (branch: %s, commit: %s, built: %s)\n\n", version, branch, commit, buildDate)
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  (none)     Upload firmware to the device\n")
+		fmt.Fprintf(os.Stderr, "  tls-check  Inspect the device's TLS certificate chain and lint local certificate files\n")
+		fmt.Fprintf(os.Stderr, "  replay     Print a session file written with -session-dir: replay [-json] [-verbose] <file>\n")
+		fmt.Fprintf(os.Stderr, "  history    List past updates: history [-device d] [-version v] [-since date] [-until date] [-json|-csv]\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
@@ -472,9 +808,41 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -json > update.log\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -tls -ca-cert ca.crt\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -tls -insecure\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -tls -client-p12 client.p12 -key-passphrase-env P12_PASS\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -target https://[fe80::1%%eth0]:8443/swupdate/ -file firmware.swu\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip gateway.example.com -file firmware.swu -token-file token.txt -header \"X-Tenant: acme\"\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file https://artifacts.example.com/fw.swu -file-sha256 <hex> -cache-dir ~/.cache/swu\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file s3://firmware/release/fw.swu -s3-endpoint http://localhost:9000\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  make-image | %s -ip 192.168.1.100 -file - -upload-name image.swu\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file oci://registry.example.com/firmware/board:v1.2.0\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -hw-revision \"myboard 1.0\"\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -device-version-url /version.json -allow-downgrade\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -restart -dry-run\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -wait-idle 10m\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -restart -min-upload-rate 50KB/s -install-timeout 20m -reboot-timeout 5m\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -target http://10.0.0.1:8080 -target http://10.0.0.2:8080 -file firmware.swu -rate-limit 2MB/s -rate-limit-total 3MB/s\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -restart -reboot-timeout 5m -report junit.xml -report-markdown summary.md\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -session-dir sessions/\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -restart -trace-endpoint http://localhost:4318 -trace-file traces.jsonl\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -webhook https://chat.example.com/hook -hook-events success,failure -hook-command ./notify.sh\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -restart -quiet\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -log-level warn -stderr-level off\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -ip 192.168.1.100 -file firmware.swu -journald -syslog udp://logs.example.com:514 -syslog-facility local0\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -target http://10.0.0.1:8080 -target http://10.0.0.2:8080 -file firmware.swu -metrics-listen :9100 -device-group gateways\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s replay -verbose sessions/session-20240101T120000.000Z.jsonl\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s history -device http://192.168.1.100:8080 -since 2024-01-01 -csv > updates.csv\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s tls-check -ip 192.168.1.100 -port 8443 -ca-cert ca.crt\n", os.Args[0])
 	}
 
-	flag.Parse()
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command == "history" {
+		os.Exit(runHistory(args))
+	}
+	_ = flag.CommandLine.Parse(args)
 
 	if showVersion {
 		fmt.Printf("swupdate-client version %s\n", version)
@@ -484,28 +852,224 @@ func main() {
 		os.Exit(0)
 	}
 
+	if showSchema {
+		fmt.Print(eventsSchema)
+		os.Exit(0)
+	}
+
+	if len(targets) > 0 {
+		spec, _ := parseTargetSpec(targets[0])
+		config.Target = spec.Address
+	}
+	if journald {
+		config.JournalSocket = defaultJournalSocket
+	}
+
+	level, err := parseLogLevel(logLevelName)
+	if err != nil || level == levelOff {
+		fmt.Fprintf(os.Stderr, "Error: invalid -log-level %q, expected debug, info, warn or error\n", logLevelName)
+		os.Exit(1)
+	}
+	config.LogLevel = level
+	if config.Verbose {
+		config.LogLevel = levelDebug
+	}
+	if stderrLevelName != "" {
+		if config.StderrLevel, err = parseLogLevel(stderrLevelName); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	defaultLogLevels(&config)
+
+	switch command {
+	case "":
+	case "tls-check":
+		config.TLS = true
+		client := NewSWUpdateClient(config)
+		ctx, cancel := runContext(config.Timeout)
+		code := runTLSCheck(ctx, client)
+		cancel()
+		os.Exit(code)
+	case "replay":
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: replay requires exactly one session file\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		os.Exit(runReplay(flag.Arg(0), config))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown command '%s'\n\n", command)
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if config.Filename == "" {
 		fmt.Fprintf(os.Stderr, "Error: firmware file (-file) is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if _, err := os.Stat(config.Filename); os.IsNotExist(err) {
-		fmt.Fprintf(os.Stderr, "Error: firmware file '%s' does not exist\n", config.Filename)
+	if len(targets) > 1 && config.Filename == stdinFirmware {
+		fmt.Fprintf(os.Stderr, "Error: firmware from stdin (-file -) cannot be sent to several targets\n")
+		os.Exit(1)
+	}
+	if len(targets) > 1 && config.HWRevision != "" {
+		fmt.Fprintf(os.Stderr, "Error: -hw-revision cannot be checked against several targets, give each its revision as -target URL,hw=REVISION\n")
+		os.Exit(1)
+	}
+	if len(targets) > 1 && config.DeviceVersion != "" {
+		fmt.Fprintf(os.Stderr, "Error: -device-version cannot apply to several targets, give each its version as -target URL,version=VERSION or use -device-version-url\n")
 		os.Exit(1)
 	}
 
-	client := NewSWUpdateClient(config)
+	var totalLimit *rateLimiter
+	if rateLimitTotal > 0 {
+		totalLimit = newRateLimiter(int64(rateLimitTotal))
+	}
+	clients := newDeviceClients(config, targets, totalLimit)
+	client := clients[0]
+	if len(clients) == 1 && !config.JSONOutput && !plain && !config.Quiet {
+		client.ui = newTerminalUI(&client.upload)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
-	defer cancel()
+	if err := client.validateFirmwareOptions(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := client.validateClientCredentials(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := client.validateAuthOptions(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	client.logMessage("connection", "INFO", fmt.Sprintf("Connecting to swupdate device at %s:%d", config.IPAddress, config.Port))
+	for _, client := range clients {
+		if err := client.validateVersionOptions(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.TraceEndpoint != "" {
+		if _, err := traceURL(config.TraceEndpoint); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	hooks, err := newHookRunner(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, client := range clients {
+		client.hooks = hooks
+	}
 
-	if err := client.Update(ctx, restart); err != nil {
-		fmt.Fprintf(os.Stderr, "Update failed: %v\n", err)
+	sinks, err := openLogSinks(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	defer sinks.close()
+	for _, client := range clients {
+		client.sinks = sinks
+	}
+
+	secure := false
+	for _, client := range clients {
+		target, err := client.target()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		secure = secure || target.secure()
+	}
+
+	// The passphrase of an encrypted client key is asked for now, before the dashboard takes over the terminal
+	if secure {
+		if _, err := client.clientCertificate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var metricsServer *http.Server
+	if metricsAddr != "" {
+		metrics := newUpdateMetrics()
+		for _, client := range clients {
+			client.metrics = metrics
+		}
+		server, err := serveMetrics(metricsAddr, metrics)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		metricsServer = server
+	}
+
+	ctx, cancel := runContext(config.Timeout)
+	defer cancel()
+
+	// The first SIGINT or SIGTERM cancels the updates gracefully, a second one exits immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// Several devices on a terminal are shown on a full-screen dashboard, whose abort key acts like SIGINT
+	var dash *dashboard
+	if len(clients) > 1 && !config.JSONOutput && !plain && !config.Quiet {
+		dash = newTerminalDashboard(clients, func() {
+			select {
+			case signals <- os.Interrupt:
+			default:
+			}
+		})
+	}
+
+	go func() {
+		sig := <-signals
+		for _, client := range clients {
+			client.Cancel(sig)
+		}
+		cancel()
+		<-signals
+		if dash != nil {
+			dash.close()
+		}
+		os.Exit(exitCancelled)
+	}()
+
+	if dash != nil {
+		dash.start()
+	}
+	code := runUpdates(ctx, clients, restart, parallel)
+	if dash != nil {
+		dash.close()
+	}
 
-	client.logMessage("completion", "INFO", "Update process completed")
+	if junitPath != "" {
+		if err := writeJUnitReport(junitPath, clients); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			code = max(code, 1)
+		}
+	}
+	if markdownPath != "" {
+		if err := writeMarkdownReport(markdownPath, clients); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			code = max(code, 1)
+		}
+	}
+	if metricsServer != nil {
+		lingerMetrics(ctx, metricsServer, metricsLinger)
+	}
+	hooks.wait()
+	if code != 0 {
+		sinks.close()
+		os.Exit(code)
+	}
 }
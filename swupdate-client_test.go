@@ -123,14 +123,17 @@ func TestHandleWebSocketEvent(t *testing.T) {
 	_, _ = buf.ReadFrom(r) // Ignore error in test - we're capturing stdout
 
 	output := buf.String()
-	var parsedEvent SWUpdateEvent
+	var parsedEvent LogMessage
 	err := json.Unmarshal([]byte(strings.TrimSpace(output)), &parsedEvent)
 	if err != nil {
 		t.Errorf("Expected valid JSON output, got: %s", output)
 	}
 
-	if parsedEvent.Type != event.Type {
-		t.Errorf("Expected type %s, got %s", event.Type, parsedEvent.Type)
+	if parsedEvent.Type != event.Type || parsedEvent.Origin != originDevice || parsedEvent.Schema != jsonSchemaVersion {
+		t.Errorf("Expected a device %s record, got %+v", event.Type, parsedEvent)
+	}
+	if parsedEvent.Data["percent"] != float64(50) {
+		t.Errorf("Expected numeric percent 50, got %v", parsedEvent.Data["percent"])
 	}
 }
 
@@ -474,7 +477,7 @@ func TestTLSConfig(t *testing.T) {
 				ClientCertFile: "cert.crt",
 				// Missing ClientKeyFile
 			},
-			wantErr: false, // Should not error, just skip client cert
+			wantErr: true, // Client certificate without key is rejected
 		},
 	}
 
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// deviceTarget is the resolved address of a device's SWUpdate web server,
+// from which all HTTP and WebSocket endpoints are derived
+type deviceTarget struct {
+	Scheme   string // "http" or "https"
+	Host     string // Host name or IP address without brackets; IPv6 literals may carry a zone ID
+	Port     int    // TCP port
+	BasePath string // Path prefix of the web server, e.g. "/swupdate"; empty when served at the root
+}
+
+// target resolves the configured device address. Config.Target takes precedence over Config.IPAddress;
+// either may be a full URL, a host name, an IPv4 address or an IPv6 address with optional zone ID.
+// Port, scheme and path given in the address override Config.Port, Config.TLS and Config.BasePath.
+func (c *SWUpdateClient) target() (deviceTarget, error) {
+	spec := c.config.Target
+	if spec == "" {
+		spec = c.config.IPAddress
+	}
+	return parseTarget(spec, c.config.Port, c.config.TLS, c.config.BasePath)
+}
+
+// parseTarget parses a device address specification, filling in unspecified parts from the defaults
+func parseTarget(spec string, defaultPort int, useTLS bool, basePath string) (deviceTarget, error) {
+	t := deviceTarget{Scheme: "http", Port: defaultPort, BasePath: basePath}
+	if useTLS {
+		t.Scheme = "https"
+	}
+
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return t, fmt.Errorf("device address is empty")
+	}
+
+	if strings.Contains(spec, "://") {
+		u, err := url.Parse(escapeZone(spec))
+		if err != nil {
+			return t, fmt.Errorf("invalid device URL %q: %w", spec, err)
+		}
+		switch u.Scheme {
+		case "http", "ws":
+			t.Scheme = "http"
+		case "https", "wss":
+			t.Scheme = "https"
+		default:
+			return t, fmt.Errorf("unsupported scheme %q in device URL %q", u.Scheme, spec)
+		}
+		if u.Path != "" && u.Path != "/" {
+			t.BasePath = u.Path
+		}
+		if u.Port() == "" {
+			// A URL without a port means the scheme's default port, not -port
+			t.Port = 80
+			if t.Scheme == "https" {
+				t.Port = 443
+			}
+		}
+		spec = u.Host
+	}
+
+	host, port, err := splitHostPort(spec)
+	if err != nil {
+		return t, fmt.Errorf("invalid device address %q: %w", spec, err)
+	}
+	if host == "" {
+		return t, fmt.Errorf("device address %q has no host", spec)
+	}
+	t.Host = host
+
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return t, fmt.Errorf("invalid port %q in device address", port)
+		}
+		t.Port = p
+	}
+	if t.Port < 1 || t.Port > 65535 {
+		return t, fmt.Errorf("invalid port %d", t.Port)
+	}
+
+	t.BasePath = cleanBasePath(t.BasePath)
+	return t, nil
+}
+
+// splitHostPort splits an address into host and optional port. Unlike net.SplitHostPort it accepts
+// addresses without a port and bare IPv6 literals such as "fe80::1%eth0".
+func splitHostPort(addr string) (host, port string, err error) {
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ']' in address")
+		}
+		host, rest := addr[1:end], addr[end+1:]
+		switch {
+		case rest == "":
+			return host, "", nil
+		case strings.HasPrefix(rest, ":"):
+			return host, rest[1:], nil
+		}
+		return "", "", fmt.Errorf("unexpected %q after ']'", rest)
+	}
+
+	switch strings.Count(addr, ":") {
+	case 0:
+		return addr, "", nil
+	case 1:
+		return net.SplitHostPort(addr)
+	}
+	// More than one colon without brackets can only be an IPv6 literal
+	return addr, "", nil
+}
+
+// escapeZone percent-encodes the '%' of an IPv6 zone ID inside a URL so that
+// "http://[fe80::1%eth0]:8080/" is accepted as well as the RFC 6874 form "%25eth0"
+func escapeZone(rawURL string) string {
+	start := strings.Index(rawURL, "[")
+	end := strings.Index(rawURL, "]")
+	if start < 0 || end < start {
+		return rawURL
+	}
+	host := rawURL[start:end]
+	if i := strings.Index(host, "%"); i >= 0 && !strings.HasPrefix(host[i:], "%25") {
+		host = host[:i] + "%25" + host[i+1:]
+	}
+	return rawURL[:start] + host + rawURL[end:]
+}
+
+// cleanBasePath normalizes a path prefix to "/a/b" form, or "" for the root
+func cleanBasePath(p string) string {
+	if p == "" {
+		return ""
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// secure reports whether the target uses HTTPS/WSS
+func (t deviceTarget) secure() bool {
+	return t.Scheme == "https"
+}
+
+// hostPort returns the host and port joined for dialing, bracketing IPv6 literals
+func (t deviceTarget) hostPort() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// serverName returns the host name used for TLS verification, without any IPv6 zone ID
+func (t deviceTarget) serverName() string {
+	if i := strings.Index(t.Host, "%"); i >= 0 {
+		return t.Host[:i]
+	}
+	return t.Host
+}
+
+// endpoint returns the HTTP(S) URL of an endpoint below the base path
+func (t deviceTarget) endpoint(name string) *url.URL {
+	return &url.URL{
+		Scheme: t.Scheme,
+		Host:   t.hostPort(),
+		Path:   t.BasePath + "/" + strings.TrimPrefix(name, "/"),
+	}
+}
+
+// uploadURL returns the firmware upload endpoint
+func (t deviceTarget) uploadURL() string {
+	return t.endpoint("upload").String()
+}
+
+// restartURL returns the device restart endpoint
+func (t deviceTarget) restartURL() string {
+	return t.endpoint("restart").String()
+}
+
+// webSocketURL returns the progress WebSocket endpoint
+func (t deviceTarget) webSocketURL() string {
+	u := t.endpoint("ws")
+	u.Scheme = "ws"
+	if t.secure() {
+		u.Scheme = "wss"
+	}
+	return u.String()
+}
+
+// String returns the base URL of the device's web server
+func (t deviceTarget) String() string {
+	return t.endpoint("").String()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		port      int
+		tls       bool
+		basePath  string
+		upload    string
+		ws        string
+		hostPort  string
+		wantError bool
+	}{
+		{
+			name:     "IPv4 address",
+			spec:     "192.168.1.100",
+			port:     8080,
+			upload:   "http://192.168.1.100:8080/upload",
+			ws:       "ws://192.168.1.100:8080/ws",
+			hostPort: "192.168.1.100:8080",
+		},
+		{
+			name:     "Host name with TLS",
+			spec:     "device.local",
+			port:     8443,
+			tls:      true,
+			upload:   "https://device.local:8443/upload",
+			ws:       "wss://device.local:8443/ws",
+			hostPort: "device.local:8443",
+		},
+		{
+			name:     "Host name with port",
+			spec:     "device.local:9000",
+			port:     8080,
+			upload:   "http://device.local:9000/upload",
+			ws:       "ws://device.local:9000/ws",
+			hostPort: "device.local:9000",
+		},
+		{
+			name:     "Bare IPv6 literal",
+			spec:     "2001:db8::1",
+			port:     8080,
+			upload:   "http://[2001:db8::1]:8080/upload",
+			ws:       "ws://[2001:db8::1]:8080/ws",
+			hostPort: "[2001:db8::1]:8080",
+		},
+		{
+			name:     "IPv6 with zone",
+			spec:     "fe80::1%eth0",
+			port:     8080,
+			upload:   "http://[fe80::1%25eth0]:8080/upload",
+			ws:       "ws://[fe80::1%25eth0]:8080/ws",
+			hostPort: "[fe80::1%eth0]:8080",
+		},
+		{
+			name:     "Bracketed IPv6 with port",
+			spec:     "[2001:db8::1]:9000",
+			port:     8080,
+			upload:   "http://[2001:db8::1]:9000/upload",
+			ws:       "ws://[2001:db8::1]:9000/ws",
+			hostPort: "[2001:db8::1]:9000",
+		},
+		{
+			name:     "Full URL with zone and base path",
+			spec:     "https://[fe80::1%eth0]:8443/swupdate/",
+			port:     8080,
+			upload:   "https://[fe80::1%25eth0]:8443/swupdate/upload",
+			ws:       "wss://[fe80::1%25eth0]:8443/swupdate/ws",
+			hostPort: "[fe80::1%eth0]:8443",
+		},
+		{
+			name:     "URL with escaped zone",
+			spec:     "http://[fe80::1%25eth0]:8080",
+			port:     1234,
+			upload:   "http://[fe80::1%25eth0]:8080/upload",
+			ws:       "ws://[fe80::1%25eth0]:8080/ws",
+			hostPort: "[fe80::1%eth0]:8080",
+		},
+		{
+			name:     "URL without port uses scheme default",
+			spec:     "https://gateway.example.com/devices/42",
+			port:     8080,
+			upload:   "https://gateway.example.com:443/devices/42/upload",
+			ws:       "wss://gateway.example.com:443/devices/42/ws",
+			hostPort: "gateway.example.com:443",
+		},
+		{
+			name:     "Base path option",
+			spec:     "10.0.0.1",
+			port:     80,
+			basePath: "swupdate/",
+			upload:   "http://10.0.0.1:80/swupdate/upload",
+			ws:       "ws://10.0.0.1:80/swupdate/ws",
+			hostPort: "10.0.0.1:80",
+		},
+		{name: "Empty address", spec: "", port: 8080, wantError: true},
+		{name: "Unsupported scheme", spec: "ftp://device", port: 8080, wantError: true},
+		{name: "Invalid port", spec: "device:99999", port: 8080, wantError: true},
+		{name: "Unterminated bracket", spec: "[fe80::1", port: 8080, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := parseTarget(tt.spec, tt.port, tt.tls, tt.basePath)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("Expected error for %q, got target %+v", tt.spec, target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTarget(%q) error = %v", tt.spec, err)
+			}
+			if got := target.uploadURL(); got != tt.upload {
+				t.Errorf("Expected upload URL %s, got %s", tt.upload, got)
+			}
+			if got := target.webSocketURL(); got != tt.ws {
+				t.Errorf("Expected WebSocket URL %s, got %s", tt.ws, got)
+			}
+			if got := target.hostPort(); got != tt.hostPort {
+				t.Errorf("Expected host:port %s, got %s", tt.hostPort, got)
+			}
+		})
+	}
+}
+
+func TestClientTargetPrecedence(t *testing.T) {
+	client := NewSWUpdateClient(Config{
+		IPAddress: "192.168.1.100",
+		Port:      8080,
+		Target:    "https://device.example.com:8443/sw",
+	})
+
+	target, err := client.target()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := target.restartURL(); got != "https://device.example.com:8443/sw/restart" {
+		t.Errorf("Expected -target to take precedence, got %s", got)
+	}
+	if !target.secure() {
+		t.Error("Expected https target to be secure")
+	}
+	if target.serverName() != "device.example.com" {
+		t.Errorf("Unexpected server name %s", target.serverName())
+	}
+}
+
+func TestUploadFirmware_BasePath(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer server.Close()
+
+	file := writeTestFile(t, "firmware.swu", []byte("test firmware data"))
+	client := NewSWUpdateClient(Config{Target: server.URL + "/swupdate/", Filename: file, Timeout: 5 * time.Second})
+
+	if err := client.uploadFirmware(context.Background()); err != nil {
+		t.Fatalf("uploadFirmware() error = %v", err)
+	}
+	if gotPath != "/swupdate/upload" {
+		t.Errorf("Expected upload to /swupdate/upload, got %s", gotPath)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// certExpiryWarning is how far ahead of expiry a certificate is reported as expiring soon
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// Finding levels reported by the TLS check
+const (
+	findingOK    = "OK"
+	findingWarn  = "WARN"
+	findingError = "ERROR"
+)
+
+// TLSCheckFinding is a single diagnostic result of the TLS check
+type TLSCheckFinding struct {
+	Level   string `json:"level"`   // OK, WARN or ERROR
+	Subject string `json:"subject"` // What was checked (server chain, CA file, client certificate, ...)
+	Message string `json:"message"` // Human-readable result
+}
+
+// CertificateInfo summarizes a certificate for display
+type CertificateInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	IsCA        bool      `json:"is_ca"`
+	SHA256      string    `json:"sha256"`
+}
+
+// TLSCheckReport holds the result of inspecting the device's TLS endpoint and the local certificate files
+type TLSCheckReport struct {
+	Target              string            `json:"target"`
+	Version             string            `json:"tls_version,omitempty"`
+	CipherSuite         string            `json:"cipher_suite,omitempty"`
+	Chain               []CertificateInfo `json:"chain,omitempty"`
+	ClientAuthRequested bool              `json:"client_auth_requested"`
+	AcceptableCAs       []string          `json:"acceptable_cas,omitempty"`
+	Findings            []TLSCheckFinding `json:"findings"`
+}
+
+// add records a finding in the report
+func (r *TLSCheckReport) add(level, subject, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, TLSCheckFinding{Level: level, Subject: subject, Message: fmt.Sprintf(format, args...)})
+}
+
+// Failed reports whether any check produced an error
+func (r *TLSCheckReport) Failed() bool {
+	for _, f := range r.Findings {
+		if f.Level == findingError {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSCheck connects to the device, inspects the presented certificate chain and lints the local certificate files.
+// Handshake failures are returned as an error together with the findings gathered so far.
+func (c *SWUpdateClient) TLSCheck(ctx context.Context) (*TLSCheckReport, error) {
+	target, err := c.target()
+	if err != nil {
+		return &TLSCheckReport{Findings: []TLSCheckFinding{}}, err
+	}
+	if !target.secure() {
+		return &TLSCheckReport{Findings: []TLSCheckFinding{}}, fmt.Errorf("tls-check requires an https:// target, got %s", target)
+	}
+
+	report := &TLSCheckReport{
+		Target:   target.hostPort(),
+		Findings: []TLSCheckFinding{},
+	}
+
+	roots, rootsErr := c.loadCACertPool()
+	if rootsErr != nil {
+		report.add(findingError, "CA certificate", "%v", rootsErr)
+	}
+	c.lintCAFile(report)
+	clientCert := c.lintClientCertificate(report)
+
+	tlsConfig := &tls.Config{
+		// Verification is done after the handshake so every problem with the chain can be reported
+		InsecureSkipVerify: true,
+		ServerName:         target.serverName(),
+		GetClientCertificate: func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			report.ClientAuthRequested = true
+			report.AcceptableCAs = distinguishedNames(info.AcceptableCAs)
+			if clientCert != nil {
+				return clientCert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.config.ConnectTimeout},
+		Config:    tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", report.Target)
+	if err != nil {
+		report.add(findingError, "handshake", "%v", err)
+		return report, fmt.Errorf("TLS handshake with %s failed: %w", report.Target, err)
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	report.Version = tls.VersionName(state.Version)
+	report.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+
+	if report.ClientAuthRequested {
+		if clientCert == nil {
+			report.add(findingWarn, "client auth", "server requested a client certificate but none is configured")
+		} else {
+			report.add(findingOK, "client auth", "server requested a client certificate, configured certificate was presented")
+		}
+	}
+
+	c.checkServerChain(report, state.PeerCertificates, roots, rootsErr, target.serverName())
+	return report, nil
+}
+
+// checkServerChain validates the presented chain against the configured roots and the target host name.
+// rootsErr is the error loading the configured CA file, in which case the chain cannot be validated.
+func (c *SWUpdateClient) checkServerChain(report *TLSCheckReport, chain []*x509.Certificate, roots *x509.CertPool, rootsErr error, serverName string) {
+	if len(chain) == 0 {
+		report.add(findingError, "server chain", "server presented no certificates")
+		return
+	}
+
+	now := time.Now()
+	intermediates := x509.NewCertPool()
+	for i, cert := range chain {
+		report.Chain = append(report.Chain, certificateInfo(cert))
+		if i > 0 {
+			intermediates.AddCert(cert)
+		}
+		checkExpiry(report, fmt.Sprintf("server chain [%d]", i), cert, now)
+	}
+
+	rootsName := "system roots"
+	if roots != nil {
+		rootsName = c.config.CertFile
+	}
+
+	leaf := chain[0]
+	if rootsErr != nil {
+		report.add(findingError, "server chain", "chain not validated, %s could not be loaded: %v", c.config.CertFile, rootsErr)
+	} else if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now}); err != nil {
+		report.add(findingError, "server chain", "chain does not validate against %s: %v", rootsName, err)
+	} else {
+		report.add(findingOK, "server chain", "chain validates against %s", rootsName)
+	}
+
+	if err := leaf.VerifyHostname(serverName); err != nil {
+		report.add(findingError, "server name", "certificate does not match %q: %v", serverName, err)
+	} else {
+		report.add(findingOK, "server name", "certificate matches %q", serverName)
+	}
+
+	if c.config.InsecureTLS {
+		report.add(findingWarn, "configuration", "-insecure is set, the update would skip these verification checks")
+	}
+}
+
+// lintCAFile checks every certificate in the configured CA file for expiry
+func (c *SWUpdateClient) lintCAFile(report *TLSCheckReport) {
+	if c.config.CertFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(c.config.CertFile)
+	if err != nil {
+		// Already reported when loading the CA pool
+		return
+	}
+
+	now := time.Now()
+	count := 0
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			report.add(findingError, "CA certificate", "failed to parse certificate %d: %v", count, err)
+			continue
+		}
+		subject := fmt.Sprintf("CA certificate %q", cert.Subject.String())
+		checkExpiry(report, subject, cert, now)
+		if !cert.IsCA {
+			report.add(findingWarn, subject, "certificate is not a CA certificate")
+		}
+		count++
+	}
+	if count == 0 {
+		report.add(findingError, "CA certificate", "%s contains no certificates", c.config.CertFile)
+	}
+}
+
+// lintClientCertificate loads the configured client identity, checking key match, expiry and usage.
+// It returns the certificate for use in the handshake, or nil if none is configured or it failed to load.
+func (c *SWUpdateClient) lintClientCertificate(report *TLSCheckReport) *tls.Certificate {
+	cert, err := c.clientCertificate()
+	if err != nil {
+		report.add(findingError, "client certificate", "%v", err)
+		return nil
+	}
+	if cert == nil {
+		return nil
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			report.add(findingError, "client certificate", "failed to parse certificate: %v", err)
+			return nil
+		}
+	}
+
+	if keyMatchesCertificate(leaf, cert.PrivateKey) {
+		report.add(findingOK, "client certificate", "private key matches certificate %q", leaf.Subject.String())
+	} else {
+		report.add(findingError, "client certificate", "private key does not match certificate %q", leaf.Subject.String())
+	}
+
+	checkExpiry(report, "client certificate", leaf, time.Now())
+
+	if len(leaf.ExtKeyUsage) > 0 && !hasExtKeyUsage(leaf, x509.ExtKeyUsageClientAuth) {
+		report.add(findingWarn, "client certificate", "certificate is not valid for client authentication (missing clientAuth extended key usage)")
+	}
+	return cert
+}
+
+// checkExpiry records whether a certificate is expired, not yet valid or expiring soon
+func checkExpiry(report *TLSCheckReport, subject string, cert *x509.Certificate, now time.Time) {
+	switch {
+	case now.Before(cert.NotBefore):
+		report.add(findingError, subject, "not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		report.add(findingError, subject, "expired on %s", cert.NotAfter.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		report.add(findingWarn, subject, "expires on %s (%d days left)", cert.NotAfter.Format(time.RFC3339), daysUntil(now, cert.NotAfter))
+	default:
+		report.add(findingOK, subject, "valid until %s (%d days left)", cert.NotAfter.Format(time.RFC3339), daysUntil(now, cert.NotAfter))
+	}
+}
+
+// keyMatchesCertificate reports whether the private key belongs to the certificate's public key
+func keyMatchesCertificate(cert *x509.Certificate, key crypto.PrivateKey) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(cert.PublicKey)
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func daysUntil(now, t time.Time) int {
+	return int(t.Sub(now).Hours() / 24)
+}
+
+// certificateInfo extracts the displayed fields of a certificate
+func certificateInfo(cert *x509.Certificate) CertificateInfo {
+	info := CertificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.Text(16),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DNSNames:  cert.DNSNames,
+		IsCA:      cert.IsCA,
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	info.SHA256 = strings.Join(hexBytes, ":")
+	return info
+}
+
+// distinguishedNames converts the DER-encoded names from a certificate request into readable strings
+func distinguishedNames(raw [][]byte) []string {
+	var names []string
+	for _, der := range raw {
+		var rdn pkix.RDNSequence
+		if _, err := asn1.Unmarshal(der, &rdn); err != nil {
+			continue
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&rdn)
+		names = append(names, name.String())
+	}
+	return names
+}
+
+// printTLSCheckReport writes the report as a single JSON object or as human-readable text
+func (c *SWUpdateClient) printTLSCheckReport(report *TLSCheckReport) {
+	if c.config.JSONOutput {
+		jsonData, _ := json.Marshal(report)
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	fmt.Printf("Target: %s", report.Target)
+	if report.Version != "" {
+		fmt.Printf(" (%s, %s)", report.Version, report.CipherSuite)
+	}
+	fmt.Println()
+
+	if len(report.Chain) > 0 {
+		fmt.Println("\nCertificate chain:")
+		for i, cert := range report.Chain {
+			fmt.Printf("  [%d] %s\n", i, cert.Subject)
+			fmt.Printf("      Issuer:  %s\n", cert.Issuer)
+			fmt.Printf("      Serial:  %s\n", cert.Serial)
+			fmt.Printf("      Valid:   %s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+			if sans := subjectAltNames(cert); sans != "" {
+				fmt.Printf("      SANs:    %s\n", sans)
+			}
+			fmt.Printf("      SHA-256: %s\n", cert.SHA256)
+		}
+	}
+
+	if report.Version != "" {
+		if report.ClientAuthRequested {
+			fmt.Println("\nClient authentication: requested")
+			for _, ca := range report.AcceptableCAs {
+				fmt.Printf("  Acceptable CA: %s\n", ca)
+			}
+		} else {
+			fmt.Println("\nClient authentication: not requested")
+		}
+	}
+
+	fmt.Println("\nChecks:")
+	for _, f := range report.Findings {
+		fmt.Printf("  %-7s %s: %s\n", "["+f.Level+"]", f.Subject, f.Message)
+	}
+}
+
+func subjectAltNames(cert CertificateInfo) string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip)
+	}
+	return strings.Join(sans, ", ")
+}
+
+// runTLSCheck executes the tls-check command and returns the process exit code
+func runTLSCheck(ctx context.Context, client *SWUpdateClient) int {
+	report, err := client.TLSCheck(ctx)
+	client.printTLSCheckReport(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "TLS check failed: %v\n", err)
+		return 1
+	}
+	if report.Failed() {
+		return 1
+	}
+	return 0
+}
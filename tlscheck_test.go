@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsTestConfig returns a client configuration pointing at a TLS test server
+func tlsTestConfig(t *testing.T, server *httptest.Server) Config {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	return Config{IPAddress: host, Port: portNum, Timeout: 5 * time.Second, TLS: true}
+}
+
+func hasFinding(report *TLSCheckReport, level, text string) bool {
+	for _, f := range report.Findings {
+		if f.Level == level && strings.Contains(f.Subject+": "+f.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTLSCheck_TrustedChain(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config := tlsTestConfig(t, server)
+	config.CertFile = writeTestFile(t, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	report, err := NewSWUpdateClient(config).TLSCheck(context.Background())
+	if err != nil {
+		t.Fatalf("TLSCheck() error = %v", err)
+	}
+	if report.Failed() {
+		t.Errorf("Expected no failed checks, got %+v", report.Findings)
+	}
+	if len(report.Chain) == 0 {
+		t.Error("Expected presented chain to be reported")
+	}
+	if report.ClientAuthRequested {
+		t.Error("Expected client auth not to be requested")
+	}
+	if !hasFinding(report, findingOK, "chain validates") {
+		t.Errorf("Expected chain validation finding, got %+v", report.Findings)
+	}
+}
+
+func TestTLSCheck_UntrustedChainAndClientAuth(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// Trust an unrelated CA so chain validation fails
+	other, _ := newTestCertificate(t)
+	config := tlsTestConfig(t, server)
+	config.CertFile = writeTestFile(t, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Raw}))
+
+	report, err := NewSWUpdateClient(config).TLSCheck(context.Background())
+	if err != nil {
+		t.Fatalf("TLSCheck() error = %v", err)
+	}
+	if !report.Failed() {
+		t.Error("Expected chain validation to fail")
+	}
+	if !report.ClientAuthRequested {
+		t.Error("Expected client auth request to be detected")
+	}
+	if !hasFinding(report, findingWarn, "none is configured") {
+		t.Errorf("Expected missing client certificate warning, got %+v", report.Findings)
+	}
+	if !hasFinding(report, findingWarn, "not a CA certificate") {
+		t.Errorf("Expected CA file lint warning, got %+v", report.Findings)
+	}
+}
+
+func TestTLSCheck_HandshakeFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	config := Config{IPAddress: "127.0.0.1", Port: addr.Port, Timeout: time.Second, TLS: true}
+	report, err := NewSWUpdateClient(config).TLSCheck(context.Background())
+	if err == nil {
+		t.Fatal("Expected handshake error")
+	}
+	if !report.Failed() {
+		t.Error("Expected handshake failure to be recorded as a finding")
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		level     string
+	}{
+		{"Valid", now.Add(-time.Hour), now.Add(365 * 24 * time.Hour), findingOK},
+		{"Expiring soon", now.Add(-time.Hour), now.Add(10 * 24 * time.Hour), findingWarn},
+		{"Expired", now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), findingError},
+		{"Not yet valid", now.Add(time.Hour), now.Add(48 * time.Hour), findingError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &TLSCheckReport{}
+			checkExpiry(report, "cert", &x509.Certificate{NotBefore: tt.notBefore, NotAfter: tt.notAfter}, now)
+			if len(report.Findings) != 1 || report.Findings[0].Level != tt.level {
+				t.Errorf("Expected one %s finding, got %+v", tt.level, report.Findings)
+			}
+		})
+	}
+}
+
+func TestKeyMatchesCertificate(t *testing.T) {
+	cert, key := newTestCertificate(t)
+	_, otherKey := newTestCertificate(t)
+
+	if !keyMatchesCertificate(cert, key) {
+		t.Error("Expected matching key to be accepted")
+	}
+	if keyMatchesCertificate(cert, otherKey) {
+		t.Error("Expected mismatched key to be rejected")
+	}
+}
+
+func TestTLSCheck_UnreadableCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config := tlsTestConfig(t, server)
+	config.CertFile = writeTestFile(t, "ca.crt", []byte("not a certificate"))
+
+	report, err := NewSWUpdateClient(config).TLSCheck(context.Background())
+	if err != nil {
+		t.Fatalf("TLSCheck() error = %v", err)
+	}
+	if !hasFinding(report, findingError, "chain not validated") || hasFinding(report, findingError, "system roots") {
+		t.Errorf("Expected the CA load error as the chain verdict, got %+v", report.Findings)
+	}
+}
+
+func TestTLSCheck_RejectsPlainHTTPTarget(t *testing.T) {
+	config := Config{Target: "http://127.0.0.1:8080", TLS: true}
+	if _, err := NewSWUpdateClient(config).TLSCheck(context.Background()); err == nil || !strings.Contains(err.Error(), "https://") {
+		t.Errorf("Expected an error for an http:// target, got %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// traceExportTimeout bounds sending a trace to -trace-endpoint
+const traceExportTimeout = 10 * time.Second
+
+// traceSpan is a span of an update's trace
+type traceSpan struct {
+	id         string
+	parentID   string
+	name       string
+	start, end time.Time
+	attributes map[string]interface{}
+	events     []traceEvent
+	err        string // Status message of a failed span
+}
+
+// traceEvent is a point in time within a span, such as a WebSocket event
+type traceEvent struct {
+	time       time.Time
+	name       string
+	attributes map[string]interface{}
+}
+
+// updateTrace collects the spans of one device's update for -trace-file and -trace-endpoint
+type updateTrace struct {
+	mu      sync.Mutex
+	traceID string
+	root    *traceSpan
+	phase   *traceSpan // Span of the phase in progress; events and handshakes are recorded in it
+	spans   []*traceSpan
+}
+
+// randomHex returns n random bytes as hex, for trace and span IDs
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newUpdateTrace starts a trace with its root span
+func newUpdateTrace(attributes map[string]interface{}) *updateTrace {
+	t := &updateTrace{traceID: randomHex(16)}
+	t.root = &traceSpan{id: randomHex(8), name: "update", start: time.Now(), attributes: attributes}
+	t.spans = append(t.spans, t.root)
+	return t
+}
+
+// begin starts a span as a child of the current phase, or of the root with phase set, which makes
+// the new span the current phase
+func (t *updateTrace) begin(name string, phase bool) *traceSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parent := t.root
+	if !phase && t.phase != nil {
+		parent = t.phase
+	}
+	span := &traceSpan{id: randomHex(8), parentID: parent.id, name: name, start: time.Now(), attributes: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	if phase {
+		t.phase = span
+	}
+	return span
+}
+
+// finish ends a span, marking it failed with err
+func (t *updateTrace) finish(span *traceSpan, err error, attributes map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span.end = time.Now()
+	if err != nil {
+		span.err = err.Error()
+	}
+	for key, value := range attributes {
+		span.attributes[key] = value
+	}
+	if t.phase == span {
+		t.phase = nil
+	}
+}
+
+// event records an event in the current phase, or the root span between phases
+func (t *updateTrace) event(name string, attributes map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span := t.root
+	if t.phase != nil {
+		span = t.phase
+	}
+	span.events = append(span.events, traceEvent{time: time.Now(), name: name, attributes: attributes})
+}
+
+// startSpan starts a span within the current phase, nil unless tracing
+func (c *SWUpdateClient) startSpan(name string) *traceSpan {
+	if c.trace == nil {
+		return nil
+	}
+	return c.trace.begin(name, false)
+}
+
+// endSpan ends a span started with startSpan
+func (c *SWUpdateClient) endSpan(span *traceSpan, err error, attributes map[string]interface{}) {
+	if span != nil {
+		c.trace.finish(span, err, attributes)
+	}
+}
+
+// traced runs a phase of the update in its own span
+func (c *SWUpdateClient) traced(name string, phase func() error) error {
+	if c.trace == nil {
+		return phase()
+	}
+	span := c.trace.begin(name, true)
+	err := phase()
+	c.trace.finish(span, err, nil)
+	return err
+}
+
+// traceDeviceEvent records a WebSocket event in the current phase's span
+func (c *SWUpdateClient) traceDeviceEvent(event SWUpdateEvent) {
+	if c.trace == nil {
+		return
+	}
+	attributes := map[string]interface{}{}
+	for key, value := range deviceEventData(event) {
+		attributes["swupdate."+key] = value
+	}
+	if event.Level != "" {
+		attributes["swupdate.level"] = event.Level
+	}
+	if event.Text != "" {
+		attributes["swupdate.text"] = event.Text
+	}
+	c.trace.event(event.Type, attributes)
+}
+
+// exportTrace ends the root span with the outcome of the update and writes the trace to
+// -trace-file and sends it to -trace-endpoint
+func (c *SWUpdateClient) exportTrace(ctx context.Context, err error) error {
+	outcome := updateOutcome(err)
+	c.trace.finish(c.trace.root, err, map[string]interface{}{
+		"swupdate.result":         outcome.Result,
+		"swupdate.artifact":       c.artifactName(),
+		"swupdate.version":        c.image.Version,
+		"swupdate.upload.bytes":   c.upload.sent.Load(),
+		"swupdate.upload.sha256":  c.image.SHA256,
+		"swupdate.upload.success": c.upload.complete.Load(),
+	})
+
+	data, err := json.Marshal(c.trace.otlp())
+	if err != nil {
+		return fmt.Errorf("failed to encode trace: %w", err)
+	}
+	if c.config.TraceFile != "" {
+		if err := appendTraceFile(c.config.TraceFile, data); err != nil {
+			return err
+		}
+	}
+	if c.config.TraceEndpoint != "" {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), traceExportTimeout)
+		defer cancel()
+		if err := sendTrace(ctx, c.config.TraceEndpoint, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// traceFileMu serialises appends of concurrent device updates to -trace-file
+var traceFileMu sync.Mutex
+
+// appendTraceFile appends a trace as one line of OTLP JSON
+func appendTraceFile(path string, data []byte) error {
+	traceFileMu.Lock()
+	defer traceFileMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create trace directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open trace file: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write trace file: %w", err)
+	}
+	return nil
+}
+
+// traceURL returns the OTLP/HTTP traces URL for an endpoint; a bare collector address gets /v1/traces
+func traceURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid trace endpoint %q, expected an http(s) URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// sendTrace exports a trace to an OTLP/HTTP collector using the JSON encoding
+func sendTrace(ctx context.Context, endpoint string, data []byte) error {
+	location, err := traceURL(endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", location, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create trace request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send trace: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to send trace: collector returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// OTLP JSON encoding of an ExportTraceServiceRequest
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 for ok, 2 for error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// otlpSpanKindInternal is the kind of every span, as they cover several requests each
+const otlpSpanKindInternal = 1
+
+// otlp encodes the trace for export
+func (t *updateTrace) otlp() otlpTraces {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]otlpSpan, 0, len(t.spans))
+	for _, span := range t.spans {
+		end := span.end
+		if end.IsZero() {
+			end = time.Now() // A phase interrupted by the end of the update
+		}
+		encoded := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            span.id,
+			ParentSpanID:      span.parentID,
+			Name:              span.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: unixNano(span.start),
+			EndTimeUnixNano:   unixNano(end),
+			Attributes:        otlpAttributes(span.attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		if span.err != "" {
+			encoded.Status = otlpStatus{Code: 2, Message: span.err}
+		}
+		for _, event := range span.events {
+			encoded.Events = append(encoded.Events, otlpEvent{TimeUnixNano: unixNano(event.time), Name: event.name, Attributes: otlpAttributes(event.attributes)})
+		}
+		spans = append(spans, encoded)
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]interface{}{
+			"service.name":    "swupdate-client",
+			"service.version": version,
+		})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "swupdate-client", Version: version}, Spans: spans}},
+	}}}
+}
+
+// unixNano formats a time as OTLP's nanoseconds since the epoch
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpAttributes encodes attributes sorted by key, leaving out empty strings
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var encoded []otlpKeyValue
+	for _, key := range keys {
+		var value otlpAnyValue
+		switch v := attributes[key].(type) {
+		case string:
+			if v == "" {
+				continue
+			}
+			value.StringValue = &v
+		case bool:
+			value.BoolValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		encoded = append(encoded, otlpKeyValue{Key: key, Value: value})
+	}
+	return encoded
+}
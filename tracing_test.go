@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spansByName indexes the spans of an exported trace
+func spansByName(t *testing.T, traces otlpTraces) map[string]otlpSpan {
+	t.Helper()
+
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected trace layout %+v", traces)
+	}
+	spans := map[string]otlpSpan{}
+	for _, span := range traces.ResourceSpans[0].ScopeSpans[0].Spans {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+// attribute returns the string form of a span or event attribute
+func attribute(attributes []otlpKeyValue, key string) string {
+	for _, attr := range attributes {
+		if attr.Key != key {
+			continue
+		}
+		switch {
+		case attr.Value.StringValue != nil:
+			return *attr.Value.StringValue
+		case attr.Value.IntValue != nil:
+			return *attr.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestTrace_File(t *testing.T) {
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{
+		{Type: "step", Step: "1", Number: "1", Name: "rootfs", Percent: "100"},
+		{Type: "status", Status: "SUCCESS"},
+	}
+	dev.downProbes = 1
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, RebootTimeout: 10 * time.Second, TraceFile: path}, 64<<10)
+
+	captureStdout(t, func() {
+		if code := runUpdate(context.Background(), client, true); code != 0 {
+			t.Errorf("runUpdate() = %d, want 0", code)
+		}
+	})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read trace file: %v", err)
+	}
+	var traces otlpTraces
+	if err := json.Unmarshal(data, &traces); err != nil {
+		t.Fatalf("Trace file is not OTLP JSON: %v\n%s", err, data)
+	}
+	spans := spansByName(t, traces)
+
+	root, ok := spans["update"]
+	if !ok || root.ParentSpanID != "" || len(root.TraceID) != 32 || attribute(root.Attributes, "swupdate.result") != "passed" {
+		t.Fatalf("Unexpected root span %+v", root)
+	}
+	if got := attribute(root.Attributes, "swupdate.upload.bytes"); got != "65536" {
+		t.Errorf("Root span upload bytes = %q, want 65536", got)
+	}
+	for _, name := range []string{"websocket-connect", "upload", "install", "restart", "reboot-wait"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("No %s span in %v", name, spans)
+			continue
+		}
+		if span.ParentSpanID != root.SpanID || span.TraceID != root.TraceID || span.Status.Code != 1 || span.EndTimeUnixNano < span.StartTimeUnixNano {
+			t.Errorf("Unexpected %s span %+v", name, span)
+		}
+	}
+
+	// The device may report progress before the upload request returns, so events land in
+	// whichever phase is in progress
+	events := append(spans["upload"].Events, spans["install"].Events...)
+	if len(events) != 2 || events[0].Name != "step" || attribute(events[0].Attributes, "swupdate.percent") != "100" {
+		t.Errorf("Expected the WebSocket events in the upload and install spans, got %+v", events)
+	}
+}
+
+func TestTrace_Endpoint(t *testing.T) {
+	received := make(chan otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var traces otlpTraces
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &traces) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		received <- traces
+	}))
+	defer collector.Close()
+
+	dev := newPhaseDevice(t)
+	dev.afterUpload = []SWUpdateEvent{
+		{Type: "message", Level: "ERROR", Text: "rootfs: checksum mismatch"},
+		{Type: "status", Status: "FAILURE"},
+	}
+	client := dev.client(t, Config{InstallTimeout: 5 * time.Second, TraceEndpoint: collector.URL}, 64<<10)
+
+	captureStdout(t, func() {
+		if code := runUpdate(context.Background(), client, false); code != 1 {
+			t.Errorf("runUpdate() = %d, want 1", code)
+		}
+	})
+
+	var traces otlpTraces
+	select {
+	case traces = <-received:
+	default:
+		t.Fatal("The collector received no trace")
+	}
+	spans := spansByName(t, traces)
+	if install := spans["install"]; install.Status.Code != 2 || !strings.Contains(install.Status.Message, "installation failed") {
+		t.Errorf("Expected the install span to fail, got %+v", install)
+	}
+	if root := spans["update"]; root.Status.Code != 2 || attribute(root.Attributes, "swupdate.result") != "failed" {
+		t.Errorf("Expected the root span to fail, got %+v", root)
+	}
+	if _, ok := spans["restart"]; ok {
+		t.Error("Unexpected restart span without -restart")
+	}
+}
+
+func TestTrace_TLSHandshake(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	client := NewSWUpdateClient(Config{Target: server.URL, InsecureTLS: true, ConnectTimeout: 5 * time.Second})
+	client.trace = newUpdateTrace(nil)
+	_ = client.traced("websocket-connect", func() error { return client.connectWebSocket(context.Background()) })
+	client.trace.finish(client.trace.root, nil, nil)
+
+	spans := spansByName(t, client.trace.otlp())
+	handshake, ok := spans["tls-handshake"]
+	if !ok || handshake.ParentSpanID != spans["websocket-connect"].SpanID || handshake.Status.Code != 1 {
+		t.Fatalf("Expected a successful handshake span within websocket-connect, got %+v", spans)
+	}
+	if got := attribute(handshake.Attributes, "tls.protocol.version"); got != "1.3" {
+		t.Errorf("tls.protocol.version = %q, want 1.3", got)
+	}
+}
+
+func TestTraceURL(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"http://localhost:4318", "http://localhost:4318/v1/traces"},
+		{"https://otel.example.com/", "https://otel.example.com/v1/traces"},
+		{"https://otel.example.com/custom/traces", "https://otel.example.com/custom/traces"},
+		{"localhost:4318", ""},
+	}
+	for _, tt := range tests {
+		got, err := traceURL(tt.endpoint)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("traceURL(%q) = %q, %v, want %q", tt.endpoint, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteUnits maps size suffixes to bytes. As in formatSize, K, M and G are powers of 1024.
+var byteUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"GIB", 1 << 30}, {"GB", 1 << 30}, {"G", 1 << 30},
+	{"MIB", 1 << 20}, {"MB", 1 << 20}, {"M", 1 << 20},
+	{"KIB", 1 << 10}, {"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteRate parses a throughput such as "2MB/s", "512K" or "100000" (bytes per second)
+func parseByteRate(s string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	text = strings.TrimSuffix(text, "/S")
+
+	multiplier := 1.0
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 2MB/s or 512KB/s", s)
+	}
+	// ParseFloat also accepts "inf" and "NaN"; a rate must be a finite number of at least 1 B/s
+	rate := value * multiplier
+	if math.IsNaN(rate) || rate < 1 || rate >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q, expected a positive rate such as 2MB/s or 512KB/s", s)
+	}
+	return int64(rate), nil
+}
+
+// formatRate formats a throughput in bytes per second
+func formatRate(rate float64) string {
+	switch {
+	case rate >= 1<<20:
+		return strconv.FormatFloat(rate/(1<<20), 'f', 2, 64) + " MB/s"
+	case rate >= 1<<10:
+		return strconv.FormatFloat(rate/(1<<10), 'f', 1, 64) + " KB/s"
+	}
+	return strconv.FormatFloat(rate, 'f', 0, 64) + " B/s"
+}
+
+// byteRate is a flag.Value for throughputs in bytes per second
+type byteRate int64
+
+func (r *byteRate) String() string {
+	if r == nil || *r == 0 {
+		return ""
+	}
+	return formatRate(float64(*r))
+}
+
+func (r *byteRate) Set(value string) error {
+	rate, err := parseByteRate(value)
+	if err != nil {
+		return err
+	}
+	*r = byteRate(rate)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{"100000", 100000},
+		{"2MB/s", 2 << 20},
+		{"512KB/s", 512 << 10},
+		{"1.5M", 3 << 19},
+		{"10 KiB/s", 10 << 10},
+		{"1gb", 1 << 30},
+		{"750B/s", 750},
+	}
+	for _, tt := range tests {
+		got, err := parseByteRate(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("parseByteRate(%q) = %d, %v; want %d", tt.input, got, err, tt.want)
+		}
+	}
+
+	for _, input := range []string{"", "fast", "-1MB/s", "2TB/s", "0", "0KB/s", "0.5B/s", "inf", "+Inf", "-inf", "NaN", "infMB/s", "1e30GB/s"} {
+		if _, err := parseByteRate(input); err == nil {
+			t.Errorf("parseByteRate(%q) expected error", input)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := map[float64]string{
+		500:             "500 B/s",
+		1536:            "1.5 KB/s",
+		2.5 * (1 << 20): "2.50 MB/s",
+	}
+	for rate, want := range tests {
+		if got := formatRate(rate); got != want {
+			t.Errorf("formatRate(%v) = %q, want %q", rate, got, want)
+		}
+	}
+}
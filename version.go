@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultDeviceVersionField is the JSON field read from the device version endpoint
+const defaultDeviceVersionField = "version"
+
+// semVersion is a version in semantic-versioning form. Any number of numeric components is
+// accepted, as sw-description versions often have four; build metadata is ignored.
+type semVersion struct {
+	Numbers    []uint64
+	Prerelease []string
+}
+
+// parseVersion parses versions such as "2.1.0", "v1.4", "2.0.0-rc.1" or "1.2.3.4+build5"
+func parseVersion(s string) (semVersion, error) {
+	var v semVersion
+
+	text := strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(text, "+"); i >= 0 {
+		text = text[:i]
+	}
+	if i := strings.Index(text, "-"); i >= 0 {
+		v.Prerelease = strings.Split(text[i+1:], ".")
+		text = text[:i]
+		for _, id := range v.Prerelease {
+			if id == "" {
+				return semVersion{}, fmt.Errorf("invalid version %q: empty pre-release identifier", s)
+			}
+		}
+	}
+
+	for _, part := range strings.Split(text, ".") {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semVersion{}, fmt.Errorf("invalid version %q", s)
+		}
+		v.Numbers = append(v.Numbers, n)
+	}
+	return v, nil
+}
+
+// compareVersions orders versions by semantic-versioning precedence, treating missing
+// components as zero. It returns -1, 0 or 1.
+func compareVersions(a, b semVersion) int {
+	for i := 0; i < len(a.Numbers) || i < len(b.Numbers); i++ {
+		var x, y uint64
+		if i < len(a.Numbers) {
+			x = a.Numbers[i]
+		}
+		if i < len(b.Numbers) {
+			y = b.Numbers[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A pre-release has lower precedence than the release itself
+	switch {
+	case len(a.Prerelease) == 0 && len(b.Prerelease) == 0:
+		return 0
+	case len(a.Prerelease) == 0:
+		return 1
+	case len(b.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(a.Prerelease) && i < len(b.Prerelease); i++ {
+		if c := comparePrerelease(a.Prerelease[i], b.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(a.Prerelease) < len(b.Prerelease):
+		return -1
+	case len(a.Prerelease) > len(b.Prerelease):
+		return 1
+	}
+	return 0
+}
+
+// comparePrerelease compares pre-release identifiers: numeric ones numerically and below alphanumeric ones
+func comparePrerelease(a, b string) int {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if x == y {
+			return 0
+		}
+		if x < y {
+			return -1
+		}
+		return 1
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// versionPolicyEnabled reports whether the installed version is known, so the version policy applies
+func (c *SWUpdateClient) versionPolicyEnabled() bool {
+	return c.config.DeviceVersion != "" || c.config.DeviceVersionURL != ""
+}
+
+// validateVersionOptions checks that at most one source of the installed version is configured
+func (c *SWUpdateClient) validateVersionOptions() error {
+	if c.config.DeviceVersion != "" && c.config.DeviceVersionURL != "" {
+		return fmt.Errorf("-device-version and -device-version-url cannot be combined")
+	}
+	return nil
+}
+
+// checkVersionPolicy compares the image version with the installed one and refuses downgrades
+// and reinstalls of the same version unless -allow-downgrade or -reinstall is set
+func (c *SWUpdateClient) checkVersionPolicy(ctx context.Context, desc *swDescription) error {
+	value, ok := desc.software()["version"]
+	if !ok {
+		return c.refuse(fmt.Errorf("cannot apply version policy: sw-description has no software version"))
+	}
+	imageText := fmt.Sprint(value)
+	imageVersion, err := parseVersion(imageText)
+	if err != nil {
+		return c.refuse(fmt.Errorf("cannot apply version policy to image: %w", err))
+	}
+
+	deviceText, err := c.installedVersion(ctx)
+	if err != nil {
+		return c.refuse(fmt.Errorf("cannot apply version policy: %w", err))
+	}
+	deviceVersion, err := parseVersion(deviceText)
+	if err != nil {
+		return c.refuse(fmt.Errorf("cannot apply version policy to installed firmware: %w", err))
+	}
+
+	data := map[string]interface{}{
+		"image_version":  imageText,
+		"device_version": deviceText,
+	}
+
+	var refusal error
+	switch compareVersions(imageVersion, deviceVersion) {
+	case 1:
+		data["decision"] = "upgrade"
+	case 0:
+		data["decision"] = "reinstall"
+		if !c.config.Reinstall {
+			refusal = fmt.Errorf("version %s is already installed (use -reinstall to install it again)", imageText)
+		}
+	default:
+		data["decision"] = "downgrade"
+		if !c.config.AllowDowngrade {
+			refusal = fmt.Errorf("image version %s is older than installed version %s (use -allow-downgrade to install it)",
+				imageText, deviceText)
+		}
+	}
+	data["allowed"] = refusal == nil
+
+	if refusal != nil {
+		c.logEvent("version-policy", "ERROR", fmt.Sprintf("Refusing %s from %s to %s", data["decision"], deviceText, imageText), data)
+		return refusal
+	}
+
+	level := "INFO"
+	if data["decision"] == "downgrade" {
+		level = "WARN"
+	}
+	c.logEvent("version-policy", level, fmt.Sprintf("Allowing %s from %s to %s", data["decision"], deviceText, imageText), data)
+	return nil
+}
+
+// installedVersion returns the firmware version installed on the device, either as configured
+// with -device-version or queried from -device-version-url
+func (c *SWUpdateClient) installedVersion(ctx context.Context) (string, error) {
+	if c.config.DeviceVersion != "" {
+		return c.config.DeviceVersion, nil
+	}
+
+	target, err := c.target()
+	if err != nil {
+		return "", err
+	}
+	versionURL := c.config.DeviceVersionURL
+	if !strings.Contains(versionURL, "://") {
+		versionURL = target.endpoint(versionURL).String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", versionURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create version request: %w", err)
+	}
+	if err := c.applyHeaders(req); err != nil {
+		return "", err
+	}
+	client, err := c.httpClient(target)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to query installed version: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read installed version: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("version query failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	field := c.config.DeviceVersionField
+	if field == "" {
+		field = defaultDeviceVersionField
+	}
+	return parseVersionResponse(body, field)
+}
+
+// parseVersionResponse extracts the version from a plain-text body or from a dotted field path
+// such as "firmware.version" in a JSON body
+func parseVersionResponse(body []byte, field string) (string, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return "", fmt.Errorf("device returned an empty version")
+	}
+	if trimmed[0] != '{' {
+		return string(trimmed), nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(trimmed, &value); err != nil {
+		return "", fmt.Errorf("invalid version response: %w", err)
+	}
+	for _, key := range strings.Split(field, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("version response has no field %q", field)
+		}
+		if value, ok = obj[key]; !ok {
+			return "", fmt.Errorf("version response has no field %q", field)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("version response field %q is not a string", field)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.2", "1.2.0", 0},
+		{"1.2.3", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.2.3.4", "1.2.3", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+		{"1.0.0+build.5", "1.0.0+build.7", 0},
+	}
+
+	for _, tt := range tests {
+		a, err := parseVersion(tt.a)
+		if err != nil {
+			t.Fatalf("parseVersion(%q) error = %v", tt.a, err)
+		}
+		b, err := parseVersion(tt.b)
+		if err != nil {
+			t.Fatalf("parseVersion(%q) error = %v", tt.b, err)
+		}
+		if got := compareVersions(a, b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseVersion_Invalid(t *testing.T) {
+	for _, s := range []string{"", "1..2", "1.x", "release-5", "1.0-"} {
+		if _, err := parseVersion(s); err == nil {
+			t.Errorf("parseVersion(%q) expected error", s)
+		}
+	}
+}
+
+func TestParseVersionResponse(t *testing.T) {
+	tests := []struct {
+		body, field, want string
+	}{
+		{"2.0.1\n", "version", "2.0.1"},
+		{`{"version": "2.0.1"}`, "version", "2.0.1"},
+		{`{"firmware": {"rootfs": {"version": "3.1"}}}`, "firmware.rootfs.version", "3.1"},
+		{`{"version": 4}`, "version", "4"},
+	}
+	for _, tt := range tests {
+		got, err := parseVersionResponse([]byte(tt.body), tt.field)
+		if err != nil || got != tt.want {
+			t.Errorf("parseVersionResponse(%q, %q) = %q, %v; want %q", tt.body, tt.field, got, err, tt.want)
+		}
+	}
+
+	if _, err := parseVersionResponse([]byte(`{"build": "1"}`), "version"); err == nil {
+		t.Error("Expected error for missing field")
+	}
+}
+
+func TestUploadFirmware_VersionPolicy(t *testing.T) {
+	image := buildSWU(testSWDescription, []byte("rootfs")) // software.version = 2.1.0
+	file := writeTestFile(t, "image.swu", image)
+
+	tests := []struct {
+		name           string
+		installed      string
+		allowDowngrade bool
+		reinstall      bool
+		wantDecision   string
+		wantErr        string
+	}{
+		{"upgrade", "2.0.9", false, false, "upgrade", ""},
+		{"reinstall refused", "2.1.0", false, false, "reinstall", "already installed"},
+		{"reinstall allowed", "v2.1", false, true, "reinstall", ""},
+		{"downgrade refused", "2.1.1", false, false, "downgrade", "older than installed"},
+		{"downgrade allowed", "3.0.0-rc.1", true, false, "downgrade", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newFirmwareReceiver(t)
+			client := NewSWUpdateClient(Config{
+				Target:         rcv.server.URL,
+				Filename:       file,
+				DeviceVersion:  tt.installed,
+				AllowDowngrade: tt.allowDowngrade,
+				Reinstall:      tt.reinstall,
+				JSONOutput:     true,
+				Timeout:        5 * time.Second,
+			})
+
+			var err error
+			output := captureStdout(t, func() { err = client.uploadFirmware(context.Background()) })
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				if rcv.data != nil {
+					t.Error("Firmware was uploaded despite the version policy")
+				}
+			} else if err != nil {
+				t.Fatalf("uploadFirmware() error = %v", err)
+			}
+
+			event := findLogEvent(t, output, "version-policy")
+			if event.Data["decision"] != tt.wantDecision || event.Data["allowed"] != (tt.wantErr == "") {
+				t.Errorf("Unexpected decision event: %+v", event.Data)
+			}
+			if event.Data["image_version"] != "2.1.0" || event.Data["device_version"] != tt.installed {
+				t.Errorf("Unexpected versions in event: %+v", event.Data)
+			}
+			if tt.wantErr != "" && event.Level != "ERROR" {
+				t.Errorf("Refusal logged at %s, want ERROR", event.Level)
+			}
+		})
+	}
+}
+
+func TestInstalledVersion_QueryEndpoint(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/swupdate/api/version" {
+			http.NotFound(w, r)
+			return
+		}
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"system": {"version": "1.4.2"}}`))
+	}))
+	defer server.Close()
+
+	client := NewSWUpdateClient(Config{
+		Target:             server.URL + "/swupdate/",
+		DeviceVersionURL:   "api/version",
+		DeviceVersionField: "system.version",
+		Token:              "secret",
+		Timeout:            5 * time.Second,
+	})
+
+	got, err := client.installedVersion(context.Background())
+	if err != nil || got != "1.4.2" {
+		t.Errorf("installedVersion() = %q, %v", got, err)
+	}
+	if gotAuth != "Bearer secret" {
+		t.Errorf("Version query sent Authorization %q", gotAuth)
+	}
+}
+
+func TestValidateVersionOptions(t *testing.T) {
+	client := NewSWUpdateClient(Config{DeviceVersion: "1.0", DeviceVersionURL: "/version"})
+	if err := client.validateVersionOptions(); err == nil {
+		t.Error("Expected error when combining -device-version and -device-version-url")
+	}
+}
+
+// captureStdout returns everything fn writes to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+
+	fn()
+	w.Close()
+	os.Stdout = orig
+	return string(<-done)
+}
+
+// findLogEvent returns the first JSON log message of the given type
+func findLogEvent(t *testing.T, output, msgType string) LogMessage {
+	t.Helper()
+
+	for _, line := range bytes.Split([]byte(output), []byte("\n")) {
+		var msg LogMessage
+		if json.Unmarshal(line, &msg) == nil && msg.Type == msgType {
+			return msg
+		}
+	}
+	t.Fatalf("No %q event in output:\n%s", msgType, output)
+	return LogMessage{}
+}